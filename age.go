@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/catalyzeio/gcm/gcm"
+)
+
+var (
+	ageRecipients string
+	identityPath  string
+)
+
+func init() {
+	commands["age-encrypt"] = func(args []string) { runAge(true, args) }
+	commands["age-decrypt"] = func(args []string) { runAge(false, args) }
+	commands["age-keygen"] = runAgeKeygen
+}
+
+// runAge encrypts or decrypts an age file.
+func runAge(enc bool, args []string) {
+	name := "age-decrypt"
+	if enc {
+		name = "age-encrypt"
+	}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&inputPath, "in", "", "The input file")
+	flags.StringVar(&outputPath, "out", "", "The output file")
+	flags.StringVar(&passphrasePath, "passphrase-file", "", "A file holding the passphrase on its first line")
+	if enc {
+		flags.StringVar(&ageRecipients, "r", "", "Comma separated age1... recipients")
+		flags.BoolVar(&armor, "armor", false, "Write the file in ASCII armor")
+	} else {
+		flags.StringVar(&identityPath, "i", "", "A file of AGE-SECRET-KEY-1... identities, one per line")
+	}
+	flags.Parse(args)
+	if inputPath == "" {
+		logger.Fatalln("-in is required")
+	}
+	if outputPath == "" {
+		logger.Fatalln("-out is required")
+	}
+
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer inFile.Close()
+	if enc {
+		err = ageEncrypt(inFile, ageRecipientsFromFlags())
+	} else {
+		err = ageDecrypt(inFile, ageIdentitiesFromFlags())
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		log.Fatalln(err.Error())
+	}
+}
+
+// ageRecipientsFromFlags returns the recipients given by -r or
+// -passphrase-file.
+func ageRecipientsFromFlags() []gcm.AgeRecipient {
+	if (ageRecipients == "") == (passphrasePath == "") {
+		logger.Fatalln("Either -r or -passphrase-file is required")
+	}
+	if passphrasePath != "" {
+		r, err := gcm.NewAgeScryptRecipient(readPassphrase(passphrasePath))
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		return []gcm.AgeRecipient{r}
+	}
+	var recipients []gcm.AgeRecipient
+	for _, s := range strings.Split(ageRecipients, ",") {
+		r, err := gcm.ParseAgeRecipient(strings.TrimSpace(s))
+		if err != nil {
+			logger.Fatalf("Invalid -r: %s.", err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients
+}
+
+// ageIdentitiesFromFlags returns the identities given by -i or
+// -passphrase-file.
+func ageIdentitiesFromFlags() []gcm.AgeIdentity {
+	if (identityPath == "") == (passphrasePath == "") {
+		logger.Fatalln("Either -i or -passphrase-file is required")
+	}
+	if passphrasePath != "" {
+		return []gcm.AgeIdentity{gcm.NewAgeScryptIdentity(readPassphrase(passphrasePath))}
+	}
+	ids, err := gcm.ReadAgeIdentities(identityPath)
+	if err != nil {
+		logger.Fatalf("Invalid -i: %s.", err)
+	}
+	if len(ids) == 0 {
+		logger.Fatalf("Invalid -i: %s has no identities.", identityPath)
+	}
+	return ids
+}
+
+func ageEncrypt(inFile *os.File, recipients []gcm.AgeRecipient) error {
+	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	var dst io.WriteCloser = outFile
+	if armor {
+		dst = gcm.NewAgeArmorWriter(outFile)
+	}
+	w, err := gcm.NewAgeEncryptWriter(dst, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, inFile); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if armor {
+		if err := dst.Close(); err != nil {
+			return err
+		}
+	}
+	return outFile.Close()
+}
+
+func ageDecrypt(inFile *os.File, identities []gcm.AgeIdentity) error {
+	r, err := gcm.NewAgeDecryptReader(inFile, identities...)
+	if err != nil {
+		return err
+	}
+	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	if _, err := io.Copy(outFile, r); err != nil {
+		return err
+	}
+	return outFile.Close()
+}
+
+// runAgeKeygen writes a new age identity to -out and prints its recipient.
+func runAgeKeygen(args []string) {
+	flags := flag.NewFlagSet("age-keygen", flag.ExitOnError)
+	flags.StringVar(&outputPath, "out", "", "The file to write the identity to")
+	flags.Parse(args)
+	if outputPath == "" {
+		logger.Fatalln("-out is required")
+	}
+	id, err := gcm.GenerateAgeIdentity()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	data := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), id.Recipient(), id)
+	if err := ioutil.WriteFile(outputPath, []byte(data), 0600); err != nil {
+		log.Fatalln(err.Error())
+	}
+	fmt.Println(id.Recipient())
+}
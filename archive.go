@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/catalyzeio/gcm/gcm"
+)
+
+func init() {
+	commands["pack"] = runPack
+	commands["unpack"] = runUnpack
+	commands["list"] = runList
+}
+
+// parseArchiveFlags parses the flags shared by the archive commands and
+// returns the key and AAD.
+func parseArchiveFlags(name string, args []string, needOutput bool) ([]byte, []byte) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&keyString, "K", "", "The hex encoded key")
+	flags.StringVar(&inputPath, "in", "", "The input file or directory")
+	if needOutput {
+		flags.StringVar(&outputPath, "out", "", "The output file or directory")
+		flags.BoolVar(&progress, "progress", false, "Report progress on stderr")
+	}
+	flags.Parse(args)
+	if keyString == "" {
+		logger.Fatalln("-K is required")
+	}
+	if inputPath == "" {
+		logger.Fatalln("-in is required")
+	}
+	if needOutput && outputPath == "" {
+		logger.Fatalln("-out is required")
+	}
+	aad, err := hex.DecodeString(gcm.AAD)
+	if err != nil {
+		panic(err)
+	}
+	return parseKey(), aad
+}
+
+func archiveOptions() *gcm.Options {
+	opts := &gcm.Options{}
+	if progress {
+		opts.Progress = newProgressLogger()
+	}
+	return opts
+}
+
+func runPack(args []string) {
+	key, aad := parseArchiveFlags("pack", args, true)
+	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer outFile.Close()
+	manifest, err := gcm.Pack(outFile, inputPath, key, aad, archiveOptions())
+	if err == nil {
+		err = outFile.Close()
+	}
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	logger.Printf("Packed %d entries", len(manifest.Entries))
+}
+
+func runUnpack(args []string) {
+	key, aad := parseArchiveFlags("unpack", args, true)
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer inFile.Close()
+	manifest, err := gcm.Unpack(inFile, outputPath, key, aad, archiveOptions())
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	logger.Printf("Unpacked %d entries", len(manifest.Entries))
+}
+
+func runList(args []string) {
+	key, aad := parseArchiveFlags("list", args, false)
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer inFile.Close()
+	manifest, err := gcm.List(inFile, key, aad)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	for _, entry := range manifest.Entries {
+		fmt.Printf("%s %12d %s %s\n", entry.Mode, entry.Size, entry.ModTime.Format("2006-01-02 15:04"), entry.Path)
+	}
+}
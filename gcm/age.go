@@ -0,0 +1,835 @@
+package gcm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// An age v1 file (https://age-encryption.org/v1) starts with a text header
+//
+//	age-encryption.org/v1
+//	-> X25519 <ephemeral share>
+//	<file key wrapped for the recipient, base64 in lines of 64 columns>
+//	--- <HMAC-SHA-256 of the header up to and including "---">
+//
+// with one stanza for each recipient, followed by a 16 byte nonce and the
+// payload. The payload is split into 64 KiB chunks, each sealed with
+// ChaCha20-Poly1305 under a key derived from the random file key and the
+// nonce. Chunk nonces are an 11 byte big-endian counter followed by a byte
+// that is 1 for the last chunk, so a truncated payload does not authenticate.
+//
+// X25519 recipients wrap the file key with a key agreed with an ephemeral
+// X25519 key, and scrypt recipients with a key derived from a passphrase.
+// Other stanzas, such as those of plugins, are skipped. Files can also be
+// armored, as strict PEM with 64 column lines and no checksum.
+//
+// The payload does not go through the chunk loop of EncryptReader and
+// DecryptWriteCloser, which seal 1 MiB chunks with AES-GCM under nonces
+// counted from an IV and find the end of a stream by its short last chunk.
+// age differs in each of these, and its last chunk may be full, so a full
+// chunk can only be placed by trying both nonces. Like OpenPGP, age files are
+// encrypted with a writer and decrypted with a reader, as in the age library
+// itself: the header has to be read and a file key unwrapped before any of
+// the payload can be used, so NewAgeDecryptReader returns ErrWrongKey before
+// the caller has handed it a destination or read any data.
+
+const (
+	ageIntro          = "age-encryption.org/v1"
+	ageFileKeySize    = 16
+	ageNonceSize      = 16
+	ageChunkSize      = 64 * 1024
+	ageSealedSize     = ageChunkSize + chacha20poly1305.Overhead
+	ageColumns        = 64
+	ageBytesPerLine   = ageColumns / 4 * 3
+	ageMaxHeaderSize  = 2 << 20
+	ageMaxStanzas     = 1024
+	ageMaxStanzaArgs  = 128
+	ageX25519Label    = "age-encryption.org/v1/X25519"
+	ageScryptLabel    = "age-encryption.org/v1/scrypt"
+	ageScryptSaltSize = 16
+	// ageScryptWorkFactor takes about a second, and ageMaxWorkFactor about
+	// 15 seconds, on a current machine
+	ageScryptWorkFactor = 18
+	ageMaxWorkFactor    = 22
+
+	ageArmorBegin         = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageArmorEnd           = "-----END AGE ENCRYPTED FILE-----"
+	ageArmorMaxWhitespace = 1024
+)
+
+var (
+	ageB64 = base64.RawStdEncoding.Strict()
+
+	errAgeHeaderMAC = errors.New("The age header failed to authenticate")
+	errAgeTruncated = errors.New("The age file is truncated")
+)
+
+// ageStanza is a recipient stanza of an age header.
+type ageStanza struct {
+	typ  string
+	args []string
+	body []byte
+}
+
+// marshal appends the stanza to b. The body always ends with a line shorter
+// than 64 columns, which may be empty.
+func (s *ageStanza) marshal(b []byte) []byte {
+	b = append(b, "-> "...)
+	b = append(b, s.typ...)
+	for _, arg := range s.args {
+		b = append(append(b, ' '), arg...)
+	}
+	b = append(b, '\n')
+	body := ageB64.EncodeToString(s.body)
+	for len(body) >= ageColumns {
+		b = append(append(b, body[:ageColumns]...), '\n')
+		body = body[ageColumns:]
+	}
+	return append(append(b, body...), '\n')
+}
+
+// ageDecode decodes canonical unpadded base64, which may not contain line
+// breaks.
+func ageDecode(s string) ([]byte, error) {
+	if strings.ContainsAny(s, "\r\n") {
+		return nil, errors.New("Invalid base64 in age header")
+	}
+	return ageB64.DecodeString(s)
+}
+
+// ageWrap seals a file key with a wrapping key. The key is only used once,
+// so the nonce is zero.
+func ageWrap(key, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+// ageUnwrap opens a file key sealed by ageWrap, returning ErrWrongKey if the
+// key does not open it.
+func ageUnwrap(key, body []byte) ([]byte, error) {
+	if len(body) != ageFileKeySize+chacha20poly1305.Overhead {
+		return nil, errors.New("Invalid age file key size")
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return fileKey, nil
+}
+
+func ageHeaderMAC(fileKey, hdr []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nil, "header", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(hdr)
+	return mac.Sum(nil), nil
+}
+
+func agePayloadCipher(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, "payload", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func ageNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// AgeRecipient is a recipient an age file can be encrypted to.
+type AgeRecipient interface {
+	wrap(fileKey []byte) (*ageStanza, error)
+}
+
+// AgeIdentity is an identity that can decrypt age files.
+type AgeIdentity interface {
+	// unwrap returns the file key sealed in one of the stanzas, or
+	// ErrWrongKey if none of them is for the identity.
+	unwrap(stanzas []*ageStanza) ([]byte, error)
+}
+
+// AgeX25519Recipient is an age X25519 public key, written as age1...
+type AgeX25519Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// ParseAgeRecipient parses an age X25519 public key.
+func ParseAgeRecipient(s string) (*AgeX25519Recipient, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid age recipient: %s", err)
+	}
+	if hrp != "age" {
+		return nil, fmt.Errorf("Invalid age recipient type %q", hrp)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid age recipient: %s", err)
+	}
+	return &AgeX25519Recipient{key: key}, nil
+}
+
+func (r *AgeX25519Recipient) String() string {
+	return bech32Encode("age", r.key.Bytes())
+}
+
+// x25519WrappingKey derives the key that wraps the file key from the shared
+// secret, the ephemeral share and the recipient's public key.
+func x25519WrappingKey(shared, share, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, share...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, ageX25519Label, chacha20poly1305.KeySize)
+}
+
+func (r *AgeX25519Recipient) wrap(fileKey []byte) (*ageStanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(r.key)
+	if err != nil {
+		return nil, err
+	}
+	share := ephemeral.PublicKey().Bytes()
+	key, err := x25519WrappingKey(shared, share, r.key.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	body, err := ageWrap(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ageStanza{typ: "X25519", args: []string{ageB64.EncodeToString(share)}, body: body}, nil
+}
+
+// AgeX25519Identity is an age X25519 secret key, written as
+// AGE-SECRET-KEY-1...
+type AgeX25519Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateAgeIdentity returns a new random X25519 identity.
+func GenerateAgeIdentity() (*AgeX25519Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &AgeX25519Identity{key: key}, nil
+}
+
+// ParseAgeIdentity parses an age X25519 secret key.
+func ParseAgeIdentity(s string) (*AgeX25519Identity, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid age identity: %s", err)
+	}
+	if hrp != "age-secret-key-" {
+		return nil, errors.New("Invalid age identity type")
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid age identity: %s", err)
+	}
+	return &AgeX25519Identity{key: key}, nil
+}
+
+// Recipient returns the public key of the identity.
+func (i *AgeX25519Identity) Recipient() *AgeX25519Recipient {
+	return &AgeX25519Recipient{key: i.key.PublicKey()}
+}
+
+func (i *AgeX25519Identity) String() string {
+	return bech32Encode("AGE-SECRET-KEY-", i.key.Bytes())
+}
+
+func (i *AgeX25519Identity) unwrap(stanzas []*ageStanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.typ != "X25519" {
+			continue
+		}
+		if len(s.args) != 1 {
+			return nil, errors.New("Invalid age X25519 stanza")
+		}
+		share, err := ageDecode(s.args[0])
+		if err != nil {
+			return nil, errors.New("Invalid age X25519 stanza")
+		}
+		pub, err := ecdh.X25519().NewPublicKey(share)
+		if err != nil {
+			return nil, errors.New("Invalid age X25519 stanza")
+		}
+		// low order shares give an all zero secret, which ECDH rejects
+		shared, err := i.key.ECDH(pub)
+		if err != nil {
+			return nil, errors.New("Invalid age X25519 share")
+		}
+		key, err := x25519WrappingKey(shared, share, i.key.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+		fileKey, err := ageUnwrap(key, s.body)
+		if err == ErrWrongKey {
+			continue
+		}
+		return fileKey, err
+	}
+	return nil, ErrWrongKey
+}
+
+// ReadAgeIdentities reads the X25519 identities in the file at p, one per
+// line, as written by age-keygen. Empty lines and lines starting with # are
+// skipped.
+func ReadAgeIdentities(p string) ([]AgeIdentity, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseAgeIdentities(f)
+}
+
+func parseAgeIdentities(r io.Reader) ([]AgeIdentity, error) {
+	var ids []AgeIdentity
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, err := ParseAgeIdentity(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid age identity on line %d", line)
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// AgeScryptRecipient encrypts age files with a passphrase. A file with a
+// passphrase cannot have any other recipient.
+type AgeScryptRecipient struct {
+	passphrase []byte
+	workFactor int
+}
+
+// NewAgeScryptRecipient returns a recipient for the passphrase.
+func NewAgeScryptRecipient(passphrase []byte) (*AgeScryptRecipient, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("The passphrase is empty")
+	}
+	return &AgeScryptRecipient{passphrase: passphrase, workFactor: ageScryptWorkFactor}, nil
+}
+
+func ageScryptKey(passphrase, salt []byte, workFactor int) ([]byte, error) {
+	salt = append([]byte(ageScryptLabel), salt...)
+	return scrypt.Key(passphrase, salt, 1<<uint(workFactor), 8, 1, chacha20poly1305.KeySize)
+}
+
+func (r *AgeScryptRecipient) wrap(fileKey []byte) (*ageStanza, error) {
+	salt := make([]byte, ageScryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := ageScryptKey(r.passphrase, salt, r.workFactor)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ageWrap(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{ageB64.EncodeToString(salt), strconv.Itoa(r.workFactor)}
+	return &ageStanza{typ: "scrypt", args: args, body: body}, nil
+}
+
+// AgeScryptIdentity decrypts age files encrypted with a passphrase.
+type AgeScryptIdentity struct {
+	passphrase    []byte
+	maxWorkFactor int
+}
+
+// NewAgeScryptIdentity returns an identity for the passphrase. Files whose
+// scrypt work factor is above 22 are rejected, since they would take minutes
+// to decrypt.
+func NewAgeScryptIdentity(passphrase []byte) *AgeScryptIdentity {
+	return &AgeScryptIdentity{passphrase: passphrase, maxWorkFactor: ageMaxWorkFactor}
+}
+
+func (i *AgeScryptIdentity) unwrap(stanzas []*ageStanza) ([]byte, error) {
+	var s *ageStanza
+	for _, stanza := range stanzas {
+		if stanza.typ == "scrypt" {
+			s = stanza
+		}
+	}
+	if s == nil {
+		return nil, ErrWrongKey
+	}
+	if len(stanzas) != 1 {
+		return nil, errors.New("An age scrypt stanza must be the only one")
+	}
+	if len(s.args) != 2 {
+		return nil, errors.New("Invalid age scrypt stanza")
+	}
+	salt, err := ageDecode(s.args[0])
+	if err != nil || len(salt) != ageScryptSaltSize {
+		return nil, errors.New("Invalid age scrypt salt")
+	}
+	// the work factor must be written in canonical decimal
+	w := s.args[1]
+	if w[0] < '1' || w[0] > '9' || strings.Trim(w, "0123456789") != "" {
+		return nil, errors.New("Invalid age scrypt work factor")
+	}
+	workFactor, err := strconv.Atoi(w)
+	if err != nil || workFactor > i.maxWorkFactor {
+		return nil, fmt.Errorf("The age scrypt work factor %s is too large", w)
+	}
+	key, err := ageScryptKey(i.passphrase, salt, workFactor)
+	if err != nil {
+		return nil, err
+	}
+	return ageUnwrap(key, s.body)
+}
+
+// ageEncryptWriter seals the payload written to it in chunks. A full chunk
+// is held until more data shows that it is not the last one.
+type ageEncryptWriter struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	index  uint64
+	closed bool
+}
+
+// NewAgeEncryptWriter returns a writer that encrypts the data written to it
+// into an age file in dst, for each of the recipients. The file is only
+// complete once the writer is closed; dst is not closed. Wrap dst in
+// NewAgeArmorWriter for an armored file.
+func NewAgeEncryptWriter(dst io.Writer, recipients ...AgeRecipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("No age recipients")
+	}
+	fileKey := make([]byte, ageFileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	hdr := []byte(ageIntro + "\n")
+	for _, r := range recipients {
+		if _, ok := r.(*AgeScryptRecipient); ok && len(recipients) > 1 {
+			return nil, errors.New("An age passphrase cannot be combined with other recipients")
+		}
+		s, err := r.wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		hdr = s.marshal(hdr)
+	}
+	hdr = append(hdr, "---"...)
+	mac, err := ageHeaderMAC(fileKey, hdr)
+	if err != nil {
+		return nil, err
+	}
+	hdr = append(append(append(hdr, ' '), ageB64.EncodeToString(mac)...), '\n')
+
+	nonce := make([]byte, ageNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := agePayloadCipher(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(append(hdr, nonce...)); err != nil {
+		return nil, err
+	}
+	return &ageEncryptWriter{dst: dst, aead: aead, buf: make([]byte, 0, ageChunkSize)}, nil
+}
+
+func (w *ageEncryptWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("The age writer is closed")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if len(w.buf) == ageChunkSize {
+			if err := w.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		read := ageChunkSize - len(w.buf)
+		if read > len(p) {
+			read = len(p)
+		}
+		w.buf = append(w.buf, p[:read]...)
+		p = p[read:]
+	}
+	return n, nil
+}
+
+func (w *ageEncryptWriter) seal(last bool) error {
+	sealed := w.aead.Seal(nil, ageNonce(w.index, last), w.buf, nil)
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk, which is only empty if nothing was written.
+func (w *ageEncryptWriter) Close() error {
+	if w.closed {
+		return errors.New("The age writer is closed")
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// ageHeaderReader reads the lines of an age header, keeping the bytes read
+// for the MAC.
+type ageHeaderReader struct {
+	br  *bufio.Reader
+	raw []byte
+}
+
+// line returns the next line without its line feed.
+func (r *ageHeaderReader) line() (string, error) {
+	start := len(r.raw)
+	for {
+		frag, err := r.br.ReadSlice('\n')
+		if len(r.raw)+len(frag) > ageMaxHeaderSize {
+			return "", errors.New("The age header is too large")
+		}
+		r.raw = append(r.raw, frag...)
+		switch err {
+		case nil:
+			return string(r.raw[start : len(r.raw)-1]), nil
+		case bufio.ErrBufferFull:
+		case io.EOF:
+			return "", errors.New("The age header is truncated")
+		default:
+			return "", err
+		}
+	}
+}
+
+// ageSplitArgs splits a stanza or closing line into its prefix and
+// arguments. A line with invalid arguments is returned whole as the prefix.
+func ageSplitArgs(line string) (string, []string) {
+	prefix, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return line, nil
+	}
+	args := strings.Split(rest, " ")
+	if len(args) > ageMaxStanzaArgs {
+		return line, nil
+	}
+	for _, arg := range args {
+		if arg == "" || strings.IndexFunc(arg, func(c rune) bool { return c < 33 || c > 126 }) >= 0 {
+			return line, nil
+		}
+	}
+	return prefix, args
+}
+
+// readAgeHeader parses the header of an age file, returning its stanzas, the
+// bytes covered by the MAC and the MAC.
+func readAgeHeader(br *bufio.Reader) ([]*ageStanza, []byte, []byte, error) {
+	r := &ageHeaderReader{br: br}
+	intro, err := r.line()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if intro != ageIntro {
+		return nil, nil, nil, errors.New("Not an age v1 file")
+	}
+	var stanzas []*ageStanza
+	for {
+		line, err := r.line()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if strings.HasPrefix(line, "---") {
+			prefix, args := ageSplitArgs(line)
+			if prefix != "---" || len(args) != 1 {
+				return nil, nil, nil, errors.New("Invalid age header closing line")
+			}
+			mac, err := ageDecode(args[0])
+			if err != nil || len(mac) != sha256.Size {
+				return nil, nil, nil, errors.New("Invalid age header MAC")
+			}
+			if len(stanzas) == 0 {
+				return nil, nil, nil, errors.New("The age header has no recipients")
+			}
+			hdr := r.raw[:len(r.raw)-len(line)-1+len("---")]
+			return stanzas, hdr, mac, nil
+		}
+		if len(stanzas) == ageMaxStanzas {
+			return nil, nil, nil, errors.New("The age header has too many recipients")
+		}
+		prefix, args := ageSplitArgs(line)
+		if prefix != "->" || len(args) == 0 {
+			return nil, nil, nil, errors.New("Invalid age stanza")
+		}
+		s := &ageStanza{typ: args[0], args: args[1:]}
+		for {
+			line, err := r.line()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			b, err := ageDecode(line)
+			if err != nil || len(b) > ageBytesPerLine {
+				return nil, nil, nil, errors.New("Invalid age stanza body")
+			}
+			s.body = append(s.body, b...)
+			// the body ends with a short line
+			if len(b) < ageBytesPerLine {
+				break
+			}
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+// ageChunkReader opens the payload chunks of an age file, returning io.EOF
+// only once the last chunk has been authenticated.
+type ageChunkReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	index uint64
+	out   []byte
+	err   error
+}
+
+func (r *ageChunkReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.out, r.err = r.next()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// next opens the next chunk. A full chunk is tried as a middle chunk first,
+// since the last chunk is only short if the payload is not a multiple of the
+// chunk size.
+func (r *ageChunkReader) next() ([]byte, error) {
+	peek, err := r.src.Peek(ageSealedSize + 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	sealed := peek
+	if len(sealed) > ageSealedSize {
+		sealed = sealed[:ageSealedSize]
+	}
+	if len(sealed) < chacha20poly1305.Overhead {
+		return nil, errAgeTruncated
+	}
+	if len(sealed) == chacha20poly1305.Overhead && r.index > 0 {
+		return nil, errors.New("The last chunk of the age file is empty")
+	}
+	last := len(sealed) < ageSealedSize
+	opened, err := r.aead.Open(nil, ageNonce(r.index, last), sealed, nil)
+	if err != nil && !last {
+		last = true
+		opened, err = r.aead.Open(nil, ageNonce(r.index, last), sealed, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Chunk %d of the age file failed to authenticate", r.index)
+	}
+	r.src.Discard(len(sealed))
+	r.index++
+	if !last {
+		return opened, nil
+	}
+	if len(peek) > len(sealed) {
+		return opened, errors.New("Unexpected data after the end of the age file")
+	}
+	return opened, io.EOF
+}
+
+// NewAgeDecryptReader returns a reader of the data in an age file read from
+// src, armored or not, using the first of the identities that unwraps the
+// file key. It returns ErrWrongKey if none of them does. As with
+// DecryptWriteCloser, data is returned as each chunk authenticates, and the
+// file is only known to be complete once the reader returns io.EOF.
+func NewAgeDecryptReader(src io.Reader, identities ...AgeIdentity) (io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("No age identities")
+	}
+	br := bufio.NewReader(src)
+	if isAgeArmored(br) {
+		br = bufio.NewReader(&ageArmorReader{br: br})
+	}
+	stanzas, hdr, mac, err := readAgeHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	var fileKey []byte
+	for _, id := range identities {
+		if fileKey, err = id.unwrap(stanzas); err != ErrWrongKey {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	expected, err := ageHeaderMAC(fileKey, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(expected, mac) {
+		return nil, errAgeHeaderMAC
+	}
+
+	nonce := make([]byte, ageNonceSize)
+	if _, err := io.ReadFull(br, nonce); err != nil {
+		return nil, errAgeTruncated
+	}
+	aead, err := agePayloadCipher(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &ageChunkReader{src: bufio.NewReaderSize(br, ageSealedSize+1), aead: aead}, nil
+}
+
+// NewAgeArmorWriter returns a writer that armors the age file written to it
+// into dst. The armor is only complete once the writer is closed; dst is not
+// closed.
+func NewAgeArmorWriter(dst io.Writer) io.WriteCloser {
+	lines := &lineWriter{dst: dst}
+	return &armorWriter{
+		dst:        dst,
+		enc:        base64.NewEncoder(base64.StdEncoding, lines),
+		lines:      lines,
+		begin:      ageArmorBegin,
+		end:        ageArmorEnd,
+		noChecksum: true,
+	}
+}
+
+// isAgeArmored reports whether the input starts with the age armor begin
+// line, without consuming any of it.
+func isAgeArmored(br *bufio.Reader) bool {
+	peek, _ := br.Peek(len(ageArmorBegin) + ageArmorMaxWhitespace)
+	trimmed := bytes.TrimLeft(peek, " \t\r\n")
+	return bytes.HasPrefix(trimmed, []byte(ageArmorBegin))
+}
+
+// ageArmorReader decodes an armored age file. Unlike armorReader it is
+// strict: every line but the last must have 64 columns, and only whitespace
+// may surround the armor.
+type ageArmorReader struct {
+	br *bufio.Reader
+
+	begun bool
+	short bool
+	space int
+	out   []byte
+	err   error
+}
+
+func (r *ageArmorReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.readLine()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// readLine decodes the next line of the armor into r.out, returning io.EOF
+// after the end line.
+func (r *ageArmorReader) readLine() error {
+	line, err := r.br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err == io.EOF && line == "" {
+		return errors.New("The age armor is truncated")
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	switch {
+	case !r.begun:
+		if strings.TrimSpace(line) == "" {
+			r.space += len(line) + 1
+			if r.space > ageArmorMaxWhitespace {
+				return errors.New("Too much whitespace before the age armor")
+			}
+			return nil
+		}
+		if line != ageArmorBegin {
+			return errors.New("Invalid age armor begin line")
+		}
+		r.begun = true
+		return nil
+	case line == ageArmorEnd:
+		return r.finish()
+	case r.short:
+		return errors.New("Invalid age armor end line")
+	case line == "" || len(line) > ageColumns:
+		return errors.New("Invalid age armor line length")
+	}
+	decoded, err := base64.StdEncoding.Strict().DecodeString(line)
+	if err != nil || strings.ContainsAny(line, "\r\n") {
+		return errors.New("Invalid age armor encoding")
+	}
+	// only the last line is shorter than 64 columns
+	r.short = len(decoded) < ageBytesPerLine
+	r.out = decoded
+	return nil
+}
+
+// finish checks that only whitespace follows the end line.
+func (r *ageArmorReader) finish() error {
+	rest, err := ioutil.ReadAll(io.LimitReader(r.br, ageArmorMaxWhitespace))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return errors.New("Unexpected data after the age armor")
+	}
+	if len(rest) == ageArmorMaxWhitespace {
+		return errors.New("Too much whitespace after the age armor")
+	}
+	return io.EOF
+}
@@ -0,0 +1,247 @@
+package gcm
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ageVector is a test vector of the age test kit in testdata/age.
+type ageVector struct {
+	expect     string
+	payload    []byte
+	identities []AgeIdentity
+	file       []byte
+}
+
+func readAgeVector(t *testing.T, path string) (*ageVector, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", path, err)
+	}
+	v := &ageVector{}
+	compressed := false
+	supported := true
+	for {
+		line, rest, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			t.Fatalf("Invalid test vector %s", path)
+		}
+		data = rest
+		if len(line) == 0 {
+			break
+		}
+		key, value, _ := strings.Cut(string(line), ": ")
+		switch key {
+		case "expect":
+			v.expect = value
+		case "payload":
+			v.payload, _ = hex.DecodeString(value)
+		case "identity":
+			id, err := ParseAgeIdentity(value)
+			if err != nil {
+				// hybrid post-quantum identities are not supported
+				supported = false
+				continue
+			}
+			v.identities = append(v.identities, id)
+		case "passphrase":
+			v.identities = append(v.identities, NewAgeScryptIdentity([]byte(value)))
+		case "compressed":
+			compressed = true
+		}
+	}
+	if len(v.identities) == 0 && supported {
+		// the header is still parsed, and must fail before any identity
+		// is tried
+		id, err := GenerateAgeIdentity()
+		if err != nil {
+			t.Fatalf("Failed to generate identity: %s", err)
+		}
+		v.identities = append(v.identities, id)
+	}
+	v.file = data
+	if compressed {
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to decompress %s: %s", path, err)
+		}
+		if v.file, err = ioutil.ReadAll(r); err != nil {
+			t.Fatalf("Failed to decompress %s: %s", path, err)
+		}
+	}
+	return v, supported
+}
+
+func TestAgeVectors(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "age", "*"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("Failed to find the age test vectors: %v", err)
+	}
+	tested := 0
+	for _, path := range paths {
+		if filepath.Base(path) == "README.md" {
+			continue
+		}
+		v, supported := readAgeVector(t, path)
+		if !supported {
+			continue
+		}
+		tested++
+		name := filepath.Base(path)
+
+		r, err := NewAgeDecryptReader(bytes.NewReader(v.file), v.identities...)
+		switch {
+		case err == nil:
+		case v.expect == "no match":
+			if err != ErrWrongKey {
+				t.Errorf("%s failed. Expected ErrWrongKey, got %v", name, err)
+			}
+			continue
+		case v.expect == "HMAC failure":
+			if err != errAgeHeaderMAC {
+				t.Errorf("%s failed. Expected a header MAC failure, got %v", name, err)
+			}
+			continue
+		case v.expect == "header failure" || v.expect == "armor failure":
+			if err == ErrWrongKey || err == errAgeHeaderMAC {
+				t.Errorf("%s failed. Expected a %s, got %v", name, v.expect, err)
+			}
+			continue
+		default:
+			t.Errorf("%s failed. Expected %s, got %v", name, v.expect, err)
+			continue
+		}
+		if v.expect != "success" && v.expect != "payload failure" && v.expect != "armor failure" {
+			t.Errorf("%s failed. Expected %s, but the header was accepted", name, v.expect)
+			continue
+		}
+
+		// the plaintext released before any error must match the payload
+		out, err := ioutil.ReadAll(r)
+		if v.expect == "success" && err != nil {
+			t.Errorf("%s failed: %s", name, err)
+		} else if v.expect != "success" && err == nil {
+			t.Errorf("%s failed. Expected %s, got success", name, v.expect)
+		}
+		if sum := sha256.Sum256(out); v.payload != nil && !bytes.Equal(sum[:], v.payload) {
+			t.Errorf("%s failed. The payload differs after %d bytes", name, len(out))
+		}
+	}
+	if tested < 100 {
+		t.Errorf("Failed. Only %d age test vectors were run", tested)
+	}
+}
+
+func ageEncrypt(t *testing.T, plainText []byte, armor bool, recipients ...AgeRecipient) []byte {
+	var buf bytes.Buffer
+	var dst io.WriteCloser = nopCloser{&buf}
+	if armor {
+		dst = NewAgeArmorWriter(&buf)
+	}
+	w, err := NewAgeEncryptWriter(dst, recipients...)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %s", err)
+	}
+	if _, err := w.Write(plainText); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func ageDecrypt(file []byte, identities ...AgeIdentity) ([]byte, error) {
+	r, err := NewAgeDecryptReader(bytes.NewReader(file), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	alice, err := GenerateAgeIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %s", err)
+	}
+	bob, err := GenerateAgeIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %s", err)
+	}
+	parsed, err := ParseAgeIdentity(alice.String())
+	if err != nil || parsed.Recipient().String() != alice.Recipient().String() {
+		t.Fatalf("Failed to parse identity %s: %v", alice, err)
+	}
+	recipient, err := ParseAgeRecipient(bob.Recipient().String())
+	if err != nil {
+		t.Fatalf("Failed to parse recipient: %s", err)
+	}
+	if !strings.HasPrefix(alice.String(), "AGE-SECRET-KEY-1") || !strings.HasPrefix(recipient.String(), "age1") {
+		t.Errorf("Failed. Unexpected key encodings %s and %s", alice, recipient)
+	}
+
+	for _, size := range []int{0, 1, ageChunkSize - 1, ageChunkSize, ageChunkSize + 1, 3 * ageChunkSize} {
+		plainText := make([]byte, size)
+		for i := range plainText {
+			plainText[i] = byte(i * 7)
+		}
+		for _, armor := range []bool{false, true} {
+			file := ageEncrypt(t, plainText, armor, alice.Recipient(), recipient)
+			for _, id := range []*AgeX25519Identity{parsed, bob} {
+				out, err := ageDecrypt(file, id)
+				if err != nil {
+					t.Fatalf("Size %d armor %t decryption failed: %s", size, armor, err)
+				}
+				if !bytes.Equal(out, plainText) {
+					t.Errorf("Size %d armor %t failed. Plaintext differs", size, armor)
+				}
+			}
+			other, _ := GenerateAgeIdentity()
+			if _, err := ageDecrypt(file, other); err != ErrWrongKey {
+				t.Errorf("Size %d armor %t failed. Expected ErrWrongKey, got %v", size, armor, err)
+			}
+			if !armor && size > 0 {
+				if _, err := ageDecrypt(file[:len(file)-1], alice); err == nil {
+					t.Errorf("Size %d failed. Expected a truncated file to be rejected", size)
+				}
+			}
+		}
+	}
+}
+
+func TestAgeScrypt(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	r, err := NewAgeScryptRecipient(passphrase)
+	if err != nil {
+		t.Fatalf("Failed to create recipient: %s", err)
+	}
+	// keep the test fast
+	r.workFactor = 10
+	plainText := bytes.Repeat([]byte("age"), 30000)
+	file := ageEncrypt(t, plainText, true, r)
+	out, err := ageDecrypt(file, NewAgeScryptIdentity(passphrase))
+	if err != nil || !bytes.Equal(out, plainText) {
+		t.Errorf("Failed to decrypt with the passphrase: %v", err)
+	}
+	if _, err := ageDecrypt(file, NewAgeScryptIdentity([]byte("wrong"))); err != ErrWrongKey {
+		t.Errorf("Failed. Expected ErrWrongKey, got %v", err)
+	}
+
+	id, _ := GenerateAgeIdentity()
+	if _, err := NewAgeEncryptWriter(ioutil.Discard, r, id.Recipient()); err == nil {
+		t.Errorf("Failed. Expected a passphrase with other recipients to be rejected")
+	}
+	if _, err := NewAgeScryptRecipient(nil); err == nil {
+		t.Errorf("Failed. Expected an empty passphrase to be rejected")
+	}
+}
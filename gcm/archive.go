@@ -0,0 +1,326 @@
+package gcm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	archiveIndexInfo = "gcm archive index"
+	archiveDataInfo  = "gcm archive data"
+)
+
+// archiveMagic identifies an archive created by Pack.
+var archiveMagic = []byte("GCMPACK\x01")
+
+// archiveHeaderSize is the size of the magic, salt and index length that
+// start every archive.
+var archiveHeaderSize = len(archiveMagic) + saltSize + 8
+
+// Pack writes every directory and regular file below dir to a single
+// encrypted archive. The archive starts with a short header holding a random
+// salt, followed by an encrypted index of the entries and then a single
+// encrypted stream of the file contents, so neither file names, sizes nor
+// metadata are visible without the key. The header is authenticated along
+// with both streams. The packed entries are returned.
+func Pack(w io.Writer, dir string, key, aad []byte, opts *Options) (*Manifest, error) {
+	manifest, err := scanDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	indexSize, err := CiphertextSize(int64(len(index)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, archiveHeaderSize)
+	header = append(header, archiveMagic...)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint64(header, uint64(indexSize))
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	streamAAD := append(append([]byte{}, aad...), header...)
+
+	indexReader, err := newDerivedEncryptReader(bytes.NewReader(index), key, salt, streamAAD, archiveIndexInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, indexReader); err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, entry := range manifest.Entries {
+		total += entry.Size
+	}
+	data := &packReader{dir: dir, entries: manifest.Entries}
+	dataReader, err := newDerivedEncryptReader(data, key, salt, streamAAD, archiveDataInfo, opts.withSize(total))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, dataReader)
+	if data.cur != nil {
+		data.cur.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Unpack extracts an archive created by Pack into dir, restoring
+// permissions and modification times. File contents are only written once
+// the chunk holding them has been authenticated, but a damaged archive may
+// leave partially extracted files behind. The unpacked entries are returned.
+func Unpack(r io.Reader, dir string, key, aad []byte, opts *Options) (*Manifest, error) {
+	salt, streamAAD, manifest, err := readArchiveIndex(r, key, aad)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, entry := range manifest.Entries {
+		if _, err := cleanManifestPath(entry.Path); err != nil {
+			return nil, err
+		}
+		total += entry.Size
+	}
+	unpacker := &unpackWriter{dir: dir, entries: manifest.Entries}
+	size, err := CiphertextSize(total, nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newDerivedDecryptWriteCloser(unpacker, key, salt, streamAAD, archiveDataInfo, opts.withSize(size))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		unpacker.abort()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		unpacker.abort()
+		return nil, err
+	}
+	if err := restoreDirMetadata(dir, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// List authenticates and returns the index of an archive created by Pack
+// without decrypting any file contents.
+func List(r io.Reader, key, aad []byte) (*Manifest, error) {
+	_, _, manifest, err := readArchiveIndex(r, key, aad)
+	return manifest, err
+}
+
+// readArchiveIndex reads the archive header and index from r, leaving r
+// positioned at the start of the data stream.
+func readArchiveIndex(r io.Reader, key, aad []byte) ([]byte, []byte, *Manifest, error) {
+	header := make([]byte, archiveHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to read archive header: %s", err)
+	}
+	if !bytes.Equal(header[:len(archiveMagic)], archiveMagic) {
+		return nil, nil, nil, errors.New("Not a gcm archive")
+	}
+	salt := header[len(archiveMagic) : len(archiveMagic)+saltSize]
+	indexSize := int64(binary.BigEndian.Uint64(header[len(archiveMagic)+saltSize:]))
+	streamAAD := append(append([]byte{}, aad...), header...)
+
+	var index bytes.Buffer
+	w, err := newDerivedDecryptWriteCloser(nopCloser{&index}, key, salt, streamAAD, archiveIndexInfo, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := io.Copy(w, io.LimitReader(r, indexSize)); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to decrypt archive index: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to decrypt archive index: %s", err)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(index.Bytes(), manifest); err != nil {
+		return nil, nil, nil, err
+	}
+	return salt, streamAAD, manifest, nil
+}
+
+// packReader concatenates the contents of the regular files in entries,
+// failing if any file has changed size since it was indexed.
+type packReader struct {
+	dir     string
+	entries []ManifestEntry
+
+	cur       *os.File
+	remaining int64
+}
+
+func (r *packReader) Read(p []byte) (int, error) {
+	for r.cur == nil {
+		if len(r.entries) == 0 {
+			return 0, io.EOF
+		}
+		entry := r.entries[0]
+		r.entries = r.entries[1:]
+		if entry.Mode.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(r.dir, filepath.FromSlash(entry.Path)))
+		if err != nil {
+			return 0, err
+		}
+		r.cur = f
+		r.remaining = entry.Size
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.cur.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		return n, fmt.Errorf("%s changed size while packing", r.cur.Name())
+	}
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if r.remaining == 0 {
+		// make sure the file did not grow either
+		var b [1]byte
+		if extra, _ := r.cur.Read(b[:]); extra > 0 {
+			return n, fmt.Errorf("%s changed size while packing", r.cur.Name())
+		}
+		r.cur.Close()
+		r.cur = nil
+	}
+	return n, nil
+}
+
+// unpackWriter splits the decrypted data stream of an archive into the files
+// listed in entries.
+type unpackWriter struct {
+	dir     string
+	entries []ManifestEntry
+
+	cur       *os.File
+	entry     ManifestEntry
+	remaining int64
+}
+
+func (w *unpackWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if w.cur == nil {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+			if w.cur == nil {
+				return written, errors.New("Archive contains more data than its index")
+			}
+		}
+		chunk := p[written:]
+		if int64(len(chunk)) > w.remaining {
+			chunk = chunk[:w.remaining]
+		}
+		n, err := w.cur.Write(chunk)
+		written += n
+		w.remaining -= int64(n)
+		if err != nil {
+			return written, err
+		}
+		if w.remaining == 0 {
+			if err := w.finish(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close creates any remaining empty files and directories and fails if the
+// data stream ended before every file was complete.
+func (w *unpackWriter) Close() error {
+	if w.cur == nil {
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	if w.cur != nil {
+		w.abort()
+		return errors.New("Archive data is truncated")
+	}
+	return nil
+}
+
+// next creates directories and empty files until it opens the next file that
+// expects data, or runs out of entries.
+func (w *unpackWriter) next() error {
+	for len(w.entries) > 0 {
+		entry := w.entries[0]
+		w.entries = w.entries[1:]
+		rel, err := cleanManifestPath(entry.Path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(w.dir, rel)
+		if entry.Mode.IsDir() {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			// files are written into the directory later, so only the
+			// permissions are restored here
+			if err := os.Chmod(target, entry.Mode.Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		w.cur = f
+		w.entry = entry
+		w.remaining = entry.Size
+		if w.remaining > 0 {
+			return nil
+		}
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *unpackWriter) finish() error {
+	f := w.cur
+	w.cur = nil
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return restoreMetadata(f.Name(), w.entry)
+}
+
+func (w *unpackWriter) abort() {
+	if w.cur != nil {
+		w.cur.Close()
+		w.cur = nil
+	}
+}
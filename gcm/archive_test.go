@@ -0,0 +1,94 @@
+package gcm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-archive")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	inDir := filepath.Join(tmp, "in")
+	outDir := filepath.Join(tmp, "out")
+
+	files := map[string][]byte{
+		"secret-name.txt": []byte("hello world"),
+		"empty":           {},
+		"sub/b.bin":       bytes.Repeat([]byte{0x42}, 2*chunkSize+7),
+		"sub/c.txt":       []byte("c"),
+	}
+	mtime := time.Date(2016, 10, 14, 12, 0, 0, 0, time.UTC)
+	for name, data := range files {
+		p := filepath.Join(inDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(p, data, 0640); err != nil {
+			t.Fatalf("Failed to write file: %s", err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatalf("Failed to set file times: %s", err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if _, err := Pack(&archive, inDir, key, nil, nil); err != nil {
+		t.Fatalf("Packing failed: %s", err)
+	}
+	if bytes.Contains(archive.Bytes(), []byte("secret-name")) {
+		t.Error("Archive leaks a file name")
+	}
+
+	manifest, err := List(bytes.NewReader(archive.Bytes()), key, nil)
+	if err != nil {
+		t.Fatalf("Listing failed: %s", err)
+	}
+	if len(manifest.Entries) != 5 {
+		t.Errorf("Expected 5 entries, got %d", len(manifest.Entries))
+	}
+
+	if _, err := Unpack(bytes.NewReader(archive.Bytes()), outDir, key, nil, nil); err != nil {
+		t.Fatalf("Unpacking failed: %s", err)
+	}
+	for name, data := range files {
+		p := filepath.Join(outDir, filepath.FromSlash(name))
+		out, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("Failed to read %s: %s", name, err)
+			continue
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s differs after unpacking", name)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Errorf("Failed to stat %s: %s", name, err)
+			continue
+		}
+		if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s metadata differs: %s %s", name, info.Mode(), info.ModTime())
+		}
+	}
+
+	// any modification of the header, index or data must be detected
+	for _, off := range []int{len(archiveMagic), archiveHeaderSize + 1, archive.Len() - 1} {
+		damaged := append([]byte{}, archive.Bytes()...)
+		damaged[off] ^= 1
+		if _, err := Unpack(bytes.NewReader(damaged), filepath.Join(tmp, "damaged"), key, nil, nil); err == nil {
+			t.Errorf("Expected unpacking an archive damaged at %d to fail", off)
+		}
+	}
+	truncated := archive.Bytes()[:archive.Len()-chunkSize]
+	if _, err := Unpack(bytes.NewReader(truncated), filepath.Join(tmp, "truncated"), key, nil, nil); err == nil {
+		t.Error("Expected unpacking a truncated archive to fail")
+	}
+}
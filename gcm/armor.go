@@ -0,0 +1,252 @@
+package gcm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Armored streams wrap the binary stream in base64 so it can be pasted into
+// text such as tickets, YAML or email:
+//
+//	-----BEGIN GCM ENCRYPTED FILE-----
+//	base64 lines of armorLineLength characters
+//	=CRC-24 of the binary stream, base64 encoded
+//	-----END GCM ENCRYPTED FILE-----
+//
+// The checksum is the CRC-24 of OpenPGP armor. It only catches damage from
+// copying and pasting; the stream itself is authenticated by GCM.
+
+const (
+	armorBegin      = "-----BEGIN GCM ENCRYPTED FILE-----"
+	armorEnd        = "-----END GCM ENCRYPTED FILE-----"
+	armorLineLength = 64
+	// armorMaxLine bounds the lines read, including the line break. Longer
+	// lines are rejected rather than buffered.
+	armorMaxLine = 4096
+
+	crc24Init = 0xb704ce
+	crc24Poly = 0x1864cfb
+)
+
+func crc24(crc uint32, p []byte) uint32 {
+	for _, b := range p {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+func encodeChecksum(crc uint32) string {
+	return "=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)})
+}
+
+// armoredSize returns the size of the armor for size bytes of binary data.
+func armoredSize(size int64) int64 {
+	encoded := (size + 2) / 3 * 4
+	lines := (encoded + armorLineLength - 1) / armorLineLength
+	return int64(len(armorBegin)+1) + encoded + lines + int64(len(encodeChecksum(0))+1) + int64(len(armorEnd)+1)
+}
+
+// armorWriter base64 encodes the data written to it into dst between the
+// begin and end lines, followed by a checksum unless it is disabled.
+type armorWriter struct {
+	dst        io.Writer
+	enc        io.WriteCloser
+	lines      *lineWriter
+	crc        uint32
+	started    bool
+	begin, end string
+	noChecksum bool
+}
+
+// NewArmorWriter returns a writer that armors the data written to it into
+// dst. The armor is only complete once the writer is closed; dst is not
+// closed.
+func NewArmorWriter(dst io.Writer) io.WriteCloser {
+	lines := &lineWriter{dst: dst}
+	return &armorWriter{
+		dst:   dst,
+		enc:   base64.NewEncoder(base64.StdEncoding, lines),
+		lines: lines,
+		crc:   crc24Init,
+		begin: armorBegin,
+		end:   armorEnd,
+	}
+}
+
+func (w *armorWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	_, err := io.WriteString(w.dst, w.begin+"\n")
+	return err
+}
+
+func (w *armorWriter) Write(p []byte) (int, error) {
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	w.crc = crc24(w.crc, p)
+	return w.enc.Write(p)
+}
+
+// Close flushes the encoded data and writes the checksum and end line.
+func (w *armorWriter) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if err := w.enc.Close(); err != nil {
+		return err
+	}
+	if w.lines.col > 0 {
+		if _, err := io.WriteString(w.dst, "\n"); err != nil {
+			return err
+		}
+	}
+	end := w.end + "\n"
+	if !w.noChecksum {
+		end = encodeChecksum(w.crc) + "\n" + end
+	}
+	_, err := io.WriteString(w.dst, end)
+	return err
+}
+
+// lineWriter breaks the data written to it into lines of armorLineLength.
+type lineWriter struct {
+	dst io.Writer
+	col int
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.col == armorLineLength {
+			if _, err := io.WriteString(w.dst, "\n"); err != nil {
+				return 0, err
+			}
+			w.col = 0
+		}
+		line := armorLineLength - w.col
+		if line > len(p) {
+			line = len(p)
+		}
+		if _, err := w.dst.Write(p[:line]); err != nil {
+			return 0, err
+		}
+		w.col += line
+		p = p[line:]
+	}
+	return n, nil
+}
+
+// Dearmor returns a reader of the binary stream in r, removing the armor if r
+// is armored. Binary streams are passed through unchanged, so the result can
+// be used for either. Leading whitespace before the armor is ignored.
+func Dearmor(r io.Reader) io.Reader {
+	br := bufio.NewReaderSize(r, armorMaxLine)
+	if !isArmored(br) {
+		return br
+	}
+	return &armorReader{br: br, crc: crc24Init}
+}
+
+// isArmored reports whether the stream starts with the armor begin line,
+// without consuming any of it.
+func isArmored(br *bufio.Reader) bool {
+	peek, _ := br.Peek(br.Size())
+	trimmed := bytes.TrimLeft(peek, " \t\r\n")
+	return bytes.HasPrefix(trimmed, []byte(armorBegin))
+}
+
+// armorReader decodes an armored stream, checking the checksum at the end.
+type armorReader struct {
+	br *bufio.Reader
+
+	begun   bool
+	done    bool
+	pending []byte
+	out     []byte
+	crc     uint32
+	sum     string
+}
+
+func (r *armorReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readLine(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// readLine decodes the next line of the armor into r.out.
+func (r *armorReader) readLine() error {
+	raw, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return errors.New("The armor has a line that is too long")
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	line := strings.TrimSpace(string(raw))
+	if err == io.EOF && line == "" {
+		return errors.New("The armored stream is truncated")
+	}
+	switch {
+	case line == "":
+		return nil
+	case !r.begun:
+		if line != armorBegin {
+			return errors.New("Invalid armor begin line")
+		}
+		r.begun = true
+		return nil
+	case line == armorEnd:
+		return r.finish()
+	case r.sum != "":
+		return errors.New("Unexpected data after the armor checksum")
+	case strings.HasPrefix(line, "=") && len(r.pending) == 0:
+		r.sum = line
+		return nil
+	}
+	r.pending = append(r.pending, line...)
+	whole := len(r.pending) / 4 * 4
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(whole))
+	n, decodeErr := base64.StdEncoding.Decode(decoded, r.pending[:whole])
+	if decodeErr != nil {
+		return errors.New("Invalid armor encoding")
+	}
+	r.pending = append(r.pending[:0], r.pending[whole:]...)
+	r.crc = crc24(r.crc, decoded[:n])
+	r.out = decoded[:n]
+	return nil
+}
+
+func (r *armorReader) finish() error {
+	if len(r.pending) > 0 {
+		return errors.New("Invalid armor encoding")
+	}
+	if r.sum == "" {
+		return errors.New("The armor checksum is missing")
+	}
+	if r.sum != encodeChecksum(r.crc) {
+		return errors.New("The armor checksum does not match")
+	}
+	r.done = true
+	return nil
+}
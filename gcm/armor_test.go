@@ -0,0 +1,143 @@
+package gcm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArmor(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 3, 47, 48, 49, 1000} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		var buf bytes.Buffer
+		w := NewArmorWriter(&buf)
+		// write in pieces to cross line boundaries
+		for i := 0; i < size; i += 5 {
+			end := i + 5
+			if end > size {
+				end = size
+			}
+			w.Write(data[i:end])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Size %d failed to close: %s", size, err)
+		}
+		if int64(buf.Len()) != armoredSize(int64(size)) {
+			t.Errorf("Size %d failed. armoredSize %d != %d", size, armoredSize(int64(size)), buf.Len())
+		}
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if len(line) > armorLineLength && !strings.HasPrefix(line, "-----") {
+				t.Errorf("Size %d failed. Line too long: %q", size, line)
+			}
+		}
+
+		out, err := ioutil.ReadAll(Dearmor(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatalf("Size %d failed to dearmor: %s", size, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("Size %d failed. Data differs", size)
+		}
+
+		// indentation and other line lengths are tolerated
+		var indented bytes.Buffer
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			indented.WriteString("    " + line + "\r\n")
+		}
+		out, err = ioutil.ReadAll(Dearmor(&indented))
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("Size %d failed to dearmor indented text: %v", size, err)
+		}
+
+		// binary data is passed through
+		out, err = ioutil.ReadAll(Dearmor(bytes.NewReader(data)))
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("Size %d failed to pass binary data through: %v", size, err)
+		}
+	}
+}
+
+func TestArmorErrors(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewArmorWriter(&buf)
+	w.Write([]byte("some ciphertext that is long enough to span more than a single armor line"))
+	w.Close()
+	armored := buf.String()
+	lines := strings.Split(armored, "\n")
+
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"truncated", strings.Join(lines[:2], "\n")},
+		{"missing end", strings.Join(lines[:len(lines)-2], "\n") + "\n"},
+		{"missing checksum", strings.Join(append(lines[:2:2], lines[len(lines)-2:]...), "\n")},
+		{"modified", strings.Replace(armored, lines[1][:4], "AAAA", 1)},
+		{"invalid base64", strings.Replace(armored, lines[1][:4], "!!!!", 1)},
+		{"data after checksum", strings.Replace(armored, armorEnd, "AAAA\n"+armorEnd, 1)},
+	}
+	for _, test := range tests {
+		if _, err := ioutil.ReadAll(Dearmor(strings.NewReader(test.text))); err == nil {
+			t.Errorf("%s failed. Expected an error", test.name)
+		}
+	}
+
+	// valid armor whose base64 is joined into one line longer than the limit
+	buf.Reset()
+	w = NewArmorWriter(&buf)
+	w.Write(bytes.Repeat([]byte{0x42}, armorMaxLine))
+	w.Close()
+	lines = strings.Split(buf.String(), "\n")
+	body := strings.Join(lines[1:len(lines)-3], "")
+	long := strings.Join([]string{lines[0], body, lines[len(lines)-3], armorEnd, ""}, "\n")
+	if _, err := ioutil.ReadAll(Dearmor(strings.NewReader(long))); err == nil {
+		t.Errorf("Failed. Expected a line longer than %d bytes to be rejected", armorMaxLine)
+	}
+}
+
+func TestArmorFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-armor")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	plainText := bytes.Repeat([]byte("armor "), 200000)
+	inPath := filepath.Join(tmp, "in")
+	if err := ioutil.WriteFile(inPath, plainText, 0600); err != nil {
+		t.Fatalf("Failed to write input: %s", err)
+	}
+	for _, opts := range []*Options{{Armor: true}, {Armor: true, Merkle: true}} {
+		encPath := filepath.Join(tmp, "enc")
+		if err := EncryptFileWithOptions(inPath, encPath, key, iv, nil, opts); err != nil {
+			t.Fatalf("Encryption failed: %s", err)
+		}
+		info, err := os.Stat(encPath)
+		if err != nil {
+			t.Fatalf("Failed to stat output: %s", err)
+		}
+		if expected, _ := CiphertextSize(int64(len(plainText)), opts); expected != info.Size() {
+			t.Errorf("Failed. CiphertextSize %d != %d", expected, info.Size())
+		}
+
+		outPath := filepath.Join(tmp, "out")
+		if err := DecryptFile(encPath, outPath, key, iv, nil); err != nil {
+			t.Fatalf("Decryption failed: %s", err)
+		}
+		out, err := ioutil.ReadFile(outPath)
+		if err != nil {
+			t.Fatalf("Failed to read output: %s", err)
+		}
+		if !bytes.Equal(out, plainText) {
+			t.Errorf("Failed. Plaintext differs")
+		}
+	}
+}
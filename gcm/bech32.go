@@ -0,0 +1,126 @@
+package gcm
+
+import (
+	"errors"
+	"strings"
+)
+
+// Bech32 as defined by BIP 173 encodes age keys: a human-readable prefix, the
+// separator "1", the data in 5 bit groups and a 6 character checksum. Unlike
+// BIP 173, the length of the string is not limited.
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range bech32Generator {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	return chk
+}
+
+// bech32Values returns the expanded prefix followed by data, over which the
+// checksum is calculated.
+func bech32Values(hrp string, data []byte) []byte {
+	values := make([]byte, 0, 2*len(hrp)+1+len(data))
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]>>5)
+	}
+	values = append(values, 0)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]&31)
+	}
+	return append(values, data...)
+}
+
+// convertBits regroups data from groups of from bits into groups of to bits.
+// Without pad, left over bits must be fewer than from and zero.
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var out []byte
+	var acc uint32
+	var bits uint
+	max := uint32(1)<<to - 1
+	for _, v := range data {
+		if uint32(v)>>from != 0 {
+			return nil, errors.New("Invalid bech32 data")
+		}
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&max))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&max))
+		}
+	} else if bits >= from || acc<<(to-bits)&max != 0 {
+		return nil, errors.New("Invalid bech32 padding")
+	}
+	return out, nil
+}
+
+// bech32Encode encodes data with the given prefix, in upper case if the
+// prefix is upper case.
+func bech32Encode(hrp string, data []byte) string {
+	upper := strings.ToUpper(hrp) == hrp && strings.ToLower(hrp) != hrp
+	hrp = strings.ToLower(hrp)
+	values, _ := convertBits(data, 8, 5, true)
+	mod := bech32Polymod(append(bech32Values(hrp, values), 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(mod>>uint(5*(5-i))&31))
+	}
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range values {
+		b.WriteByte(bech32Charset[v])
+	}
+	if upper {
+		return strings.ToUpper(b.String())
+	}
+	return b.String()
+}
+
+// bech32Decode returns the lower case prefix and the data of a bech32 string.
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("Mixed case in bech32 string")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("Invalid bech32 separator position")
+	}
+	hrp := s[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, errors.New("Invalid bech32 prefix")
+		}
+	}
+	values := make([]byte, 0, len(s)-pos-1)
+	for i := pos + 1; i < len(s); i++ {
+		v := strings.IndexByte(bech32Charset, s[i])
+		if v < 0 {
+			return "", nil, errors.New("Invalid bech32 character")
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(bech32Values(hrp, values)) != 1 {
+		return "", nil, errors.New("Invalid bech32 checksum")
+	}
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
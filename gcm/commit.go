@@ -0,0 +1,72 @@
+package gcm
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"os"
+)
+
+// ErrWrongKey is returned when the key commitment of a stream does not match
+// the key used to decrypt it.
+var ErrWrongKey = errors.New("wrong key")
+
+// ErrNoKeyCommitment is returned when a stream without a key commitment is
+// decrypted with RequireKeyCommitment set.
+var ErrNoKeyCommitment = errors.New("The stream has no key commitment")
+
+const (
+	commitmentSize = 32
+	commitmentInfo = "gcm key commitment"
+)
+
+// keyCommitment returns a value that commits to the key and IV of a stream.
+// AES-GCM alone is not key-committing: a ciphertext can be crafted to
+// authenticate under many keys, which enables partitioning oracle attacks.
+// Storing the commitment in the authenticated header rules this out, and
+// lets a wrong key be detected before any chunk is read.
+func keyCommitment(key, iv []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, iv, commitmentInfo, commitmentSize)
+}
+
+// lazyFile is an output file that is only created, or truncated, on the
+// first write or on Close, so a stream that fails to authenticate at its
+// start leaves an existing file untouched.
+type lazyFile struct {
+	path string
+	f    *os.File
+}
+
+func (l *lazyFile) open() error {
+	if l.f != nil {
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	return nil
+}
+
+func (l *lazyFile) Write(p []byte) (int, error) {
+	if err := l.open(); err != nil {
+		return 0, err
+	}
+	return l.f.Write(p)
+}
+
+// Close creates the file if nothing was written to it, and closes it.
+func (l *lazyFile) Close() error {
+	if err := l.open(); err != nil {
+		return err
+	}
+	return l.f.Close()
+}
+
+// abort closes the file if it was opened, without creating it otherwise.
+func (l *lazyFile) abort() {
+	if l.f != nil {
+		l.f.Close()
+	}
+}
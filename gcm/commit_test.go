@@ -0,0 +1,139 @@
+package gcm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyCommitment(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-commit")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	wrongKey := bytes.Repeat([]byte{1}, 32)
+	iv := make([]byte, 12)
+	plainText := bytes.Repeat([]byte("secret"), chunkSize/3)
+	inPath := filepath.Join(tmp, "in")
+	encPath := filepath.Join(tmp, "in.enc")
+	outPath := filepath.Join(tmp, "out")
+	existing := []byte("do not truncate")
+	if err := ioutil.WriteFile(inPath, plainText, 0600); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+
+	for _, commit := range []bool{true, false} {
+		if err := ioutil.WriteFile(outPath, existing, 0600); err != nil {
+			t.Fatalf("Failed to write file: %s", err)
+		}
+		opts := &Options{KeyCommitment: commit}
+		if err := EncryptFileWithOptions(inPath, encPath, key, iv, nil, opts); err != nil {
+			t.Fatalf("Encryption failed: %s", err)
+		}
+
+		err := DecryptFile(encPath, outPath, wrongKey, iv, nil)
+		if err == nil {
+			t.Fatalf("Expected decryption with the wrong key to fail")
+		}
+		if commit && err != ErrWrongKey {
+			t.Errorf("Expected ErrWrongKey, got %s", err)
+		}
+		out, err := ioutil.ReadFile(outPath)
+		if err != nil {
+			t.Fatalf("Failed to read file: %s", err)
+		}
+		if !bytes.Equal(out, existing) {
+			t.Errorf("Commitment %t: output was modified by a failed decryption", commit)
+		}
+
+		if err := DecryptFile(encPath, outPath, key, iv, nil); err != nil {
+			t.Fatalf("Decryption failed: %s", err)
+		}
+		out, err = ioutil.ReadFile(outPath)
+		if err != nil {
+			t.Fatalf("Failed to read file: %s", err)
+		}
+		if !bytes.Equal(out, plainText) {
+			t.Errorf("Commitment %t: decrypted file differs", commit)
+		}
+	}
+
+	// the commitment covers the IV as well
+	r, err := NewEncryptReaderWithOptions(bytes.NewReader(nil), key, iv, nil, &Options{KeyCommitment: true})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %s", err)
+	}
+	cipherText, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	w, err := NewDecryptWriteCloser(nopCloser{ioutil.Discard}, key, append([]byte{1}, iv[1:]...), nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %s", err)
+	}
+	if _, err := w.Write(cipherText); err != ErrWrongKey {
+		t.Errorf("Expected ErrWrongKey for the wrong IV, got %v", err)
+	}
+}
+
+func TestRequireKeyCommitment(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	decrypt := func(cipherText []byte, opts *Options) error {
+		w, err := NewDecryptWriteCloserWithOptions(nopCloser{ioutil.Discard}, key, iv, nil, opts)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %s", err)
+		}
+		if _, err := w.Write(cipherText); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	encrypt := func(opts *Options) []byte {
+		r, err := NewEncryptReaderWithOptions(bytes.NewReader([]byte("secret")), key, iv, nil, opts)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %s", err)
+		}
+		cipherText, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Encryption failed: %s", err)
+		}
+		return cipherText
+	}
+	require := &Options{RequireKeyCommitment: true}
+
+	committed := encrypt(&Options{KeyCommitment: true, Metadata: &Metadata{Name: "secret"}})
+	if err := decrypt(committed, require); err != nil {
+		t.Errorf("Failed to decrypt a committed stream: %s", err)
+	}
+
+	// the same stream with the commitment field stripped from its header
+	size, err := headerSizeFromPrefix(committed)
+	if err != nil {
+		t.Fatalf("Failed to read the header size: %s", err)
+	}
+	h, err := parseHeader(committed[:size])
+	if err != nil {
+		t.Fatalf("Failed to parse the header: %s", err)
+	}
+	h.commitment = nil
+	stripped := append(h.marshal(), committed[size:]...)
+	if err := decrypt(stripped, require); err != ErrNoKeyCommitment {
+		t.Errorf("Failed. Expected ErrNoKeyCommitment for a stripped commitment, got %v", err)
+	}
+
+	for _, opts := range []*Options{nil, {Metadata: &Metadata{}}} {
+		cipherText := encrypt(opts)
+		if err := decrypt(cipherText, require); err != ErrNoKeyCommitment {
+			t.Errorf("Failed. Expected ErrNoKeyCommitment, got %v", err)
+		}
+		if err := decrypt(cipherText, nil); err != nil {
+			t.Errorf("Failed to decrypt without requiring a commitment: %s", err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package gcm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how plaintext is compressed before it is encrypted.
+// The algorithm is recorded in the stream header, so decryption
+// decompresses transparently.
+type Compression uint8
+
+const (
+	// CompressionNone stores the plaintext as is.
+	CompressionNone Compression = iota
+	// CompressionGzip compresses the plaintext with gzip.
+	CompressionGzip
+	// CompressionZstd compresses the plaintext with zstd, which is faster
+	// than gzip and usually compresses better.
+	CompressionZstd
+)
+
+// zstdMaxWindow limits the memory a zstd stream can make the decompressor
+// allocate. The encoder's window is far smaller.
+const zstdMaxWindow = 64 << 20
+
+// ParseCompression returns the Compression with the given name.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	}
+	return CompressionNone, fmt.Errorf("Unknown compression %q", name)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", uint8(c))
+}
+
+func (c Compression) valid() bool {
+	return c <= CompressionZstd
+}
+
+// compressReader compresses the data read from src.
+type compressReader struct {
+	src io.Reader
+	eof bool
+
+	zw  io.WriteCloser
+	out bytes.Buffer
+	in  []byte
+}
+
+func newCompressReader(src io.Reader, c Compression) (*compressReader, error) {
+	r := &compressReader{src: src, in: make([]byte, 32*1024)}
+	switch c {
+	case CompressionGzip:
+		r.zw = gzip.NewWriter(&r.out)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(&r.out, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		r.zw = zw
+	default:
+		return nil, fmt.Errorf("Unsupported compression %s", c)
+	}
+	return r, nil
+}
+
+func (r *compressReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := r.src.Read(r.in)
+		if n > 0 {
+			if _, err := r.zw.Write(r.in[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			if err := r.zw.Close(); err != nil {
+				return 0, err
+			}
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+// decompressWriter decompresses the data written to it into dst. The
+// decompressor pulls from a pipe in its own goroutine.
+type decompressWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newDecompressWriter(dst io.Writer, c Compression) (*decompressWriter, error) {
+	if c != CompressionGzip && c != CompressionZstd {
+		return nil, fmt.Errorf("Unsupported compression %s", c)
+	}
+	pr, pw := io.Pipe()
+	w := &decompressWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		var err error
+		if c == CompressionGzip {
+			err = gunzip(dst, pr)
+		} else {
+			err = unzstd(dst, pr)
+		}
+		if err == nil {
+			// anything after the compressed data was not produced by the
+			// encryptor
+			if n, _ := io.Copy(ioutil.Discard, pr); n > 0 {
+				err = fmt.Errorf("Unexpected data after compressed stream")
+			}
+		}
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// gunzip decompresses the single gzip member read from src into dst.
+func gunzip(dst io.Writer, src io.Reader) error {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return err
+	}
+	zr.Multistream(false)
+	_, err = io.Copy(dst, zr)
+	return err
+}
+
+// unzstd decompresses the zstd frames read from src into dst.
+func unzstd(dst io.Writer, src io.Reader) error {
+	zr, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	_, err = io.Copy(dst, zr)
+	return err
+}
+
+func (w *decompressWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close waits for the decompressor to finish and returns its error.
+func (w *decompressWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
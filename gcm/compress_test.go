@@ -0,0 +1,76 @@
+package gcm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-compress")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	plainText := bytes.Repeat([]byte("INSERT INTO logs VALUES (1, 'compressible');\n"), 3*chunkSize/40)
+	inPath := filepath.Join(tmp, "dump.sql")
+	encPath := filepath.Join(tmp, "dump.sql.enc")
+	outPath := filepath.Join(tmp, "dump.out")
+	if err := ioutil.WriteFile(inPath, plainText, 0600); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		var last Progress
+		opts := &Options{
+			Compression: c,
+			Metadata:    &Metadata{},
+			Progress:    func(p Progress) { last = p },
+		}
+		if err := EncryptFileWithOptions(inPath, encPath, key, iv, nil, opts); err != nil {
+			t.Fatalf("Encryption with %s failed: %s", c, err)
+		}
+		if last.Bytes != int64(len(plainText)) {
+			t.Errorf("Progress reported %d of %d input bytes with %s", last.Bytes, len(plainText), c)
+		}
+		info, err := os.Stat(encPath)
+		if err != nil {
+			t.Fatalf("Failed to stat file: %s", err)
+		}
+		if info.Size() > int64(len(plainText)/10) {
+			t.Errorf("Expected %s compressed output, got %d bytes for %d", c, info.Size(), len(plainText))
+		}
+
+		// decompression is transparent, and the digest covers the original data
+		if err := DecryptFile(encPath, outPath, key, iv, nil); err != nil {
+			t.Fatalf("Decryption with %s failed: %s", c, err)
+		}
+		out, err := ioutil.ReadFile(outPath)
+		if err != nil {
+			t.Fatalf("Failed to read file: %s", err)
+		}
+		if !bytes.Equal(out, plainText) {
+			t.Errorf("Decrypted file differs with %s", c)
+		}
+	}
+
+	if _, err := CiphertextSize(100, &Options{Compression: CompressionGzip}); err == nil {
+		t.Error("Expected CiphertextSize to fail for compressed data")
+	}
+	for name, expected := range map[string]Compression{"": CompressionNone, "none": CompressionNone, "gzip": CompressionGzip, "zstd": CompressionZstd} {
+		c, err := ParseCompression(name)
+		if err != nil || c != expected {
+			t.Errorf("ParseCompression(%q) = %s, %v", name, c, err)
+		}
+	}
+	for _, name := range []string{"lz4", "brotli"} {
+		if _, err := ParseCompression(name); err == nil {
+			t.Errorf("Expected ParseCompression(%q) to fail", name)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package gcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// A Conn secures a connection with a pre-shared key using the chunk framing
+// of the streams of this package. The client and the server each send a
+// hello
+//
+//	magic   [4]byte  "GCMN"
+//	version uint8
+//	nonce   [32]byte random
+//
+// and derive a key and IV per direction from the pre-shared key and both
+// nonces. Each side then sends a record holding the SHA-256 of the two
+// hellos, which proves it holds the key. Records are
+//
+//	length  uint32   size of the sealed data
+//	sealed  [length]byte
+//
+// sealed with the length as associated data and an IV incremented for each
+// record, so the IV is the record's sequence number. Records hold at most a
+// chunk of data. An empty record ends the data in its direction, so a
+// connection cut short is not mistaken for a complete one.
+
+const (
+	connVersion   = 1
+	connNonceSize = 32
+	connHelloSize = 4 + 1 + connNonceSize
+	connMaxRecord = chunkSize + tagSize
+
+	connClientInfo = "gcm conn client"
+	connServerInfo = "gcm conn server"
+)
+
+var connMagic = []byte("GCMN")
+
+// errRecordAuth is returned for a record that fails to authenticate.
+var errRecordAuth = errors.New("A record failed to authenticate")
+
+// Conn is a net.Conn whose data is sealed with a pre-shared key. The
+// handshake runs on the first Read or Write, or on Handshake.
+type Conn struct {
+	net.Conn
+	psk      []byte
+	isClient bool
+
+	handshakeMu  sync.Mutex
+	handshakeErr error
+	handshaken   bool
+	// established is set once the handshake has succeeded, for Close,
+	// which must not wait for a handshake in progress
+	established atomic.Bool
+
+	in  connHalf
+	out connHalf
+
+	// plaintext of the last record read that has not been returned yet
+	pending []byte
+	eof     bool
+}
+
+// connHalf holds the state of one direction of a Conn.
+type connHalf struct {
+	sync.Mutex
+	aead cipher.AEAD
+	iv   []byte
+	err  error
+}
+
+func (h *connHalf) init(psk, salt []byte, info string) error {
+	key, iv, err := deriveKeyIV(psk, salt, info)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	h.aead, err = cipher.NewGCM(block)
+	h.iv = iv
+	return err
+}
+
+// Client returns a Conn that runs the client side of the handshake over
+// conn.
+func Client(conn net.Conn, psk []byte) *Conn {
+	return &Conn{Conn: conn, psk: psk, isClient: true}
+}
+
+// Server returns a Conn that runs the server side of the handshake over
+// conn.
+func Server(conn net.Conn, psk []byte) *Conn {
+	return &Conn{Conn: conn, psk: psk}
+}
+
+// Dial connects to address and completes the handshake.
+func Dial(network, address string, psk []byte) (*Conn, error) {
+	raw, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := Client(raw, psk)
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Listen listens on address for connections secured with the pre-shared
+// key.
+func Listen(network, address string, psk []byte) (net.Listener, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, psk), nil
+}
+
+// NewListener returns a listener whose connections are the server side of
+// Conns over those of inner. The handshake runs on the first Read or Write,
+// so a slow client does not hold up Accept.
+func NewListener(inner net.Listener, psk []byte) net.Listener {
+	return &listener{Listener: inner, psk: psk}
+}
+
+type listener struct {
+	net.Listener
+	psk []byte
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.psk), nil
+}
+
+// Handshake runs the handshake if it has not run yet. It returns ErrWrongKey
+// if the peer does not hold the same key, and errors of the underlying
+// connection unchanged.
+func (c *Conn) Handshake() error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if !c.handshaken {
+		c.handshakeErr = c.handshake()
+		c.handshaken = true
+		c.established.Store(c.handshakeErr == nil)
+	}
+	return c.handshakeErr
+}
+
+func (c *Conn) handshake() error {
+	hello := make([]byte, 0, connHelloSize)
+	hello = append(hello, connMagic...)
+	hello = append(hello, connVersion)
+	hello = append(hello, make([]byte, connNonceSize)...)
+	if _, err := rand.Read(hello[len(hello)-connNonceSize:]); err != nil {
+		return err
+	}
+	peer := make([]byte, connHelloSize)
+
+	// the client speaks first so the handshake also works over
+	// unbuffered connections
+	var clientHello, serverHello []byte
+	if c.isClient {
+		if _, err := c.Conn.Write(hello); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c.Conn, peer); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		clientHello, serverHello = hello, peer
+	} else {
+		if _, err := io.ReadFull(c.Conn, peer); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		clientHello, serverHello = peer, hello
+	}
+	if !hmac.Equal(peer[:len(connMagic)], connMagic) {
+		return errors.New("The peer is not a GCM connection")
+	}
+	if peer[len(connMagic)] != connVersion {
+		return fmt.Errorf("Unsupported connection version %d", peer[len(connMagic)])
+	}
+
+	salt := append(append([]byte{}, clientHello[5:]...), serverHello[5:]...)
+	inInfo, outInfo := connServerInfo, connClientInfo
+	if !c.isClient {
+		inInfo, outInfo = outInfo, inInfo
+	}
+	if err := c.in.init(c.psk, salt, inInfo); err != nil {
+		return err
+	}
+	if err := c.out.init(c.psk, salt, outInfo); err != nil {
+		return err
+	}
+
+	transcript := sha256.New()
+	transcript.Write(clientHello)
+	transcript.Write(serverHello)
+	finished := transcript.Sum(nil)
+	if !c.isClient {
+		if _, err := c.Conn.Write(hello); err != nil {
+			return err
+		}
+		if err := c.writeRecord(finished); err != nil {
+			return err
+		}
+	}
+	peerFinished, err := c.readRecord()
+	if err == errRecordAuth {
+		return ErrWrongKey
+	}
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(peerFinished, finished) {
+		return ErrWrongKey
+	}
+	if c.isClient {
+		return c.writeRecord(finished)
+	}
+	return nil
+}
+
+// writeRecord seals and sends a record of at most a chunk.
+func (c *Conn) writeRecord(p []byte) error {
+	record := make([]byte, 4, 4+len(p)+tagSize)
+	binary.BigEndian.PutUint32(record, uint32(len(p)+tagSize))
+	record = c.out.aead.Seal(record, c.out.iv, p, record[:4])
+	incrementIV(c.out.iv)
+	_, err := c.Conn.Write(record)
+	return err
+}
+
+// readRecord receives and opens the next record.
+func (c *Conn) readRecord() ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, length); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length)
+	if n < tagSize || n > connMaxRecord {
+		return nil, fmt.Errorf("Invalid record size %d", n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	opened, err := c.in.aead.Open(sealed[:0], c.in.iv, sealed, length)
+	if err != nil {
+		return nil, errRecordAuth
+	}
+	incrementIV(c.in.iv)
+	return opened, nil
+}
+
+// Read reads data sent by the peer. It returns io.EOF once the peer has
+// closed the connection, and io.ErrUnexpectedEOF if the connection ends
+// without the peer closing it.
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.in.Lock()
+	defer c.in.Unlock()
+	for len(c.pending) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.in.err != nil {
+			return 0, c.in.err
+		}
+		record, err := c.readRecord()
+		if err != nil {
+			c.in.err = err
+			return 0, err
+		}
+		if len(record) == 0 {
+			c.eof = true
+		}
+		c.pending = record
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write seals p into records of at most a chunk and sends them.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.out.err != nil {
+		return 0, c.out.err
+	}
+	n := 0
+	for n < len(p) {
+		end := n + chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := c.writeRecord(p[n:end]); err != nil {
+			c.out.err = err
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// Close sends the empty record that ends the data in this direction, if the
+// handshake completed, and closes the connection.
+func (c *Conn) Close() error {
+	if c.established.Load() {
+		c.out.Lock()
+		if c.out.err == nil {
+			c.writeRecord(nil)
+			c.out.err = net.ErrClosed
+		}
+		c.out.Unlock()
+	}
+	return c.Conn.Close()
+}
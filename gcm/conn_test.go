@@ -0,0 +1,140 @@
+package gcm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	psk := bytes.Repeat([]byte{9}, 32)
+	l, err := Listen("tcp", "127.0.0.1:0", psk)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	conn, err := Dial("tcp", l.Addr().String(), psk)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	data := make([]byte, 3*chunkSize+123)
+	for i := range data {
+		data[i] = byte(i % 247)
+	}
+	go conn.Write(data)
+	echoed := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Errorf("Failed. Echoed data differs")
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+
+	if _, err := Dial("tcp", l.Addr().String(), bytes.Repeat([]byte{8}, 32)); err != ErrWrongKey {
+		t.Errorf("Failed. Expected a wrong key to be detected, got %v", err)
+	}
+}
+
+// connPair returns the two ends of a Conn over a pipe after the handshake.
+func connPair(t *testing.T) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	psk := make([]byte, 32)
+	client, server := Client(a, psk), Server(b, psk)
+	done := make(chan error)
+	go func() { done <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Client handshake failed: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Server handshake failed: %s", err)
+	}
+	return client, server
+}
+
+func TestConnClose(t *testing.T) {
+	client, server := connPair(t)
+	go func() {
+		client.Write([]byte("hello"))
+		client.Close()
+	}()
+	read, err := ioutil.ReadAll(server)
+	if err != nil || string(read) != "hello" {
+		t.Errorf("Failed. Expected hello and EOF, got %q, %v", read, err)
+	}
+
+	// a connection cut without the closing record is truncated
+	client, server = connPair(t)
+	go func() {
+		client.Write([]byte("hello"))
+		client.Conn.Close()
+	}()
+	if read, err := ioutil.ReadAll(server); err != io.ErrUnexpectedEOF || string(read) != "hello" {
+		t.Errorf("Failed. Expected truncation to be detected, got %q, %v", read, err)
+	}
+
+	// injected records fail to authenticate
+	client, server = connPair(t)
+	go func() {
+		client.Conn.Write(append([]byte{0, 0, 0, 20}, make([]byte, 20)...))
+	}()
+	if _, err := server.Read(make([]byte, 10)); err != errRecordAuth {
+		t.Errorf("Failed. Expected an injected record to be rejected, got %v", err)
+	}
+}
+
+func TestConnHandshakeErrors(t *testing.T) {
+	// a server that hangs up after its hello is not a wrong key
+	a, b := net.Pipe()
+	go func() {
+		io.ReadFull(b, make([]byte, connHelloSize))
+		hello := append(append([]byte{}, connMagic...), connVersion)
+		b.Write(append(hello, make([]byte, connNonceSize)...))
+		b.Close()
+	}()
+	if err := Client(a, make([]byte, 32)).Handshake(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Failed. Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// neither is a peer that hangs up before its hello
+	a, b = net.Pipe()
+	go func() {
+		io.ReadFull(b, make([]byte, connHelloSize))
+		b.Close()
+	}()
+	if err := Client(a, make([]byte, 32)).Handshake(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Failed. Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	a, b = net.Pipe()
+	a.Close()
+	if err := Server(b, make([]byte, 32)).Handshake(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Failed. Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// a finished record sealed with another key is
+	a, b = net.Pipe()
+	client, server := Client(a, make([]byte, 32)), Server(b, bytes.Repeat([]byte{1}, 32))
+	go server.Handshake()
+	if err := client.Handshake(); err != ErrWrongKey {
+		t.Errorf("Failed. Expected ErrWrongKey, got %v", err)
+	}
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,184 @@
+package gcm
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Convergent encryption derives the key and IV of a file from its content, so
+// identical files encrypt to identical output that deduplicating storage can
+// store once. The salt that the key and IV are derived from is an HMAC of the
+// plaintext under a key derived from a secret convergence key, rather than a
+// plain hash, so nobody without the convergence key can confirm a guess of
+// the content of a file. The serialized header, the metadata record and the
+// associated data are part of the HMAC as well, so files whose content
+// matches but whose other sealed bytes differ never share a key and IV. The
+// output has the layout of encryptDerived.
+//
+// The salt still shows which files have the same content, which is the point
+// of the mode but also all it gives away.
+
+const (
+	convergentInfo     = "gcm convergent"
+	convergentSaltInfo = "gcm convergent salt"
+)
+
+// errConvergentChanged is returned if the input changed between the two
+// passes of EncryptFileConvergent.
+var errConvergentChanged = errors.New("The file changed while it was encrypted")
+
+// convergentMAC returns the HMAC that the salt is taken from, with the
+// header, metadata record and associated data for the options already
+// written. The plaintext follows. The metadata of the options must already be
+// filled in.
+func convergentMAC(convergenceKey, aad []byte, opts *Options) (hash.Hash, error) {
+	macKey, err := hkdf.Key(sha256.New, convergenceKey, nil, convergentSaltInfo, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	var hdr, meta []byte
+	if opts.needsHeader() {
+		h, m, err := opts.header()
+		if err != nil {
+			return nil, err
+		}
+		// a key commitment is all zeros here, since the key is not known
+		// yet, which still binds whether there is one
+		hdr, meta = h.marshal(), m
+	}
+	mac := hmac.New(sha256.New, macKey)
+	for _, field := range [][]byte{hdr, meta, aad} {
+		mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(field))))
+		mac.Write(field)
+	}
+	return mac, nil
+}
+
+// convergentSalt returns the salt for the plaintext read from src when it is
+// encrypted with the given associated data and options.
+func convergentSalt(src io.Reader, convergenceKey, aad []byte, opts *Options) ([]byte, error) {
+	mac, err := convergentMAC(convergenceKey, aad, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(mac, src); err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil)[:saltSize], nil
+}
+
+// EncryptFileConvergent encrypts the file at inFilePath with a key and IV
+// derived from the convergence key and the content of the file, so files
+// with the same content encrypt to the same output under the same
+// convergence key. The options may be nil. Metadata, if requested, is part of
+// the output, so the names, modes and times of the files must match as well.
+//
+// The file is read twice. If it changes in between, the output is removed
+// and an error returned, since the new content would otherwise be sealed with
+// the key and IV of the old. DecryptFileConvergent decrypts the output with
+// the convergence key alone.
+func EncryptFileConvergent(inFilePath, outFilePath string, convergenceKey, aad []byte, opts *Options) error {
+	opts, err := fileOptions(inFilePath, opts)
+	if err != nil {
+		return err
+	}
+	inFile, err := os.Open(inFilePath)
+	if err != nil {
+		return err
+	}
+	salt, err := convergentSalt(inFile, convergenceKey, aad, opts)
+	inFile.Close()
+	if err != nil {
+		return err
+	}
+	inFile, err = os.Open(inFilePath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	return sealConvergent(inFile, outFilePath, convergenceKey, salt, aad, opts)
+}
+
+// sealConvergent encrypts src into outFilePath with the key and IV derived
+// from salt, checking that src still has the content the salt was computed
+// from before completing the output.
+func sealConvergent(src io.Reader, outFilePath string, convergenceKey, salt, aad []byte, opts *Options) error {
+	key, iv, err := deriveKeyIV(convergenceKey, salt, convergentInfo)
+	if err != nil {
+		return err
+	}
+	mac, err := convergentMAC(convergenceKey, aad, opts)
+	if err != nil {
+		return err
+	}
+	r, err := NewEncryptReaderWithOptions(io.TeeReader(src, mac), key, iv, aad, opts)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.OpenFile(outFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	var dst io.Writer = outFile
+	var armor io.WriteCloser
+	if opts.armored() {
+		armor = NewArmorWriter(outFile)
+		dst = armor
+	}
+	if _, err := dst.Write(salt); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil)[:saltSize], salt) {
+		outFile.Close()
+		os.Remove(outFilePath)
+		return errConvergentChanged
+	}
+	if armor != nil {
+		if err := armor.Close(); err != nil {
+			return err
+		}
+	}
+	return outFile.Close()
+}
+
+// DecryptFileConvergent decrypts a file encrypted by EncryptFileConvergent
+// into outFilePath like DecryptFileWithOptions. The options may be nil.
+func DecryptFileConvergent(inFilePath, outFilePath string, convergenceKey, aad []byte, opts *Options) error {
+	info, err := os.Stat(inFilePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("A file does not exist at %s", inFilePath)
+	}
+	if err == nil {
+		opts = opts.withSize(info.Size() - saltSize)
+	}
+
+	inFile, err := os.Open(inFilePath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	src := Dearmor(inFile)
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(src, salt); err != nil {
+		return fmt.Errorf("Failed to read the salt: %s", err)
+	}
+	key, iv, err := deriveKeyIV(convergenceKey, salt, convergentInfo)
+	if err != nil {
+		return err
+	}
+	return decryptToPath(src, outFilePath, key, iv, aad, opts)
+}
@@ -0,0 +1,122 @@
+package gcm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvergent(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-convergent")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	files := map[string][]byte{
+		"a":     bytes.Repeat([]byte("same content "), 100000),
+		"b":     bytes.Repeat([]byte("same content "), 100000),
+		"c":     bytes.Repeat([]byte("other content "), 100000),
+		"empty": {},
+	}
+	encrypted := make(map[string][]byte)
+	for name, data := range files {
+		p := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(p, data, 0600); err != nil {
+			t.Fatalf("Failed to write file: %s", err)
+		}
+		if err := EncryptFileConvergent(p, p+".enc", key, nil, nil); err != nil {
+			t.Fatalf("Encryption failed: %s", err)
+		}
+		encrypted[name], _ = ioutil.ReadFile(p + ".enc")
+
+		if err := DecryptFileConvergent(p+".enc", p+".dec", key, nil, nil); err != nil {
+			t.Fatalf("Decryption failed: %s", err)
+		}
+		if decrypted, _ := ioutil.ReadFile(p + ".dec"); !bytes.Equal(decrypted, data) {
+			t.Errorf("Failed for %s. Decrypted text differs", name)
+		}
+	}
+	if !bytes.Equal(encrypted["a"], encrypted["b"]) {
+		t.Errorf("Failed. Identical files encrypted to different ciphertext")
+	}
+	if bytes.Equal(encrypted["a"][:saltSize], encrypted["c"][:saltSize]) {
+		t.Errorf("Failed. Different files share a salt")
+	}
+
+	// a different convergence key gives different ciphertext and cannot
+	// decrypt
+	other := bytes.Repeat([]byte{2}, 32)
+	p := filepath.Join(tmp, "a")
+	if err := EncryptFileConvergent(p, p+".other", other, nil, nil); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(p + ".other"); bytes.Equal(b, encrypted["a"]) {
+		t.Errorf("Failed. Different convergence keys gave the same ciphertext")
+	}
+	if err := DecryptFileConvergent(p+".enc", p+".wrong", other, nil, nil); err == nil {
+		t.Errorf("Failed. Expected decryption with the wrong convergence key to fail")
+	}
+
+	// the same content with different metadata or associated data gets a
+	// different key and IV
+	ivs := make(map[string]bool)
+	for i, c := range []struct {
+		aad  []byte
+		opts *Options
+	}{
+		{nil, &Options{Metadata: &Metadata{Name: "first"}}},
+		{nil, &Options{Metadata: &Metadata{Name: "second"}}},
+		{[]byte("aad"), &Options{Metadata: &Metadata{Name: "first"}}},
+		{nil, &Options{KeyCommitment: true}},
+	} {
+		out := filepath.Join(tmp, fmt.Sprintf("bound%d", i))
+		if err := EncryptFileConvergent(p, out, key, c.aad, c.opts); err != nil {
+			t.Fatalf("Encryption failed: %s", err)
+		}
+		b, _ := ioutil.ReadFile(out)
+		_, iv, err := deriveKeyIV(key, b[:saltSize], convergentInfo)
+		if err != nil {
+			t.Fatalf("Failed to derive IV: %s", err)
+		}
+		if ivs[string(iv)] {
+			t.Errorf("Failed for case %d. The IV was already used for the same content", i)
+		}
+		ivs[string(iv)] = true
+		if err := DecryptFileConvergent(out, p+".dec", key, c.aad, nil); err != nil {
+			t.Errorf("Failed for case %d. Decryption failed: %s", i, err)
+		}
+	}
+
+	// a file that changes between the salt pass and the encryption pass
+	// must not be sealed under the old content's key and IV
+	salt, err := convergentSalt(bytes.NewReader(files["a"]), key, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to compute salt: %s", err)
+	}
+	changed := filepath.Join(tmp, "changed.enc")
+	for _, armor := range []bool{false, true} {
+		err := sealConvergent(bytes.NewReader(files["c"]), changed, key, salt, nil, &Options{Armor: armor})
+		if err != errConvergentChanged {
+			t.Errorf("Armor %t failed. Expected a changed file to be rejected, got %v", armor, err)
+		}
+		if _, err := os.Stat(changed); !os.IsNotExist(err) {
+			t.Errorf("Armor %t failed. Expected the output to be removed, got %v", armor, err)
+		}
+	}
+
+	// armored output decrypts as well
+	if err := EncryptFileConvergent(p, p+".asc", key, nil, &Options{Armor: true, KeyCommitment: true}); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if err := DecryptFileConvergent(p+".asc", p+".dec", key, nil, nil); err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if decrypted, _ := ioutil.ReadFile(p + ".dec"); !bytes.Equal(decrypted, files["a"]) {
+		t.Errorf("Failed. Decrypted armored text differs")
+	}
+}
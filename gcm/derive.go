@@ -0,0 +1,100 @@
+package gcm
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+const (
+	// saltSize is the size of the random salt used to derive per-file keys.
+	saltSize = 16
+	// derivedIVSize is the size of IVs derived from a master key.
+	derivedIVSize = 12
+)
+
+// deriveKeyIV derives a key of the same length as master and an IV from the
+// master key, a salt and a context string using HKDF-SHA256.
+func deriveKeyIV(master, salt []byte, info string) ([]byte, []byte, error) {
+	switch len(master) {
+	case 16, 24, 32:
+	default:
+		return nil, nil, fmt.Errorf("Invalid key size %d", len(master))
+	}
+	okm, err := hkdf.Key(sha256.New, master, salt, info, len(master)+derivedIVSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return okm[:len(master)], okm[len(master):], nil
+}
+
+// newSalt returns a new random salt.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// encryptDerived writes a random salt followed by the contents of src
+// encrypted with a key and IV derived from the master key and that salt.
+func encryptDerived(dst io.Writer, src io.Reader, master, aad []byte, info string, opts *Options) error {
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	return encryptDerivedWithSalt(dst, src, master, salt, aad, info, opts)
+}
+
+// encryptDerivedWithSalt is encryptDerived with the given salt.
+func encryptDerivedWithSalt(dst io.Writer, src io.Reader, master, salt, aad []byte, info string, opts *Options) error {
+	r, err := newDerivedEncryptReader(src, master, salt, aad, info, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(salt); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// decryptDerived reverses encryptDerived, reading the salt from src. dst is
+// closed once the final chunk has been authenticated.
+func decryptDerived(dst io.WriteCloser, src io.Reader, master, aad []byte, info string, opts *Options) error {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(src, salt); err != nil {
+		return err
+	}
+	w, err := newDerivedDecryptWriteCloser(dst, master, salt, aad, info, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// newDerivedEncryptReader creates an EncryptReader using a key and IV derived
+// from the master key and salt.
+func newDerivedEncryptReader(src io.Reader, master, salt, aad []byte, info string, opts *Options) (*EncryptReader, error) {
+	key, iv, err := deriveKeyIV(master, salt, info)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptReaderWithOptions(src, key, iv, aad, opts)
+}
+
+// newDerivedDecryptWriteCloser creates a DecryptWriteCloser using a key and IV
+// derived from the master key and salt.
+func newDerivedDecryptWriteCloser(dst io.WriteCloser, master, salt, aad []byte, info string, opts *Options) (*DecryptWriteCloser, error) {
+	key, iv, err := deriveKeyIV(master, salt, info)
+	if err != nil {
+		return nil, err
+	}
+	return NewDecryptWriteCloserWithOptions(dst, key, iv, aad, opts)
+}
@@ -0,0 +1,309 @@
+package gcm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// ManifestName is the name of the encrypted manifest written to the root
+	// of an encrypted directory.
+	ManifestName = ".gcm-manifest"
+
+	dirFileInfo     = "gcm dir file"
+	dirManifestInfo = "gcm dir manifest"
+)
+
+// Manifest lists the files and directories processed by EncryptDir or
+// DecryptDir.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes a single file or directory in a Manifest.
+type ManifestEntry struct {
+	// Path is the slash separated path relative to the directory root.
+	Path string `json:"path"`
+	// Mode holds the type and permission bits of the original entry.
+	Mode os.FileMode `json:"mode"`
+	// ModTime is the modification time of the original entry.
+	ModTime time.Time `json:"mtime"`
+	// Size is the plaintext size of a regular file.
+	Size int64 `json:"size,omitempty"`
+	// Salt is the salt at the start of the encrypted file, which ties the
+	// entry to that ciphertext, so an older or another file cannot be put
+	// in its place.
+	Salt []byte `json:"salt,omitempty"`
+}
+
+// dirFileKeyInfo returns the HKDF info for the key of the file at the slash
+// separated path p, which binds the file to its path.
+func dirFileKeyInfo(p string) string {
+	return dirFileInfo + "\x00" + p
+}
+
+// scanDir lists the directories and regular files below root in lexical
+// order, skipping symbolic links and other special files.
+func scanDir(root string) (*Manifest, error) {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil, fmt.Errorf("A directory does not exist at %s", root)
+	}
+	manifest := &Manifest{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Size:    fileSize(info),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// restoreMetadata applies the permissions and modification time of entry to
+// the file or directory at p.
+func restoreMetadata(p string, entry ManifestEntry) error {
+	if err := os.Chmod(p, entry.Mode.Perm()); err != nil {
+		return err
+	}
+	if entry.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(p, entry.ModTime, entry.ModTime)
+}
+
+// restoreDirMetadata restores the permissions and modification times of the
+// directories in manifest below root. This is done last, deepest first, so
+// they are not disturbed by the files written into them.
+func restoreDirMetadata(root string, manifest *Manifest) error {
+	for i := len(manifest.Entries) - 1; i >= 0; i-- {
+		entry := manifest.Entries[i]
+		if !entry.Mode.IsDir() {
+			continue
+		}
+		rel, err := cleanManifestPath(entry.Path)
+		if err != nil {
+			return err
+		}
+		if err := restoreMetadata(filepath.Join(root, rel), entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncryptDir encrypts every regular file below inDir into the same relative
+// path below outDir, preserving permissions. Each file is encrypted with its
+// own key and IV, derived from the master key, its path and a random salt
+// stored at the start of the file, so no IV is needed and none is ever
+// reused. An encrypted manifest of the processed entries, which records the
+// salt of every file, is written to ManifestName in outDir and returned.
+// Symbolic links and other special files are skipped. Directories are created
+// with mode 0700, so read-only ones can still be filled; their modes are in
+// the manifest.
+func EncryptDir(inDir, outDir string, key, aad []byte, opts *Options) (*Manifest, error) {
+	manifest, err := scanDir(inDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return nil, err
+	}
+	for i, entry := range manifest.Entries {
+		if entry.Path == ManifestName {
+			return nil, fmt.Errorf("%s is reserved for the manifest", entry.Path)
+		}
+		source := filepath.Join(inDir, filepath.FromSlash(entry.Path))
+		target := filepath.Join(outDir, filepath.FromSlash(entry.Path))
+		if entry.Mode.IsDir() {
+			err = os.MkdirAll(target, 0700)
+		} else {
+			manifest.Entries[i].Salt, err = encryptDirFile(source, target, entry, key, aad, opts)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := writeManifest(filepath.Join(outDir, ManifestName), manifest, key, aad); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// DecryptDir decrypts a directory produced by EncryptDir into outDir. Only the
+// entries listed in the authenticated manifest are processed, and each file
+// must be the one recorded there, at the same path and of the same size. The
+// manifest is returned.
+func DecryptDir(inDir, outDir string, key, aad []byte, opts *Options) (*Manifest, error) {
+	manifest, err := ReadManifest(inDir, key, aad)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return nil, err
+	}
+	for _, entry := range manifest.Entries {
+		rel, err := cleanManifestPath(entry.Path)
+		if err != nil {
+			return nil, err
+		}
+		target := filepath.Join(outDir, rel)
+		if entry.Mode.IsDir() {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := decryptDirFile(filepath.Join(inDir, rel), target, entry, key, aad, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := restoreDirMetadata(outDir, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ReadManifest authenticates and returns the manifest of a directory produced
+// by EncryptDir.
+func ReadManifest(inDir string, key, aad []byte) (*Manifest, error) {
+	f, err := os.Open(filepath.Join(inDir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readManifest(f, key, aad)
+}
+
+func readManifest(f io.Reader, key, aad []byte) (*Manifest, error) {
+	var buf bytes.Buffer
+	if err := decryptDerived(nopCloser{&buf}, f, key, aad, dirManifestInfo, nil); err != nil {
+		return nil, fmt.Errorf("Failed to decrypt manifest: %s", err)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(buf.Bytes(), manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeManifest(p string, manifest *Manifest, key, aad []byte) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := encryptDerived(f, bytes.NewReader(data), key, aad, dirManifestInfo, nil); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// encryptDirFile encrypts a file of a directory, returning its salt.
+func encryptDirFile(inPath, outPath string, entry ManifestEntry, key, aad []byte, opts *Options) ([]byte, error) {
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	outFile, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	if err := encryptDerivedWithSalt(outFile, inFile, key, salt, aad, dirFileKeyInfo(entry.Path), opts.withSize(entry.Size)); err != nil {
+		return nil, err
+	}
+	return salt, outFile.Close()
+}
+
+func decryptDirFile(inPath, outPath string, entry ManifestEntry, key, aad []byte, opts *Options) error {
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	var size int64
+	if info, err := inFile.Stat(); err == nil {
+		size = info.Size()
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(inFile, salt); err != nil || !bytes.Equal(salt, entry.Salt) {
+		return fmt.Errorf("%s is not the file listed in the manifest", entry.Path)
+	}
+
+	outFile, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	w, err := newDerivedDecryptWriteCloser(outFile, key, salt, aad, dirFileKeyInfo(entry.Path), opts.withSize(size))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, inFile); err != nil {
+		return fmt.Errorf("Failed to decrypt %s: %s", entry.Path, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Failed to decrypt %s: %s", entry.Path, err)
+	}
+	if info, err := os.Stat(outPath); err != nil || info.Size() != entry.Size {
+		return fmt.Errorf("%s does not have the size listed in the manifest", entry.Path)
+	}
+	return restoreMetadata(outPath, entry)
+}
+
+// cleanManifestPath converts a manifest path to a local relative path,
+// rejecting paths that would escape the output directory.
+func cleanManifestPath(p string) (string, error) {
+	clean := path.Clean(p)
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path in manifest: %s", p)
+	}
+	return filepath.FromSlash(clean), nil
+}
+
+func fileSize(info os.FileInfo) int64 {
+	if info.Mode().IsRegular() {
+		return info.Size()
+	}
+	return 0
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,182 @@
+package gcm
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-dir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	inDir := filepath.Join(tmp, "in")
+	encDir := filepath.Join(tmp, "enc")
+	outDir := filepath.Join(tmp, "out")
+
+	files := map[string][]byte{
+		"a.txt":         []byte("hello world"),
+		"empty":         {},
+		"sub/b.bin":     bytes.Repeat([]byte{0x42}, chunkSize+1),
+		"sub/deep/c.sh": []byte("#!/bin/sh\n"),
+	}
+	for name, data := range files {
+		p := filepath.Join(inDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(p, data, 0640); err != nil {
+			t.Fatalf("Failed to write file: %s", err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(inDir, "sub/deep/c.sh"), 0750); err != nil {
+		t.Fatalf("Failed to chmod file: %s", err)
+	}
+
+	manifest, err := EncryptDir(inDir, encDir, key, nil, nil)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if len(manifest.Entries) != 6 {
+		t.Errorf("Expected 6 manifest entries, got %d", len(manifest.Entries))
+	}
+
+	// identical files must not produce identical ciphertext
+	if err := ioutil.WriteFile(filepath.Join(inDir, "copy.txt"), files["a.txt"], 0640); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+	if _, err := EncryptDir(inDir, encDir, key, nil, nil); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	a, _ := ioutil.ReadFile(filepath.Join(encDir, "a.txt"))
+	b, _ := ioutil.ReadFile(filepath.Join(encDir, "copy.txt"))
+	if bytes.Equal(a, b) {
+		t.Error("Identical files encrypted to identical ciphertext")
+	}
+
+	if _, err := DecryptDir(encDir, outDir, key, nil, nil); err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	for name, data := range files {
+		p := filepath.Join(outDir, filepath.FromSlash(name))
+		out, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("Failed to read %s: %s", name, err)
+			continue
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s differs after decryption", name)
+		}
+	}
+	info, err := os.Stat(filepath.Join(outDir, "sub/deep/c.sh"))
+	if err != nil {
+		t.Fatalf("Failed to stat file: %s", err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("Expected mode 0750, got %s", info.Mode())
+	}
+
+	if _, err := DecryptDir(encDir, filepath.Join(tmp, "bad"), make([]byte, 16), nil, nil); err == nil {
+		t.Error("Expected decryption with the wrong key to fail")
+	}
+}
+
+// TestDirReadOnly checks that read-only directories are filled and that their
+// modes are restored after decryption.
+func TestDirReadOnly(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-dir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	inDir := filepath.Join(tmp, "in")
+	encDir := filepath.Join(tmp, "enc")
+	outDir := filepath.Join(tmp, "out")
+	if err := os.MkdirAll(filepath.Join(inDir, "ro"), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(inDir, "ro/a.txt"), []byte("hello"), 0640); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+	if err := os.Chmod(filepath.Join(inDir, "ro"), 0555); err != nil {
+		t.Fatalf("Failed to chmod dir: %s", err)
+	}
+	defer os.Chmod(filepath.Join(outDir, "ro"), 0755)
+	defer os.Chmod(filepath.Join(inDir, "ro"), 0755)
+
+	if _, err := EncryptDir(inDir, encDir, key, nil, nil); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if _, err := DecryptDir(encDir, outDir, key, nil, nil); err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(outDir, "ro/a.txt"))
+	if err != nil || string(out) != "hello" {
+		t.Errorf("Failed to decrypt the file in the read-only dir: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(outDir, "ro"))
+	if err != nil {
+		t.Fatalf("Failed to stat dir: %s", err)
+	}
+	if info.Mode().Perm() != 0555 {
+		t.Errorf("Expected mode 0555, got %s", info.Mode())
+	}
+}
+
+func TestDirTampering(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-dir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	inDir := filepath.Join(tmp, "in")
+	encDir := filepath.Join(tmp, "enc")
+	os.MkdirAll(inDir, 0755)
+	ioutil.WriteFile(filepath.Join(inDir, "a"), []byte("version 1"), 0600)
+	ioutil.WriteFile(filepath.Join(inDir, "b"), []byte("other file"), 0600)
+	if _, err := EncryptDir(inDir, encDir, key, nil, nil); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	old, _ := ioutil.ReadFile(filepath.Join(encDir, "a"))
+	ioutil.WriteFile(filepath.Join(inDir, "a"), []byte("version 2"), 0600)
+	if _, err := EncryptDir(inDir, encDir, key, nil, nil); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	a, _ := ioutil.ReadFile(filepath.Join(encDir, "a"))
+	b, _ := ioutil.ReadFile(filepath.Join(encDir, "b"))
+
+	for name, files := range map[string][2][]byte{
+		"swapped":     {b, a},
+		"rolled back": {old, b},
+	} {
+		ioutil.WriteFile(filepath.Join(encDir, "a"), files[0], 0600)
+		ioutil.WriteFile(filepath.Join(encDir, "b"), files[1], 0600)
+		if _, err := DecryptDir(encDir, filepath.Join(tmp, "out"), key, nil, nil); err == nil {
+			t.Errorf("Failed. Expected %s files to be rejected", name)
+		}
+		if _, err := NewFS(os.DirFS(encDir), key, nil).Open("a"); err == nil {
+			t.Errorf("Failed. Expected FS to reject %s files", name)
+		}
+	}
+
+	// files not in the manifest are not visible
+	ioutil.WriteFile(filepath.Join(encDir, "a"), a, 0600)
+	ioutil.WriteFile(filepath.Join(encDir, "c"), a, 0600)
+	if _, err := NewFS(os.DirFS(encDir), key, nil).Open("c"); err == nil {
+		t.Errorf("Failed. Expected a file missing from the manifest to be hidden")
+	}
+	if entries, err := fs.ReadDir(NewFS(os.DirFS(encDir), key, nil), "."); err != nil || len(entries) != 2 {
+		t.Errorf("Failed. Expected only the 2 listed files, got %d, %v", len(entries), err)
+	}
+}
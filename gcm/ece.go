@@ -0,0 +1,365 @@
+package gcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RFC 8188 defines the "aes128gcm" HTTP content coding, a record based AES-GCM
+// format like the streams of this package. A body starts with a header
+//
+//	salt  [16]byte
+//	rs    uint32   record size
+//	idlen uint8
+//	keyid [idlen]byte
+//
+// followed by records of rs bytes, the last of which may be shorter. Each
+// record holds data, a delimiter of 1, or 2 for the last record, and
+// optional zero padding, sealed with a nonce derived from its sequence
+// number. The key and nonce are derived from the input keying material and
+// the salt with HKDF-SHA-256.
+
+// ContentEncodingAES128GCM is the HTTP Content-Encoding of RFC 8188 bodies.
+const ContentEncodingAES128GCM = "aes128gcm"
+
+const (
+	eceSaltSize        = 16
+	eceKeySize         = 16
+	eceNonceSize       = 12
+	eceHeaderSize      = eceSaltSize + 4 + 1
+	eceMinRecordSize   = tagSize + 2
+	eceDefaultRecord   = 4096
+	eceMaxRecordSize   = chunkSize // decoders buffer a whole record
+	eceRecordDelimiter = 1
+	eceFinalDelimiter  = 2
+)
+
+// ContentParams configures an RFC 8188 encoder.
+type ContentParams struct {
+	// Salt is the random salt of the body. A new salt is generated if it
+	// is nil. A salt must never be reused with the same key.
+	Salt []byte
+	// RecordSize is the size of each encrypted record, at least 18. It
+	// defaults to 4096. Records larger than 1 MiB are only decoded by a
+	// ContentDecryptWriteCloser whose limit is raised with SetMaxRecordSize.
+	RecordSize uint32
+	// KeyID identifies the key to the recipient. It may be empty.
+	KeyID []byte
+}
+
+// ContentKeyFunc returns the input keying material for the key ID of an
+// RFC 8188 body.
+type ContentKeyFunc = KeyFunc
+
+// eceKeys derives the AEAD and base nonce for an RFC 8188 body.
+func eceKeys(ikm, salt []byte) (cipher.AEAD, []byte, error) {
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", eceKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", eceNonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+// eceNonce returns the nonce of the record with the given sequence number.
+func eceNonce(base []byte, seq uint64) []byte {
+	nonce := append([]byte{}, base...)
+	for i := 0; i < 8; i++ {
+		nonce[eceNonceSize-1-i] ^= byte(seq >> (8 * uint(i)))
+	}
+	return nonce
+}
+
+// ContentEncryptReader encodes the data read from its source as an RFC 8188
+// body.
+type ContentEncryptReader struct {
+	src  io.Reader
+	eof  bool
+	aead cipher.AEAD
+
+	nonce []byte
+	seq   uint64
+
+	sealed []byte
+	off    int
+	// buff holds the data of the next record plus one byte that shows
+	// whether another record follows
+	buff []byte
+	held int
+}
+
+// NewContentEncryptReader creates a ContentEncryptReader that encodes src with
+// the given input keying material. The params may be nil.
+func NewContentEncryptReader(src io.Reader, ikm []byte, params *ContentParams) (*ContentEncryptReader, error) {
+	p := ContentParams{}
+	if params != nil {
+		p = *params
+	}
+	if p.RecordSize == 0 {
+		p.RecordSize = eceDefaultRecord
+	}
+	if p.RecordSize < eceMinRecordSize {
+		return nil, fmt.Errorf("Invalid record size %d", p.RecordSize)
+	}
+	if len(p.KeyID) > 255 {
+		return nil, errors.New("The key ID is longer than 255 bytes")
+	}
+	if p.Salt == nil {
+		p.Salt = make([]byte, eceSaltSize)
+		if _, err := rand.Read(p.Salt); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.Salt) != eceSaltSize {
+		return nil, fmt.Errorf("Invalid salt size %d", len(p.Salt))
+	}
+	aead, nonce, err := eceKeys(ikm, p.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 0, eceHeaderSize+len(p.KeyID))
+	hdr = append(hdr, p.Salt...)
+	hdr = binary.BigEndian.AppendUint32(hdr, p.RecordSize)
+	hdr = append(hdr, byte(len(p.KeyID)))
+	hdr = append(hdr, p.KeyID...)
+	return &ContentEncryptReader{
+		src:    src,
+		aead:   aead,
+		nonce:  nonce,
+		sealed: hdr,
+		buff:   make([]byte, int(p.RecordSize)-tagSize, int(p.RecordSize)),
+	}, nil
+}
+
+func (r *ContentEncryptReader) Read(p []byte) (int, error) {
+	n := len(p)
+	off := 0
+	for off < n {
+		if r.off >= len(r.sealed) {
+			if r.eof {
+				return off, io.EOF
+			}
+			if err := r.seal(); err != nil {
+				return off, err
+			}
+		}
+		read := copy(p[off:], r.sealed[r.off:])
+		r.off += read
+		off += read
+	}
+	return off, nil
+}
+
+func (r *ContentEncryptReader) seal() error {
+	n, err := io.ReadFull(r.src, r.buff[r.held:])
+	n += r.held
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.eof = true
+	} else if err != nil {
+		return err
+	}
+	record := r.buff[:n]
+	delimiter := byte(eceFinalDelimiter)
+	var extra byte
+	if !r.eof {
+		// the extra byte starts the next record
+		record = r.buff[:n-1]
+		delimiter = eceRecordDelimiter
+		extra = r.buff[n-1]
+	}
+	plain := append(record, delimiter)
+	r.sealed = r.aead.Seal(r.sealed[:0], eceNonce(r.nonce, r.seq), plain, nil)
+	r.seq++
+	r.off = 0
+	r.held = 0
+	if !r.eof {
+		r.buff[0] = extra
+		r.held = 1
+	}
+	return nil
+}
+
+// ContentDecryptWriteCloser decodes an RFC 8188 body written to it, writing
+// the data to dst. The body is only known to be complete and authentic once
+// Close returns without error.
+type ContentDecryptWriteCloser struct {
+	dst  io.WriteCloser
+	keys ContentKeyFunc
+	aead cipher.AEAD
+
+	nonce []byte
+	seq   uint64
+	keyID []byte
+
+	header        []byte
+	recordSize    int
+	maxRecordSize uint32
+	sealed        []byte
+	off           int
+	final         bool
+}
+
+// NewContentDecryptWriteCloser creates a ContentDecryptWriteCloser that
+// decodes with the given input keying material, whatever the key ID.
+func NewContentDecryptWriteCloser(dst io.WriteCloser, ikm []byte) *ContentDecryptWriteCloser {
+	return NewContentDecryptWriteCloserWithKeys(dst, func([]byte) ([]byte, error) {
+		return ikm, nil
+	})
+}
+
+// NewContentDecryptWriteCloserWithKeys creates a ContentDecryptWriteCloser
+// that looks up the input keying material by the key ID in the header.
+func NewContentDecryptWriteCloserWithKeys(dst io.WriteCloser, keys ContentKeyFunc) *ContentDecryptWriteCloser {
+	return &ContentDecryptWriteCloser{dst: dst, keys: keys, maxRecordSize: eceMaxRecordSize}
+}
+
+// SetMaxRecordSize sets the largest record size accepted from the header,
+// which defaults to 1 MiB. A record is buffered whole before it is
+// authenticated, so the limit bounds the memory an untrusted body can claim.
+// It must be called before the header is written.
+func (w *ContentDecryptWriteCloser) SetMaxRecordSize(size uint32) {
+	w.maxRecordSize = size
+}
+
+// KeyID returns the key ID of the body, or nil if the header has not been
+// read yet.
+func (w *ContentDecryptWriteCloser) KeyID() []byte {
+	return w.keyID
+}
+
+func (w *ContentDecryptWriteCloser) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.aead == nil {
+		read, err := w.readHeader(p)
+		if err != nil || w.aead == nil {
+			return read, err
+		}
+		p = p[read:]
+	}
+	off := 0
+	for off < len(p) {
+		if w.final {
+			return n - len(p) + off, errors.New("Unexpected data after the final record")
+		}
+		written := copy(w.sealed[w.off:], p[off:])
+		w.off += written
+		off += written
+		if w.off == len(w.sealed) {
+			if err := w.open(); err != nil {
+				return n - len(p) + off, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// readHeader consumes the header, returning the number of bytes of p used.
+func (w *ContentDecryptWriteCloser) readHeader(p []byte) (int, error) {
+	need := eceHeaderSize
+	if len(w.header) >= eceHeaderSize {
+		need += int(w.header[eceHeaderSize-1])
+	}
+	read := 0
+	for len(w.header) < need {
+		if read == len(p) {
+			return read, nil
+		}
+		w.header = append(w.header, p[read])
+		read++
+		if len(w.header) == eceHeaderSize {
+			need += int(w.header[eceHeaderSize-1])
+		}
+	}
+
+	salt := w.header[:eceSaltSize]
+	rs := binary.BigEndian.Uint32(w.header[eceSaltSize:])
+	if rs < eceMinRecordSize || rs > w.maxRecordSize {
+		return read, fmt.Errorf("Invalid record size %d", rs)
+	}
+	w.keyID = append([]byte{}, w.header[eceHeaderSize:]...)
+	ikm, err := w.keys(w.keyID)
+	if err != nil {
+		return read, err
+	}
+	aead, nonce, err := eceKeys(ikm, salt)
+	if err != nil {
+		return read, err
+	}
+	w.aead = aead
+	w.nonce = nonce
+	w.sealed = make([]byte, rs)
+	return read, nil
+}
+
+func (w *ContentDecryptWriteCloser) open() error {
+	plain, err := w.aead.Open(w.sealed[:0:0], eceNonce(w.nonce, w.seq), w.sealed[:w.off], nil)
+	if err != nil {
+		return err
+	}
+	w.seq++
+	w.off = 0
+	// remove the padding and delimiter
+	end := len(plain) - 1
+	for end >= 0 && plain[end] == 0 {
+		end--
+	}
+	if end < 0 {
+		return errors.New("Record has no delimiter")
+	}
+	switch plain[end] {
+	case eceRecordDelimiter:
+	case eceFinalDelimiter:
+		w.final = true
+	default:
+		return errors.New("Invalid record delimiter")
+	}
+	_, err = w.dst.Write(plain[:end])
+	return err
+}
+
+// Close decodes the final record and closes dst. It returns an error if the
+// body is truncated.
+func (w *ContentDecryptWriteCloser) Close() error {
+	if w.aead == nil {
+		return errors.New("The content header is truncated")
+	}
+	if w.off > 0 {
+		if w.final {
+			return errors.New("Unexpected data after the final record")
+		}
+		if err := w.open(); err != nil {
+			return err
+		}
+		if !w.final {
+			// only the last record may be shorter than the record size
+			return errors.New("The content is truncated")
+		}
+	}
+	if !w.final {
+		return errors.New("The content is truncated")
+	}
+	return w.dst.Close()
+}
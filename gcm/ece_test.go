@@ -0,0 +1,132 @@
+package gcm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+)
+
+func decodeContent(body, ikm []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w := NewContentDecryptWriteCloser(nopCloser{&out}, ikm)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// TestContentVectors checks the examples in section 3 of RFC 8188.
+func TestContentVectors(t *testing.T) {
+	tests := []struct {
+		ikm  string
+		body string
+	}{
+		{"yqdlZ-tYemfogSmv7Ws5PQ", "I1BsxtFttlv3u_Oo94xnmwAAEAAA-NAVub2qFgBEuQKRapoZu-IxkIva3MEB1PD-ly8Thjg"},
+		{"BO3ZVPxUlnLORbVGMpbT1Q", "uNCkWiNYzKTnBN9ji3-qWAAAABkCYTHOG8chz_gnvgOqdGYovxyjuqRyJFjEDyoF1Fvkj6hQPdPHI51OEUKEpgz3SsLWIqS_uA"},
+	}
+	for i, test := range tests {
+		ikm, _ := base64.RawURLEncoding.DecodeString(test.ikm)
+		body, _ := base64.RawURLEncoding.DecodeString(test.body)
+		out, err := decodeContent(body, ikm)
+		if err != nil {
+			t.Fatalf("Vector %d failed: %s", i, err)
+		}
+		if string(out) != "I am the walrus" {
+			t.Errorf("Vector %d failed. Got %q", i, out)
+		}
+	}
+}
+
+func TestContentEncryptVector(t *testing.T) {
+	ikm, _ := base64.RawURLEncoding.DecodeString("yqdlZ-tYemfogSmv7Ws5PQ")
+	expected, _ := base64.RawURLEncoding.DecodeString("I1BsxtFttlv3u_Oo94xnmwAAEAAA-NAVub2qFgBEuQKRapoZu-IxkIva3MEB1PD-ly8Thjg")
+	r, err := NewContentEncryptReader(bytes.NewReader([]byte("I am the walrus")), ikm, &ContentParams{Salt: expected[:eceSaltSize]})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %s", err)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Encoding failed: %s", err)
+	}
+	if !bytes.Equal(body, expected) {
+		t.Errorf("Failed. Expected %x, got %x", expected, body)
+	}
+}
+
+func TestContentRoundTrip(t *testing.T) {
+	ikm := []byte("0123456789abcdef")
+	for _, rs := range []uint32{18, 25, 4096} {
+		for _, size := range []int{0, 1, 7, 8, 9, 100, 10000} {
+			plainText := bytes.Repeat([]byte{9}, size)
+			r, err := NewContentEncryptReader(bytes.NewReader(plainText), ikm, &ContentParams{RecordSize: rs, KeyID: []byte("k1")})
+			if err != nil {
+				t.Fatalf("Failed to create reader: %s", err)
+			}
+			body, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Record size %d size %d encoding failed: %s", rs, size, err)
+			}
+			out, err := decodeContent(body, ikm)
+			if err != nil {
+				t.Fatalf("Record size %d size %d decoding failed: %s", rs, size, err)
+			}
+			if !bytes.Equal(out, plainText) {
+				t.Errorf("Record size %d size %d failed. Plaintext differs", rs, size)
+			}
+			// dropping whole records is detected
+			if size > 0 && len(body) > eceHeaderSize+2+int(rs) {
+				if _, err := decodeContent(body[:eceHeaderSize+2+int(rs)], ikm); err == nil {
+					t.Errorf("Record size %d size %d failed. Expected truncation to be detected", rs, size)
+				}
+			}
+		}
+	}
+}
+
+func TestContentErrors(t *testing.T) {
+	ikm := []byte("0123456789abcdef")
+	r, _ := NewContentEncryptReader(bytes.NewReader([]byte("hello")), ikm, &ContentParams{KeyID: []byte("a")})
+	body, _ := ioutil.ReadAll(r)
+
+	if _, err := decodeContent(body, []byte("wrong")); err == nil {
+		t.Errorf("Failed. Expected a wrong key to be detected")
+	}
+	if _, err := decodeContent(append(append([]byte{}, body...), 0), ikm); err == nil {
+		t.Errorf("Failed. Expected trailing data to be detected")
+	}
+	if _, err := decodeContent(body[:10], ikm); err == nil {
+		t.Errorf("Failed. Expected a truncated header to be detected")
+	}
+	if _, err := NewContentEncryptReader(nil, ikm, &ContentParams{RecordSize: 17}); err == nil {
+		t.Errorf("Failed. Expected a small record size to be rejected")
+	}
+
+	r, _ = NewContentEncryptReader(bytes.NewReader([]byte("hello")), ikm, &ContentParams{RecordSize: eceMaxRecordSize + 1})
+	large, _ := ioutil.ReadAll(r)
+	if _, err := decodeContent(large, ikm); err == nil {
+		t.Errorf("Failed. Expected a large record size to be rejected")
+	}
+	var raised bytes.Buffer
+	lw := NewContentDecryptWriteCloser(nopCloser{&raised}, ikm)
+	lw.SetMaxRecordSize(eceMaxRecordSize + 1)
+	lw.Write(large)
+	if err := lw.Close(); err != nil || raised.String() != "hello" {
+		t.Errorf("Failed to decode with a raised record size limit: %v", err)
+	}
+
+	var out bytes.Buffer
+	w := NewContentDecryptWriteCloserWithKeys(nopCloser{&out}, func(keyID []byte) ([]byte, error) {
+		if string(keyID) != "a" {
+			t.Errorf("Failed. Unexpected key ID %q", keyID)
+		}
+		return ikm, nil
+	})
+	w.Write(body)
+	if err := w.Close(); err != nil || out.String() != "hello" {
+		t.Errorf("Failed to decode with key lookup: %v", err)
+	}
+}
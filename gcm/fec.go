@@ -0,0 +1,443 @@
+package gcm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Streams encrypted with error correction follow every group of DataChunks
+// ciphertext chunks with ParityChunks parity shards of a systematic
+// Reed-Solomon code over GF(256). Chunks that fail to authenticate are
+// treated as erasures, so up to ParityChunks damaged chunks per group are
+// repaired before they are decrypted.
+//
+// Parity shards are the size of the first chunk of their group, with shorter
+// chunks padded with zeros. Every group but the last holds DataChunks full
+// chunks, and the last group holds the final, short chunk, so the layout of
+// the last group follows from its size.
+
+const (
+	// maxParityChunks bounds the parity shards per group, and so the sets
+	// of shards a damaged group may be repaired from.
+	maxParityChunks = 16
+	// maxRepairAttempts bounds the sets of parity shards tried per group.
+	// Damaged parity is only found by trying another set, so heavy damage
+	// to both chunks and parity gives up rather than trying them all.
+	maxRepairAttempts = 256
+)
+
+// ErrorCorrection configures Reed-Solomon parity over the ciphertext chunks.
+type ErrorCorrection struct {
+	// DataChunks is the number of chunks in each group.
+	DataChunks int
+	// ParityChunks is the number of parity shards after each group, and so
+	// the number of damaged chunks that can be repaired per group. It is at
+	// most 16.
+	ParityChunks int
+}
+
+func (e ErrorCorrection) enabled() bool {
+	return e.ParityChunks > 0
+}
+
+func (e ErrorCorrection) validate() error {
+	if e.DataChunks < 1 || e.ParityChunks < 1 || e.ParityChunks > maxParityChunks || e.DataChunks+e.ParityChunks > 256 {
+		return fmt.Errorf("Invalid error correction of %d data and %d parity chunks", e.DataChunks, e.ParityChunks)
+	}
+	return nil
+}
+
+// GF(256) with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c times src to dst.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// coefficient returns the coefficient of data chunk j in parity shard
+// i. Together with the identity rows of the data chunks, every square
+// submatrix of the Cauchy matrix is invertible, so any DataChunks shards of a
+// group recover it.
+func (e ErrorCorrection) coefficient(i, j int) byte {
+	return gfInv(byte(e.DataChunks+i) ^ byte(j))
+}
+
+// gfInvert inverts the square matrix m in place.
+func gfInvert(m [][]byte) error {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return errors.New("Singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		scale := gfInv(m[col][col])
+		for j := 0; j < n; j++ {
+			m[col][j] = gfMul[scale][m[col][j]]
+			inv[col][j] = gfMul[scale][inv[col][j]]
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			f := m[row][col]
+			for j := 0; j < n; j++ {
+				m[row][j] ^= gfMul[f][m[col][j]]
+				inv[row][j] ^= gfMul[f][inv[col][j]]
+			}
+		}
+	}
+	copy(m, inv)
+	return nil
+}
+
+// fecEncoder accumulates the parity of the chunks of a group as they are
+// sealed.
+type fecEncoder struct {
+	ec     ErrorCorrection
+	parity [][]byte
+	chunks int
+	size   int
+}
+
+func newFECEncoder(ec ErrorCorrection) *fecEncoder {
+	e := &fecEncoder{ec: ec, parity: make([][]byte, ec.ParityChunks)}
+	for i := range e.parity {
+		e.parity[i] = make([]byte, chunkSize+tagSize)
+	}
+	return e
+}
+
+// add adds a sealed chunk to the group, and returns the parity of the group
+// to follow it if the group is complete or final is set.
+func (e *fecEncoder) add(dst, chunk []byte, final bool) []byte {
+	if e.chunks == 0 {
+		e.size = len(chunk)
+	}
+	for i, p := range e.parity {
+		gfMulAdd(p, chunk, e.ec.coefficient(i, e.chunks))
+	}
+	e.chunks++
+	if e.chunks < e.ec.DataChunks && !final {
+		return dst
+	}
+	for _, p := range e.parity {
+		dst = append(dst, p[:e.size]...)
+		for i := range p {
+			p[i] = 0
+		}
+	}
+	e.chunks = 0
+	return dst
+}
+
+// paritySize returns the total size of the parity for a stream of body
+// bytes of chunks.
+func (e ErrorCorrection) paritySize(body int64) int64 {
+	full := int64(chunkSize + tagSize)
+	chunks := body/full + 1
+	groups := (chunks + int64(e.DataChunks) - 1) / int64(e.DataChunks)
+	size := groups * int64(e.ParityChunks) * full
+	if (chunks-1)%int64(e.DataChunks) == 0 {
+		// the last group holds only the final chunk
+		size -= int64(e.ParityChunks) * (full - body%full)
+	}
+	return size
+}
+
+// fecGroup describes the layout of a group of chunks and parity shards.
+type fecGroup struct {
+	chunks []int
+	parity int
+}
+
+// fullGroup returns the layout of a group that is not the last.
+func (e ErrorCorrection) fullGroup() fecGroup {
+	g := fecGroup{chunks: make([]int, e.DataChunks), parity: chunkSize + tagSize}
+	for i := range g.chunks {
+		g.chunks[i] = chunkSize + tagSize
+	}
+	return g
+}
+
+// fullGroupSize returns the size of a group that is not the last, which is
+// larger than any last group.
+func (e ErrorCorrection) fullGroupSize() int {
+	return (e.DataChunks + e.ParityChunks) * (chunkSize + tagSize)
+}
+
+// lastGroup returns the layout of the last group given its size.
+func (e ErrorCorrection) lastGroup(size int) (fecGroup, error) {
+	full := chunkSize + tagSize
+	m := e.ParityChunks
+	if size < (m+1)*full {
+		// only the final chunk, with parity of the same size
+		if size%(m+1) != 0 || size/(m+1) < tagSize {
+			return fecGroup{}, errors.New("The stream is truncated")
+		}
+		return fecGroup{chunks: []int{size / (m + 1)}, parity: size / (m + 1)}, nil
+	}
+	data := size - m*full
+	fulls := data / full
+	last := data % full
+	if last < tagSize || fulls >= e.DataChunks {
+		return fecGroup{}, errors.New("The stream is truncated")
+	}
+	g := fecGroup{parity: full}
+	for i := 0; i < fulls; i++ {
+		g.chunks = append(g.chunks, full)
+	}
+	g.chunks = append(g.chunks, last)
+	return g, nil
+}
+
+// truncatedGroup returns the layout of the data chunks of a last group of
+// size bytes that is not valid, ignoring its parity.
+func (e ErrorCorrection) truncatedGroup(size int) fecGroup {
+	full := chunkSize + tagSize
+	g := fecGroup{}
+	for len(g.chunks) < e.DataChunks && (size > 0 || len(g.chunks) == 0) {
+		n := size
+		if n > full {
+			n = full
+		}
+		g.chunks = append(g.chunks, n)
+		size -= n
+	}
+	return g
+}
+
+// split splits the bytes of a group into its chunks and parity shards.
+func (g fecGroup) split(b []byte, m int) ([][]byte, [][]byte) {
+	chunks := make([][]byte, len(g.chunks))
+	for i, n := range g.chunks {
+		chunks[i], b = b[:n], b[n:]
+	}
+	parity := make([][]byte, m)
+	for i := range parity {
+		parity[i], b = b[:g.parity], b[g.parity:]
+	}
+	return chunks, parity
+}
+
+// size returns the size of the group with m parity shards.
+func (g fecGroup) size(m int) int {
+	size := m * g.parity
+	for _, n := range g.chunks {
+		size += n
+	}
+	return size
+}
+
+// repair replaces the chunks of a group for which valid returns false with
+// ones reconstructed from the other chunks and the parity, trying sets of
+// parity shards in turn since damaged parity cannot be detected. It returns
+// the number of chunks repaired and the indexes of the chunks that could not
+// be.
+func (e ErrorCorrection) repair(chunks, parity [][]byte, valid func(i int, chunk []byte) bool) (int, []int) {
+	var bad []int
+	for i, c := range chunks {
+		if !valid(i, c) {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 || len(bad) > len(parity) {
+		return 0, bad
+	}
+	s := &fecSolver{ec: e, chunks: chunks, parity: parity, bad: bad, rhs: make([][]byte, len(parity))}
+	rows := make([]int, len(bad))
+	for i := range rows {
+		rows[i] = i
+	}
+	for attempt := 0; attempt < maxRepairAttempts; attempt++ {
+		if repaired, err := s.reconstruct(rows); err == nil {
+			ok := true
+			for k, i := range bad {
+				if !valid(i, repaired[k]) {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				for k, i := range bad {
+					copy(chunks[i], repaired[k])
+				}
+				return len(bad), nil
+			}
+		}
+		if !nextCombination(rows, len(parity)) {
+			break
+		}
+	}
+	return 0, bad
+}
+
+// fecSolver reconstructs the bad chunks of a group from sets of parity
+// shards, reusing its buffers between sets.
+type fecSolver struct {
+	ec     ErrorCorrection
+	chunks [][]byte
+	parity [][]byte
+	bad    []int
+	// rhs holds each parity shard minus the known chunks, a combination of
+	// the bad chunks, once it is needed
+	rhs [][]byte
+	out [][]byte
+}
+
+// reconstruct solves for the bad chunks using the given parity rows.
+func (s *fecSolver) reconstruct(rows []int) ([][]byte, error) {
+	n := len(s.bad)
+	m := make([][]byte, n)
+	for r, row := range rows {
+		m[r] = make([]byte, n)
+		for k, j := range s.bad {
+			m[r][k] = s.ec.coefficient(row, j)
+		}
+	}
+	if err := gfInvert(m); err != nil {
+		return nil, err
+	}
+	size := len(s.parity[0])
+	if s.out == nil {
+		s.out = make([][]byte, n)
+		for k := range s.out {
+			s.out[k] = make([]byte, size)
+		}
+	}
+	for k, j := range s.bad {
+		out := s.out[k][:size]
+		for i := range out {
+			out[i] = 0
+		}
+		for r, row := range rows {
+			gfMulAdd(out, s.known(row), m[k][r])
+		}
+		s.out[k] = out[:len(s.chunks[j])]
+	}
+	return s.out, nil
+}
+
+// known returns parity shard row minus the known chunks.
+func (s *fecSolver) known(row int) []byte {
+	if s.rhs[row] != nil {
+		return s.rhs[row]
+	}
+	isBad := make(map[int]bool)
+	for _, i := range s.bad {
+		isBad[i] = true
+	}
+	rhs := append([]byte{}, s.parity[row]...)
+	for j, c := range s.chunks {
+		if !isBad[j] {
+			gfMulAdd(rhs, c, s.ec.coefficient(row, j))
+		}
+	}
+	s.rhs[row] = rhs
+	return rhs
+}
+
+// nextCombination advances c, a k element subset of 0..n-1 in increasing
+// order, to the next one in lexicographic order, and reports whether there
+// was one.
+func nextCombination(c []int, n int) bool {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i] < n-len(c)+i {
+			c[i]++
+			for j := i + 1; j < len(c); j++ {
+				c[j] = c[j-1] + 1
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// fecDecoder buffers the groups of a stream, repairs them, and passes their
+// chunks on.
+type fecDecoder struct {
+	ec    ErrorCorrection
+	buf   []byte
+	valid func(i int, chunk []byte) bool
+	emit  func(chunk []byte) error
+	skip  func(n int)
+	group int
+}
+
+func (d *fecDecoder) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	full := d.ec.fullGroupSize()
+	for len(d.buf) >= full {
+		if err := d.process(d.buf[:full], d.ec.fullGroup()); err != nil {
+			return 0, err
+		}
+		d.buf = append(d.buf[:0], d.buf[full:]...)
+	}
+	return len(p), nil
+}
+
+// Close processes the last group.
+func (d *fecDecoder) Close() error {
+	g, err := d.ec.lastGroup(len(d.buf))
+	if err != nil {
+		return err
+	}
+	return d.process(d.buf, g)
+}
+
+func (d *fecDecoder) process(b []byte, g fecGroup) error {
+	chunks, parity := g.split(b, d.ec.ParityChunks)
+	if _, bad := d.ec.repair(chunks, parity, d.valid); len(bad) > 0 {
+		return fmt.Errorf("Chunk group %d has %d damaged chunks, more than its %d parity chunks can repair", d.group, len(bad), d.ec.ParityChunks)
+	}
+	d.group++
+	for _, c := range chunks {
+		if err := d.emit(c); err != nil {
+			return err
+		}
+	}
+	d.skip(d.ec.ParityChunks * g.parity)
+	return nil
+}
@@ -0,0 +1,278 @@
+package gcm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestErrorCorrection(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	sizes := []int{0, 100, chunkSize, 2*chunkSize + 5, 3*chunkSize + 10, 6 * chunkSize}
+	for _, ec := range []ErrorCorrection{{DataChunks: 1, ParityChunks: 1}, {DataChunks: 2, ParityChunks: 1}, {DataChunks: 3, ParityChunks: 2}} {
+		for _, size := range sizes {
+			plainText := make([]byte, size)
+			for i := range plainText {
+				plainText[i] = byte(i % 253)
+			}
+			opts := &Options{ErrorCorrection: ec}
+			cipherText := encryptBytes(t, plainText, key, iv, opts)
+			expected, err := CiphertextSize(int64(size), opts)
+			if err != nil {
+				t.Fatalf("CiphertextSize failed: %s", err)
+			}
+			if int64(len(cipherText)) != expected {
+				t.Errorf("Failed for %+v and %d bytes. Expected %d bytes of ciphertext, got %d", ec, size, expected, len(cipherText))
+			}
+			decrypted, err := decryptSigned(cipherText, key, iv, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed for %+v and %d bytes: %s", ec, size, err)
+			}
+			if !bytes.Equal(decrypted, plainText) {
+				t.Errorf("Failed for %+v and %d bytes. Decrypted text differs", ec, size)
+			}
+		}
+	}
+}
+
+func TestErrorCorrectionRepair(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	ec := ErrorCorrection{DataChunks: 3, ParityChunks: 2}
+	full := chunkSize + tagSize
+	group := ec.fullGroupSize()
+	plainText := make([]byte, 7*chunkSize+100)
+	for i := range plainText {
+		plainText[i] = byte(i % 251)
+	}
+	opts := &Options{ErrorCorrection: ec, Metadata: &Metadata{Name: "x"}}
+	cipherText := encryptBytes(t, plainText, key, iv, opts)
+	overhead, _ := opts.overhead()
+	header := int(overhead)
+
+	// two chunks of the first group, a chunk and a parity shard of the
+	// second, and the final chunk
+	damaged := append([]byte{}, cipherText...)
+	for _, off := range []int{10, 2*full + 20, group + full + 30, group + 4*full + 40, 2*group + full + 50} {
+		damaged[header+off] ^= 0xff
+	}
+	decrypted, err := decryptSigned(damaged, key, iv, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if !bytes.Equal(decrypted, plainText) {
+		t.Errorf("Failed. Repaired text differs")
+	}
+
+	// pieces that split the groups are buffered until a group is complete
+	var out bytes.Buffer
+	w, err := NewDecryptWriteCloser(nopCloser{&out}, key, iv, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %s", err)
+	}
+	for off := 0; off < len(damaged); off += 100000 {
+		end := off + 100000
+		if end > len(damaged) {
+			end = len(damaged)
+		}
+		if _, err := w.Write(damaged[off:end]); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if !bytes.Equal(out.Bytes(), plainText) {
+		t.Errorf("Failed. Repaired text written in pieces differs")
+	}
+
+	// more damaged chunks than parity shards cannot be repaired
+	damaged = append([]byte{}, cipherText...)
+	for _, off := range []int{10, full + 20, 2*full + 30} {
+		damaged[header+off] ^= 0xff
+	}
+	if _, err := decryptSigned(damaged, key, iv, nil); err == nil || !strings.Contains(err.Error(), "damaged chunks") {
+		t.Errorf("Failed. Expected unrepairable damage to be reported, got %v", err)
+	}
+}
+
+func TestErrorCorrectionLastGroup(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	ec := ErrorCorrection{DataChunks: 3, ParityChunks: 2}
+	// the final chunk is alone in the last group
+	plainText := bytes.Repeat([]byte{7}, 3*chunkSize+10)
+	opts := &Options{ErrorCorrection: ec}
+	cipherText := encryptBytes(t, plainText, key, iv, opts)
+	overhead, _ := opts.overhead()
+	last := int(overhead) + ec.fullGroupSize()
+	if len(cipherText)-last != 3*(10+tagSize) {
+		t.Fatalf("Failed. Unexpected size %d of the last group", len(cipherText)-last)
+	}
+	damaged := append([]byte{}, cipherText...)
+	damaged[last+5] ^= 1
+	damaged[last+10+tagSize+5] ^= 1
+	decrypted, err := decryptSigned(damaged, key, iv, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if !bytes.Equal(decrypted, plainText) {
+		t.Errorf("Failed. Repaired text differs")
+	}
+
+	if _, err := decryptSigned(cipherText[:len(cipherText)-1], key, iv, nil); err == nil {
+		t.Errorf("Failed. Expected truncation to be detected")
+	}
+}
+
+func TestErrorCorrectionSigned(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	pub, priv, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	plainText := bytes.Repeat([]byte{1, 2, 3}, chunkSize)
+	opts := &Options{ErrorCorrection: ErrorCorrection{DataChunks: 2, ParityChunks: 1}, Merkle: true, SigningKey: priv}
+	cipherText := encryptBytes(t, plainText, key, iv, opts)
+	overhead, _ := opts.overhead()
+	h, _, _ := opts.header()
+	damaged := append([]byte{}, cipherText...)
+	damaged[int(overhead)-h.trailerSize()+100] ^= 1
+
+	decrypted, err := decryptSigned(damaged, key, iv, &Options{TrustedKeys: []ed25519.PublicKey{pub}})
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if !bytes.Equal(decrypted, plainText) {
+		t.Errorf("Failed. Repaired text differs")
+	}
+	if _, err := ReadMerkleTree(bytes.NewReader(cipherText)); err == nil {
+		t.Errorf("Failed. Expected Merkle trees of streams with error correction to be rejected")
+	}
+}
+
+func TestErrorCorrectionSalvage(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	ec := ErrorCorrection{DataChunks: 3, ParityChunks: 1}
+	full := chunkSize + tagSize
+	plainText := make([]byte, 5*chunkSize+100)
+	for i := range plainText {
+		plainText[i] = byte(i%251 + 1)
+	}
+	opts := &Options{ErrorCorrection: ec}
+	cipherText := encryptBytes(t, plainText, key, iv, opts)
+	overhead, _ := opts.overhead()
+	header := int(overhead)
+
+	// two chunks of the first group are lost, one of the second is repaired
+	damaged := append([]byte{}, cipherText...)
+	for _, off := range []int{10, full + 10, ec.fullGroupSize() + 10} {
+		damaged[header+off] ^= 1
+	}
+	var out bytes.Buffer
+	report, err := Salvage(&out, bytes.NewReader(damaged), int64(len(damaged)), key, iv, nil, false)
+	if err != nil {
+		t.Fatalf("Salvage failed: %s", err)
+	}
+	if report.Chunks != 6 || report.Repaired != 1 || len(report.Damaged) != 2 || report.Truncated {
+		t.Fatalf("Failed. Unexpected report %+v", report)
+	}
+	if d := report.Damaged[1]; d.Index != 1 || d.Offset != int64(header+full) || d.OutputOffset != chunkSize {
+		t.Errorf("Failed. Unexpected damaged chunk %+v", d)
+	}
+	expected := append([]byte{}, plainText...)
+	copy(expected[:2*chunkSize], make([]byte, 2*chunkSize))
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("Failed. Salvaged plaintext differs")
+	}
+
+	// the chunks of a truncated last group are still salvaged
+	cut := cipherText[:header+ec.fullGroupSize()+2*full]
+	out.Reset()
+	report, err = Salvage(&out, bytes.NewReader(cut), int64(len(cut)), key, iv, nil, false)
+	if err != nil {
+		t.Fatalf("Salvage failed: %s", err)
+	}
+	if !report.Truncated || !bytes.Equal(out.Bytes()[:5*chunkSize], plainText[:5*chunkSize]) {
+		t.Errorf("Failed. Expected the truncated stream to be salvaged")
+	}
+
+	if _, err := PlaintextSize(int64(len(cipherText)), opts); err == nil {
+		t.Errorf("Failed. Expected PlaintextSize to reject error correction")
+	}
+	if _, err := CiphertextSize(10, &Options{ErrorCorrection: ErrorCorrection{DataChunks: 255, ParityChunks: 2}}); err == nil {
+		t.Errorf("Failed. Expected invalid error correction to be rejected")
+	}
+}
+
+func TestErrorCorrectionAttempts(t *testing.T) {
+	if err := (ErrorCorrection{DataChunks: 4, ParityChunks: maxParityChunks + 1}).validate(); err == nil {
+		t.Errorf("Failed. Expected more than %d parity chunks to be rejected", maxParityChunks)
+	}
+
+	// subsets are enumerated in lexicographic order
+	c := []int{0, 1}
+	var subsets [][2]int
+	for ok := true; ok; ok = nextCombination(c, 4) {
+		subsets = append(subsets, [2]int{c[0], c[1]})
+	}
+	if len(subsets) != 6 || subsets[1] != [2]int{0, 2} || subsets[5] != [2]int{2, 3} {
+		t.Errorf("Failed. Unexpected subsets %v", subsets)
+	}
+
+	ec := ErrorCorrection{DataChunks: 16, ParityChunks: 16}
+	original := make([][]byte, ec.DataChunks)
+	enc := newFECEncoder(ec)
+	var shards []byte
+	for i := range original {
+		original[i] = bytes.Repeat([]byte{byte(i + 1)}, 64)
+		shards = enc.add(shards, original[i], false)
+	}
+	group := func() ([][]byte, [][]byte) {
+		chunks := make([][]byte, len(original))
+		for i := range chunks {
+			chunks[i] = append([]byte{}, original[i]...)
+		}
+		parity := make([][]byte, ec.ParityChunks)
+		for i := range parity {
+			parity[i] = append([]byte{}, shards[i*64:(i+1)*64]...)
+		}
+		return chunks, parity
+	}
+	attempts := 0
+	valid := func(i int, chunk []byte) bool {
+		attempts++
+		return bytes.Equal(chunk, original[i])
+	}
+
+	// the first shards are damaged, so later sets repair the chunk
+	chunks, parity := group()
+	chunks[5][0] ^= 1
+	for i := 0; i < 3; i++ {
+		parity[i][0] ^= 1
+	}
+	if repaired, bad := ec.repair(chunks, parity, valid); repaired != 1 || len(bad) != 0 || !bytes.Equal(chunks[5], original[5]) {
+		t.Errorf("Failed. Expected the chunk to be repaired, got %d repaired and %v bad", repaired, bad)
+	}
+
+	// with every shard damaged, repair gives up after maxRepairAttempts
+	// sets instead of trying all 12870
+	chunks, parity = group()
+	for i := 0; i < 8; i++ {
+		chunks[i][0] ^= 1
+	}
+	for i := range parity {
+		parity[i][1] ^= 1
+	}
+	attempts = 0
+	if repaired, bad := ec.repair(chunks, parity, valid); repaired != 0 || len(bad) != 8 {
+		t.Errorf("Failed. Expected no repair, got %d repaired and %v bad", repaired, bad)
+	}
+	if expected := len(chunks) + maxRepairAttempts; attempts != expected {
+		t.Errorf("Failed. Expected %d checks, got %d", expected, attempts)
+	}
+}
@@ -0,0 +1,236 @@
+package gcm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sync"
+)
+
+// FS is a read-only fs.FS over a directory encrypted by EncryptDir, such as
+// os.DirFS of the output directory. Files are decrypted as they are read and
+// support Seek and ReadAt, so an FS can be served with http.FileServer or
+// parsed with template.ParseFS. Only the entries of the authenticated
+// manifest are visible, and each file must be the one recorded there, at the
+// same path and of the same size. The manifest itself is hidden.
+//
+// Files are read at random with a DecryptReaderAt, so every chunk read is
+// authenticated, but files encrypted with compression, padding or error
+// correction cannot be opened.
+type FS struct {
+	fsys fs.FS
+	key  []byte
+	aad  []byte
+
+	once    sync.Once
+	entries map[string]ManifestEntry
+	err     error
+}
+
+// NewFS creates an FS that decrypts the files of fsys with the master key
+// and AAD they were encrypted with.
+func NewFS(fsys fs.FS, key, aad []byte) *FS {
+	return &FS{fsys: fsys, key: key, aad: aad}
+}
+
+// Open opens the named file. Directories are listed with the plaintext sizes
+// of their files.
+func (f *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == ManifestName {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	entries, err := f.manifest()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	entry, listed := entries[name]
+	if !listed && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() != (name == "." || entry.Mode.IsDir()) {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("The entry does not match the manifest")}
+	}
+	if info.IsDir() {
+		return &fsDir{File: file, fs: f, dir: name}, nil
+	}
+	r, err := f.decrypt(file, info, entry)
+	if err != nil {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{
+		File:          file,
+		info:          fsFileInfo{FileInfo: info, size: r.Size()},
+		SectionReader: io.NewSectionReader(r, 0, r.Size()),
+	}, nil
+}
+
+// manifest returns the entries of the authenticated manifest by path.
+func (f *FS) manifest() (map[string]ManifestEntry, error) {
+	f.once.Do(func() {
+		file, err := f.fsys.Open(ManifestName)
+		if err != nil {
+			f.err = err
+			return
+		}
+		defer file.Close()
+		manifest, err := readManifest(file, f.key, f.aad)
+		if err != nil {
+			f.err = err
+			return
+		}
+		f.entries = make(map[string]ManifestEntry, len(manifest.Entries))
+		for _, entry := range manifest.Entries {
+			f.entries[path.Clean(entry.Path)] = entry
+		}
+	})
+	return f.entries, f.err
+}
+
+// decrypt returns a DecryptReaderAt over an encrypted file, reading all of
+// it into memory if it cannot be read at random.
+func (f *FS) decrypt(file fs.File, info fs.FileInfo, entry ManifestEntry) (*DecryptReaderAt, error) {
+	src, ok := file.(io.ReaderAt)
+	if !ok {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		src = bytesReaderAt(data)
+	}
+	size := info.Size() - saltSize
+	if size < 0 {
+		return nil, errors.New("The file is too short")
+	}
+	salt := make([]byte, saltSize)
+	if _, err := src.ReadAt(salt, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(salt, entry.Salt) {
+		return nil, errors.New("The file is not the one listed in the manifest")
+	}
+	key, iv, err := deriveKeyIV(f.key, salt, dirFileKeyInfo(entry.Path))
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewDecryptReaderAt(io.NewSectionReader(src, saltSize, size), size, key, iv, f.aad)
+	if err != nil {
+		return nil, err
+	}
+	if r.Size() != entry.Size {
+		return nil, errors.New("The file does not have the size listed in the manifest")
+	}
+	return r, nil
+}
+
+// stat returns the info of the named file with its plaintext size.
+func (f *FS) stat(name string) (fs.FileInfo, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+type bytesReaderAt []byte
+
+func (b bytesReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fsFile is a decrypting file of an FS.
+type fsFile struct {
+	fs.File
+	info fsFileInfo
+	*io.SectionReader
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	return f.SectionReader.Read(p)
+}
+
+// fsFileInfo reports the plaintext size of a file.
+type fsFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i fsFileInfo) Size() int64 {
+	return i.size
+}
+
+// fsDir is a directory of an FS, which lists only the entries of the
+// manifest.
+type fsDir struct {
+	fs.File
+	fs  *FS
+	dir string
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.dir, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rd, ok := d.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: d.dir, Err: errors.New("not implemented")}
+	}
+	var out []fs.DirEntry
+	for {
+		entries, err := rd.ReadDir(n)
+		for _, entry := range entries {
+			name := path.Join(d.dir, entry.Name())
+			if _, listed := d.fs.entries[name]; !listed {
+				continue
+			}
+			out = append(out, fsDirEntry{DirEntry: entry, fs: d.fs, name: name})
+		}
+		// a batch made up of only unlisted entries must not look like the end
+		if err != nil || n <= 0 || len(out) > 0 {
+			return out, err
+		}
+	}
+}
+
+// fsDirEntry reports the plaintext size of a file in its info.
+type fsDirEntry struct {
+	fs.DirEntry
+	fs   *FS
+	name string
+}
+
+func (e fsDirEntry) Info() (fs.FileInfo, error) {
+	if e.IsDir() {
+		return e.DirEntry.Info()
+	}
+	return e.fs.stat(e.name)
+}
@@ -0,0 +1,106 @@
+package gcm
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-fs")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	inDir := filepath.Join(tmp, "in")
+	encDir := filepath.Join(tmp, "enc")
+	large := make([]byte, 2*chunkSize+12345)
+	for i := range large {
+		large[i] = byte(i % 241)
+	}
+	files := map[string][]byte{
+		"index.html":  []byte("<p>hello</p>"),
+		"empty":       {},
+		"sub/big.bin": large,
+		// only the manifest at the root is hidden
+		"sub/" + ManifestName: []byte("not the manifest"),
+	}
+	for name, data := range files {
+		p := filepath.Join(inDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatalf("Failed to write file: %s", err)
+		}
+	}
+	if _, err := EncryptDir(inDir, encDir, key, nil, &Options{Metadata: &Metadata{Name: "x"}, KeyCommitment: true}); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+
+	fsys := NewFS(os.DirFS(encDir), key, nil)
+	if err := fstest.TestFS(fsys, "index.html", "empty", "sub/big.bin", "sub/"+ManifestName); err != nil {
+		t.Fatalf("TestFS failed: %s", err)
+	}
+	for name, data := range files {
+		read, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("Failed for %s. Decrypted text differs", name)
+		}
+	}
+	if _, err := fsys.Open(ManifestName); err == nil {
+		t.Errorf("Failed. Expected the manifest to be hidden")
+	}
+
+	// ranges are served by seeking
+	server := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/sub/big.bin", nil)
+	req.Header.Set("Range", "bytes=1048570-1048590")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, large[1048570:1048591]) {
+		t.Errorf("Failed. Unexpected range response %d %q", resp.StatusCode, body)
+	}
+
+	// a damaged chunk fails when it is read, not before
+	p := filepath.Join(encDir, "sub", "big.bin")
+	damaged, _ := ioutil.ReadFile(p)
+	damaged[len(damaged)-100] ^= 1
+	if err := ioutil.WriteFile(p, damaged, 0644); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+	f, err := fsys.Open("sub/big.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer f.Close()
+	buf := make([]byte, 100)
+	if _, err := f.(interface {
+		ReadAt([]byte, int64) (int, error)
+	}).ReadAt(buf, 10); err != nil {
+		t.Errorf("Failed. ReadAt of an intact chunk failed: %s", err)
+	}
+	if _, err := ioutil.ReadAll(f); err == nil {
+		t.Errorf("Failed. Expected the damaged chunk to fail")
+	}
+
+	if _, err := NewFS(os.DirFS(encDir), make([]byte, 16), nil).Open("index.html"); err == nil {
+		t.Errorf("Failed. Expected a wrong key to be detected")
+	}
+}
@@ -3,9 +3,18 @@ package gcm
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
 const (
@@ -17,11 +26,13 @@ const (
 
 // EncryptFile encrypts the file at the specified path using GCM.
 func EncryptFile(inFilePath, outFilePath string, key, iv, aad []byte) error {
-	if _, err := os.Stat(inFilePath); os.IsNotExist(err) {
-		return fmt.Errorf("A file does not exist at %s", inFilePath)
-	}
+	return EncryptFileWithOptions(inFilePath, outFilePath, key, iv, aad, nil)
+}
 
-	inFile, err := os.Open(inFilePath)
+// EncryptFileWithOptions encrypts the file at the specified path using GCM
+// and the given options. The options may be nil.
+func EncryptFileWithOptions(inFilePath, outFilePath string, key, iv, aad []byte, opts *Options) error {
+	inFile, r, err := openEncryptReader(inFilePath, key, iv, aad, opts)
 	if err != nil {
 		return err
 	}
@@ -33,20 +44,75 @@ func EncryptFile(inFilePath, outFilePath string, key, iv, aad []byte) error {
 	}
 	defer outFile.Close()
 
-	r, err := NewEncryptReader(inFile, key, iv, aad)
-	if err != nil {
+	if !opts.armored() {
+		_, err = io.Copy(outFile, r)
+		return err
+	}
+	w := NewArmorWriter(outFile)
+	if _, err := io.Copy(w, r); err != nil {
 		return err
 	}
+	return w.Close()
+}
 
-	_, err = io.Copy(outFile, r)
-	return err
+// fileOptions returns a copy of the options with the size of the file at
+// inFilePath and any unset metadata filled in. Filling in options it has
+// returned changes nothing, as long as the file is unchanged.
+func fileOptions(inFilePath string, opts *Options) (*Options, error) {
+	info, err := os.Stat(inFilePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("A file does not exist at %s", inFilePath)
+	}
+	if err != nil {
+		// opening the file reports the error
+		return opts, nil
+	}
+	opts = opts.withSize(info.Size())
+	if opts.Metadata != nil {
+		if opts.Metadata, err = fileMetadata(opts.Metadata, inFilePath, info); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// openEncryptReader opens the file at inFilePath and returns it along with
+// an EncryptReader over it, filling in the size and metadata of the file.
+func openEncryptReader(inFilePath string, key, iv, aad []byte, opts *Options) (*os.File, *EncryptReader, error) {
+	opts, err := fileOptions(inFilePath, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	inFile, err := os.Open(inFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := NewEncryptReaderWithOptions(inFile, key, iv, aad, opts)
+	if err != nil {
+		inFile.Close()
+		return nil, nil, err
+	}
+	return inFile, r, nil
 }
 
 // DecryptFile decrypts the file at the specified path using GCM.
 func DecryptFile(inFilePath, outFilePath string, key, iv, aad []byte) error {
-	if _, err := os.Stat(inFilePath); os.IsNotExist(err) {
+	return DecryptFileWithOptions(inFilePath, outFilePath, key, iv, aad, nil)
+}
+
+// DecryptFileWithOptions decrypts the file at the specified path using GCM
+// and the given options. The options may be nil. If outFilePath is an
+// existing directory, the file must carry metadata, and it is decrypted into
+// that directory under its original name with its mode and modification time
+// restored. Armored input is detected and decoded.
+func DecryptFileWithOptions(inFilePath, outFilePath string, key, iv, aad []byte, opts *Options) error {
+	info, err := os.Stat(inFilePath)
+	if os.IsNotExist(err) {
 		return fmt.Errorf("A file does not exist at %s", inFilePath)
 	}
+	if err == nil {
+		opts = opts.withSize(info.Size())
+	}
 
 	inFile, err := os.Open(inFilePath)
 	if err != nil {
@@ -54,20 +120,65 @@ func DecryptFile(inFilePath, outFilePath string, key, iv, aad []byte) error {
 	}
 	defer inFile.Close()
 
-	outFile, err := os.OpenFile(outFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	return decryptToPath(Dearmor(inFile), outFilePath, key, iv, aad, opts)
+}
+
+// decryptToPath decrypts src into the file or directory at outFilePath.
+func decryptToPath(src io.Reader, outFilePath string, key, iv, aad []byte, opts *Options) error {
+	if info, err := os.Stat(outFilePath); err == nil && info.IsDir() {
+		return decryptFileToDir(src, outFilePath, key, iv, aad, opts)
+	}
+
+	// the output is only created once the start of the stream has been
+	// authenticated, so a wrong key leaves any existing file untouched
+	outFile := &lazyFile{path: outFilePath}
+	defer outFile.abort()
+
+	w, err := NewDecryptWriteCloserWithOptions(outFile, key, iv, aad, opts)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
 
-	w, err := NewDecryptWriteCloser(outFile, key, iv, aad)
+	if _, err = io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// decryptFileToDir decrypts into a temporary file in dir, which is renamed to
+// the name in the stream metadata once the whole stream has authenticated.
+func decryptFileToDir(src io.Reader, dir string, key, iv, aad []byte, opts *Options) error {
+	tmpFile, err := ioutil.TempFile(dir, ".gcm-")
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+	defer tmpFile.Close()
 
-	_, err = io.Copy(w, inFile)
-	return err
+	w, err := NewDecryptWriteCloserWithOptions(tmpFile, key, iv, aad, opts)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	meta := w.Metadata()
+	if meta == nil {
+		return errors.New("The file has no metadata, so the output must be a file path")
+	}
+	name, err := meta.safeName()
+	if err != nil {
+		return err
+	}
+	outPath := filepath.Join(dir, name)
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		return err
+	}
+	return meta.restore(outPath)
 }
 
 // Wraps data from an io.Reader in an encrypted GCM data stream.
@@ -82,23 +193,47 @@ type EncryptReader struct {
 	sealed []byte
 	off    int
 
-	buff []byte
+	// buf is a pooled buffer in which each chunk is read and sealed in
+	// place. It is returned to the pool once the stream has been read.
+	buf []byte
+
+	// counter, if set, counts the bytes read from the original source when
+	// chunks are read from compressing or padding readers
+	counter  *countingReader
+	consumed int64
+
+	opts *Options
+
+	// leaves holds the Merkle leaf hashes of the chunks if the stream ends
+	// with a Merkle trailer
+	merkle bool
+	leaves [][]byte
+
+	fec *fecEncoder
+
+	// signer, if set, signs the digest of everything read from the reader
+	signer ed25519.PrivateKey
+	digest hash.Hash
+
+	progress progressTracker
 }
 
 func NewEncryptReader(src io.Reader, key, iv, aad []byte) (*EncryptReader, error) {
+	return NewEncryptReaderWithOptions(src, key, iv, aad, nil)
+}
+
+// NewEncryptReaderWithOptions creates an EncryptReader configured with the
+// given options. The options may be nil.
+func NewEncryptReaderWithOptions(src io.Reader, key, iv, aad []byte, opts *Options) (*EncryptReader, error) {
 	// copy the IV since it will be incremented
 	ivCopy := make([]byte, len(iv))
 	copy(ivCopy, iv)
 
-	aes, err := aes.NewCipher(key)
+	gcm, err := newGCM(key, len(iv))
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCMWithNonceSize(aes, len(iv))
-	if err != nil {
-		return nil, err
-	}
-	return &EncryptReader{
+	r := &EncryptReader{
 		src: src,
 
 		gcm: gcm,
@@ -107,8 +242,59 @@ func NewEncryptReader(src io.Reader, key, iv, aad []byte) (*EncryptReader, error
 
 		sealed: []byte{},
 
-		buff: make([]byte, chunkSize),
-	}, nil
+		progress: opts.progressTracker(),
+
+		opts: opts,
+	}
+	if opts.needsHeader() {
+		if err := r.writeHeader(key, opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.compressed() || opts.padded() {
+		r.counter = &countingReader{r: src}
+		r.src = r.counter
+	}
+	if opts.compressed() {
+		if r.src, err = newCompressReader(r.src, opts.Compression); err != nil {
+			return nil, err
+		}
+	}
+	if opts.padded() {
+		r.src = &padReader{src: r.src, padding: opts.Padding}
+	}
+	return r, nil
+}
+
+// writeHeader queues the stream header and any records that follow it to be
+// read before the first chunk, and adds the header to the AAD of every chunk.
+func (r *EncryptReader) writeHeader(key []byte, opts *Options) error {
+	h, meta, err := opts.header()
+	if err != nil {
+		return err
+	}
+	if opts.KeyCommitment {
+		if h.commitment, err = keyCommitment(key, r.iv); err != nil {
+			return err
+		}
+	}
+	hdr := h.marshal()
+	r.aad = append(append([]byte{}, r.aad...), hdr...)
+	r.merkle = h.merkle
+	if h.fec.enabled() {
+		r.fec = newFECEncoder(h.fec)
+	}
+	r.sealed = hdr
+	if meta != nil {
+		r.sealed = r.gcm.Seal(r.sealed, r.iv, meta, r.aad)
+		incrementIV(r.iv)
+	}
+	if opts.SigningKey != nil {
+		r.signer = opts.SigningKey
+		r.digest = newSignatureHash()
+		r.digest.Write(r.sealed)
+	}
+	return nil
 }
 
 func (r *EncryptReader) Read(p []byte) (int, error) {
@@ -118,6 +304,7 @@ func (r *EncryptReader) Read(p []byte) (int, error) {
 		// encrypt the next chunk if no data available
 		if r.off >= len(r.sealed) {
 			if r.eof {
+				r.release()
 				return off, io.EOF
 			}
 			if err := r.seal(); err != nil {
@@ -132,17 +319,26 @@ func (r *EncryptReader) Read(p []byte) (int, error) {
 	return off, nil
 }
 
+// CalculateTotalSize returns the size of the encrypted output for size bytes
+// of plaintext with the options of the reader, including any padding. It
+// returns 0 if the size cannot be calculated, such as for compressed data.
+//
+// Deprecated: Use CiphertextSize, which does not need a reader and supports
+// sizes larger than an int.
 func (r *EncryptReader) CalculateTotalSize(size int) int {
-	parts := size / chunkSize
-	if size%chunkSize > 0 {
-		parts++
+	total, err := CiphertextSize(int64(size), r.opts)
+	if err != nil {
+		return 0
 	}
-	return r.gcm.Overhead()*parts + size
+	return int(total)
 }
 
 func (r *EncryptReader) seal() error {
+	if r.buf == nil {
+		r.buf = getChunkBuffer()
+	}
 	// pull in the next chunk from the reader
-	n, err := io.ReadFull(r.src, r.buff)
+	n, err := io.ReadFull(r.src, r.buf[:chunkSize])
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		// mark EOF reached for subsequent seal attempts
 		r.eof = true
@@ -151,50 +347,196 @@ func (r *EncryptReader) seal() error {
 		return err
 	}
 	// encrypt this chunk
-	r.sealed = r.gcm.Seal(nil, r.iv, r.buff[:n], r.aad)
+	r.sealed = r.gcm.Seal(r.buf[:0], r.iv, r.buf[:n], r.aad)
 	incrementIV(r.iv)
 	r.off = 0
+	if r.merkle {
+		r.leaves = append(r.leaves, merkleLeaf(r.sealed))
+	}
+	if r.signer != nil {
+		r.digest.Write(r.sealed)
+	}
+	if r.fec != nil {
+		// parity is not signed, so repaired streams still verify
+		r.sealed = r.fec.add(r.sealed, r.sealed, r.eof)
+	}
+	if r.merkle && r.eof {
+		// append the root, authenticated with the next IV
+		root := merkleRoot(r.leaves)
+		trailer := r.gcm.Seal(append([]byte{}, root...), r.iv, nil, append(append([]byte{}, r.aad...), root...))
+		incrementIV(r.iv)
+		if r.signer != nil {
+			r.digest.Write(trailer)
+		}
+		r.sealed = append(r.sealed, trailer...)
+	}
+	if r.signer != nil && r.eof {
+		r.sealed = append(r.sealed, ed25519.Sign(r.signer, signatureMessage(r.digest))...)
+	}
+	if r.counter != nil {
+		n = int(r.counter.n - r.consumed)
+		r.consumed = r.counter.n
+	}
+	r.progress.chunk(n)
 	return nil
 }
 
+// release returns the chunk buffer to the pool.
+func (r *EncryptReader) release() {
+	if r.buf != nil {
+		putChunkBuffer(r.buf)
+		r.buf = nil
+		r.sealed = nil
+		r.off = 0
+	}
+}
+
+// errStreamClosed is returned by a DecryptWriteCloser once it is closed.
+var errStreamClosed = errors.New("The stream is already closed")
+
 // Unwraps an encrypted GCM data to the given io.Writer stream.
 type DecryptWriteCloser struct {
 	dst io.WriteCloser
+	key []byte
 
 	gcm cipher.AEAD
 	iv  []byte
 	aad []byte
 
+	// sealed is a pooled buffer in which each chunk is collected and opened
+	// in place. It is returned to the pool by Close, after which closed
+	// keeps it from being used.
 	sealed []byte
 	off    int
+	closed bool
+
+	// the optional header and the records that follow it are collected in
+	// prefix until prefixNeed bytes are available for the current stage
+	stage      int
+	prefix     []byte
+	prefixNeed int
+	header     *header
+	metadata   *Metadata
+
+	// final records whether the last chunk opened was shorter than a full
+	// chunk, which marks the end of a stream with a header
+	final bool
+	hash  hash.Hash
+
+	// trailer holds back the bytes that follow the final chunk, and leaves
+	// the Merkle leaf hashes of the chunks opened so far
+	trailerSize int
+	trailer     []byte
+	leaves      [][]byte
+
+	// fec repairs the chunks of streams with error correction, opening
+	// them into scratch to check them for damage
+	fec     *fecDecoder
+	scratch []byte
+
+	requireCommitment bool
+
+	// digest covers every byte before the signature of a signed stream
+	trusted []ed25519.PublicKey
+	digest  hash.Hash
+
+	// out receives the plaintext, passing it through decompressor and hash
+	// as configured by the header
+	out          io.Writer
+	decompressor *decompressWriter
+	stripper     *padStripper
+
+	progress progressTracker
 }
 
+// stages of reading the start of a stream
+const (
+	stageMagic = iota
+	stagePrefix
+	stageHeader
+	stageMetadata
+	stageChunks
+)
+
 func NewDecryptWriteCloser(dst io.WriteCloser, key, iv, aad []byte) (*DecryptWriteCloser, error) {
+	return NewDecryptWriteCloserWithOptions(dst, key, iv, aad, nil)
+}
+
+// NewDecryptWriteCloserWithOptions creates a DecryptWriteCloser configured
+// with the given options. The options may be nil.
+func NewDecryptWriteCloserWithOptions(dst io.WriteCloser, key, iv, aad []byte, opts *Options) (*DecryptWriteCloser, error) {
 	// copy the IV since it will be incremented
 	ivCopy := make([]byte, len(iv))
 	copy(ivCopy, iv)
 
-	aes, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCMWithNonceSize(aes, len(iv))
+	gcm, err := newGCM(key, len(iv))
 	if err != nil {
 		return nil, err
 	}
 
 	return &DecryptWriteCloser{
 		dst: dst,
+		key: key,
 
 		gcm: gcm,
 		iv:  ivCopy,
 		aad: aad,
 
-		sealed: make([]byte, chunkSize+gcm.Overhead()),
+		sealed: getChunkBuffer(),
+
+		stage:      stageMagic,
+		prefixNeed: len(headerMagic),
+
+		requireCommitment: opts.requiresCommitment(),
+		trusted:           opts.trustedKeys(),
+
+		progress: opts.progressTracker(),
 	}, nil
 }
 
+// Metadata returns the authenticated metadata of the stream, or nil if the
+// stream has none or it has not been read yet. The plaintext digest in the
+// metadata is only verified by Close.
+func (w *DecryptWriteCloser) Metadata() *Metadata {
+	return w.metadata
+}
+
 func (w *DecryptWriteCloser) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errStreamClosed
+	}
+	n := len(p)
+	if w.prefixing() {
+		read, err := w.readPrefix(p)
+		if err != nil {
+			return read, err
+		}
+		p = p[read:]
+	}
+	held := false
+	if w.trailerSize > 0 {
+		// only pass on the bytes that cannot be part of the trailer
+		p = w.holdTrailer(p)
+		held = true
+	}
+	if w.fec != nil {
+		// whole groups are passed on once repaired
+		if _, err := w.fec.Write(p); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	written, err := w.writeChunks(p)
+	if err != nil {
+		if held {
+			return 0, err
+		}
+		return n - len(p) + written, err
+	}
+	return n, nil
+}
+
+func (w *DecryptWriteCloser) writeChunks(p []byte) (int, error) {
 	n := len(p)
 	off := 0
 	for off < n {
@@ -212,28 +554,318 @@ func (w *DecryptWriteCloser) Write(p []byte) (int, error) {
 	return off, nil
 }
 
+// holdTrailer keeps the last trailerSize bytes seen so far in w.trailer, and
+// returns the bytes before them.
+func (w *DecryptWriteCloser) holdTrailer(p []byte) []byte {
+	if len(w.trailer)+len(p) <= w.trailerSize {
+		w.trailer = append(w.trailer, p...)
+		return nil
+	}
+	buf := append(w.trailer, p...)
+	cut := len(buf) - w.trailerSize
+	w.trailer = append([]byte{}, buf[cut:]...)
+	return buf[:cut]
+}
+
+// Close authenticates the end of the stream and closes dst. Close is final
+// whether or not it succeeds: later calls to Write and Close return an error.
 func (w *DecryptWriteCloser) Close() error {
+	if w.closed {
+		return errStreamClosed
+	}
+	w.closed = true
+	defer w.release()
+	if w.stage == stageMagic {
+		// too short for a header; treat it as a stream without one
+		if err := w.startChunks(w.prefix); err != nil {
+			return err
+		}
+	}
+	if w.prefixing() {
+		return errors.New("The stream header is truncated")
+	}
+	if w.fec != nil {
+		if err := w.fec.Close(); err != nil {
+			return err
+		}
+	}
 	if w.off > 0 {
 		if err := w.open(); err != nil {
 			return err
 		}
 	}
+	if w.header != nil && !w.final {
+		return errors.New("The stream is truncated")
+	}
+	if w.trailerSize > 0 && len(w.trailer) != w.trailerSize {
+		return errors.New("The stream is truncated")
+	}
+	if w.header != nil && w.header.merkle {
+		if err := w.verifyMerkleTrailer(); err != nil {
+			return err
+		}
+	}
+	if w.header != nil && w.header.signer != nil {
+		if err := w.verifySignature(); err != nil {
+			return err
+		}
+	}
+	if w.stripper != nil {
+		if err := w.stripper.Close(); err != nil {
+			return err
+		}
+	}
+	if w.decompressor != nil {
+		if err := w.decompressor.Close(); err != nil {
+			return err
+		}
+	}
+	if w.hash != nil && !hmac.Equal(w.hash.Sum(nil), w.metadata.SHA256) {
+		return errors.New("The plaintext digest does not match the metadata")
+	}
 	return w.dst.Close()
 }
 
+// release returns the chunk buffer to the pool.
+func (w *DecryptWriteCloser) release() {
+	if w.sealed != nil {
+		putChunkBuffer(w.sealed)
+		w.sealed = nil
+	}
+}
+
+// verifyMerkleTrailer checks the Merkle root in the trailer against the
+// chunks opened, and authenticates it.
+func (w *DecryptWriteCloser) verifyMerkleTrailer() error {
+	root := w.trailer[:merkleRootSize]
+	if !hmac.Equal(root, merkleRoot(w.leaves)) {
+		return errors.New("The Merkle root does not match the chunks")
+	}
+	_, err := w.gcm.Open(nil, w.iv, w.trailer[merkleRootSize:merkleTrailerSize], append(append([]byte{}, w.aad...), root...))
+	return err
+}
+
+// verifySignature checks the signature that ends a signed stream.
+func (w *DecryptWriteCloser) verifySignature() error {
+	sig := w.trailer[len(w.trailer)-ed25519.SignatureSize:]
+	w.digest.Write(w.trailer[:len(w.trailer)-ed25519.SignatureSize])
+	if !ed25519.Verify(w.header.signer, signatureMessage(w.digest), sig) {
+		return errors.New("Invalid signature")
+	}
+	return nil
+}
+
+// Signer returns the public key that signed the stream, or nil if the
+// stream is not signed. The signature is only verified by Close.
+func (w *DecryptWriteCloser) Signer() ed25519.PublicKey {
+	if w.header == nil || w.header.signer == nil {
+		return nil
+	}
+	return ed25519.PublicKey(w.header.signer)
+}
+
+func (w *DecryptWriteCloser) prefixing() bool {
+	return w.stage != stageChunks
+}
+
+// readPrefix consumes the optional header and the records that follow it,
+// returning the number of bytes of p used.
+func (w *DecryptWriteCloser) readPrefix(p []byte) (int, error) {
+	off := 0
+	for w.prefixing() {
+		need := w.prefixNeed - len(w.prefix)
+		if need > len(p)-off {
+			w.prefix = append(w.prefix, p[off:]...)
+			return len(p), nil
+		}
+		w.prefix = append(w.prefix, p[off:off+need]...)
+		off += need
+		if err := w.advancePrefix(); err != nil {
+			return off, err
+		}
+	}
+	return off, nil
+}
+
+// advancePrefix processes the complete prefix of the current stage.
+func (w *DecryptWriteCloser) advancePrefix() error {
+	switch w.stage {
+	case stageMagic:
+		if !hasHeaderMagic(w.prefix) {
+			return w.startChunks(w.prefix)
+		}
+		w.stage = stagePrefix
+		w.prefixNeed = headerPrefixSize
+	case stagePrefix:
+		size, err := headerSizeFromPrefix(w.prefix)
+		if err != nil {
+			return err
+		}
+		w.stage = stageHeader
+		w.prefixNeed = size
+		if size == len(w.prefix) {
+			return w.advancePrefix()
+		}
+	case stageHeader:
+		h, err := parseHeader(w.prefix)
+		if err != nil {
+			return err
+		}
+		if h.commitment == nil && w.requireCommitment {
+			return ErrNoKeyCommitment
+		}
+		if h.commitment != nil {
+			commitment, err := keyCommitment(w.key, w.iv)
+			if err != nil {
+				return err
+			}
+			if !hmac.Equal(commitment, h.commitment) {
+				return ErrWrongKey
+			}
+		}
+		if h.signer != nil {
+			if err := checkSigner(h.signer, w.trusted); err != nil {
+				return err
+			}
+			w.digest = newSignatureHash()
+			w.digest.Write(w.prefix)
+		}
+		w.header = h
+		w.trailerSize = h.trailerSize()
+		w.aad = append(append([]byte{}, w.aad...), w.prefix...)
+		w.progress.skip(len(w.prefix))
+		w.prefix = w.prefix[:0]
+		if h.metadataSize == 0 {
+			return w.startChunks(nil)
+		}
+		w.stage = stageMetadata
+		w.prefixNeed = int(h.metadataSize)
+	case stageMetadata:
+		opened, err := w.gcm.Open(nil, w.iv, w.prefix, w.aad)
+		if err != nil {
+			return err
+		}
+		if w.digest != nil {
+			w.digest.Write(w.prefix)
+		}
+		incrementIV(w.iv)
+		meta := &Metadata{}
+		if err := json.Unmarshal(opened, meta); err != nil {
+			return err
+		}
+		w.metadata = meta
+		if len(meta.SHA256) > 0 {
+			w.hash = sha256.New()
+		}
+		w.progress.skip(len(w.prefix))
+		return w.startChunks(nil)
+	}
+	return nil
+}
+
+// startChunks ends the prefix stages, queueing any bytes already read as the
+// start of the first chunk.
+func (w *DecryptWriteCloser) startChunks(buffered []byte) error {
+	if w.requireCommitment && w.header == nil {
+		return ErrNoKeyCommitment
+	}
+	if len(w.trusted) > 0 && w.digest == nil {
+		return ErrNotSigned
+	}
+	w.off = copy(w.sealed, buffered)
+	w.stage = stageChunks
+	w.prefix = nil
+
+	w.out = w.dst
+	if w.hash != nil {
+		w.out = io.MultiWriter(w.dst, w.hash)
+	}
+	if w.header != nil && w.header.compression != CompressionNone {
+		d, err := newDecompressWriter(w.out, w.header.compression)
+		if err != nil {
+			return err
+		}
+		w.decompressor = d
+		w.out = d
+	}
+	if w.header != nil && w.header.padding.enabled() {
+		w.stripper = &padStripper{dst: w.out, padding: w.header.padding}
+		w.out = w.stripper
+	}
+	if w.header != nil && w.header.fec.enabled() {
+		w.fec = &fecDecoder{
+			ec:    w.header.fec,
+			valid: w.validChunk,
+			emit: func(chunk []byte) error {
+				_, err := w.writeChunks(chunk)
+				return err
+			},
+			skip: w.progress.skip,
+		}
+	}
+	return nil
+}
+
+// validChunk reports whether the i-th chunk after the next one to be opened
+// authenticates.
+func (w *DecryptWriteCloser) validChunk(i int, chunk []byte) bool {
+	if w.scratch == nil {
+		w.scratch = make([]byte, 0, chunkSize)
+	}
+	_, err := w.gcm.Open(w.scratch[:0], advanceIV(w.iv, i), chunk, w.aad)
+	return err == nil
+}
+
 func (w *DecryptWriteCloser) open() error {
-	opened, err := w.gcm.Open(nil, w.iv, w.sealed[:w.off], w.aad)
+	// the ciphertext is hashed first, since it is overwritten when opened
+	if w.header != nil && w.header.merkle {
+		w.leaves = append(w.leaves, merkleLeaf(w.sealed[:w.off]))
+	}
+	if w.digest != nil {
+		w.digest.Write(w.sealed[:w.off])
+	}
+	opened, err := w.gcm.Open(w.sealed[:0], w.iv, w.sealed[:w.off], w.aad)
 	if err != nil {
 		return err
 	}
-	if _, err := w.dst.Write(opened); err != nil {
+	if _, err := w.out.Write(opened); err != nil {
 		return err
 	}
 	incrementIV(w.iv)
+	w.final = w.off < cap(w.sealed)
+	w.progress.chunk(w.off)
 	w.off = 0
 	return nil
 }
 
+// newGCM returns AES-GCM for the key, which selects AES-128, AES-192 or
+// AES-256 by its size, with nonces of ivSize bytes.
+func newGCM(key []byte, ivSize int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, ivSize)
+}
+
+// chunkPool holds buffers for a sealed chunk, shared by all streams so that
+// sealing and opening chunks does not allocate.
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, chunkSize+tagSize)
+		return &b
+	},
+}
+
+func getChunkBuffer() []byte {
+	return *chunkPool.Get().(*[]byte)
+}
+
+func putChunkBuffer(b []byte) {
+	b = b[:cap(b)]
+	chunkPool.Put(&b)
+}
+
 func incrementIV(iv []byte) {
 	for i := len(iv) - 1; i >= 0; i-- {
 		iv[i]++
@@ -242,3 +874,15 @@ func incrementIV(iv []byte) {
 		}
 	}
 }
+
+// advanceIV returns a copy of iv incremented n times.
+func advanceIV(iv []byte, n int) []byte {
+	iv = append([]byte{}, iv...)
+	carry := uint64(n)
+	for i := len(iv) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(iv[i]) + carry&0xff
+		iv[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return iv
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -573,3 +574,133 @@ func TestGCM(t *testing.T) {
 		}
 	}
 }
+
+// zeroReader is an endless source of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestChunkAllocations(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	r, err := NewEncryptReader(zeroReader{}, key, iv, nil)
+	if err != nil {
+		t.Fatalf("NewEncryptReader failed: %s", err)
+	}
+	chunk := make([]byte, chunkSize+tagSize)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if allocs := testing.AllocsPerRun(5, func() {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+	}); allocs != 0 {
+		t.Errorf("Failed. Sealing a chunk made %.1f allocations", allocs)
+	}
+
+	// a second stream supplies the chunks in order, one for the warm-up
+	// run and five counted
+	r, err = NewEncryptReader(zeroReader{}, key, iv, nil)
+	if err != nil {
+		t.Fatalf("NewEncryptReader failed: %s", err)
+	}
+	sealed := make([][]byte, 7)
+	for i := range sealed {
+		sealed[i] = make([]byte, chunkSize+tagSize)
+		if _, err := io.ReadFull(r, sealed[i]); err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+	}
+	w, err := NewDecryptWriteCloser(nopCloser{ioutil.Discard}, key, iv, nil)
+	if err != nil {
+		t.Fatalf("NewDecryptWriteCloser failed: %s", err)
+	}
+	// the first chunk decides whether the stream has a header
+	if _, err := w.Write(sealed[0]); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	next := 1
+	if allocs := testing.AllocsPerRun(5, func() {
+		if _, err := w.Write(sealed[next]); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		next++
+	}); allocs != 0 {
+		t.Errorf("Failed. Opening a chunk made %.1f allocations", allocs)
+	}
+}
+
+// TestDecryptClosed checks that a closed DecryptWriteCloser, whose chunk
+// buffer is back in the pool, rejects further use.
+func TestDecryptClosed(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	cipherText := encryptBytes(t, []byte("hello"), key, iv, &Options{Metadata: &Metadata{}})
+	for _, truncated := range []bool{false, true} {
+		w, err := NewDecryptWriteCloser(nopCloser{ioutil.Discard}, key, iv, nil)
+		if err != nil {
+			t.Fatalf("NewDecryptWriteCloser failed: %s", err)
+		}
+		input := cipherText
+		if truncated {
+			input = cipherText[:len(cipherText)-1]
+		}
+		if _, err := w.Write(input); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		if err := w.Close(); (err != nil) != truncated {
+			t.Errorf("Truncated %t failed. Close returned %v", truncated, err)
+		}
+		if err := w.Close(); err != errStreamClosed {
+			t.Errorf("Truncated %t failed. Expected a second Close to fail, got %v", truncated, err)
+		}
+		if _, err := w.Write(cipherText); err != errStreamClosed {
+			t.Errorf("Truncated %t failed. Expected Write after Close to fail, got %v", truncated, err)
+		}
+	}
+}
+
+func BenchmarkEncryptReader(b *testing.B) {
+	r, err := NewEncryptReader(zeroReader{}, make([]byte, 32), make([]byte, 12), nil)
+	if err != nil {
+		b.Fatalf("NewEncryptReader failed: %s", err)
+	}
+	chunk := make([]byte, chunkSize+tagSize)
+	b.SetBytes(chunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		io.ReadFull(r, chunk)
+	}
+}
+
+func BenchmarkDecryptWriteCloser(b *testing.B) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	r, err := NewEncryptReader(zeroReader{}, key, iv, nil)
+	if err != nil {
+		b.Fatalf("NewEncryptReader failed: %s", err)
+	}
+	w, err := NewDecryptWriteCloser(nopCloser{ioutil.Discard}, key, iv, nil)
+	if err != nil {
+		b.Fatalf("NewDecryptWriteCloser failed: %s", err)
+	}
+	chunk := make([]byte, chunkSize+tagSize)
+	b.SetBytes(chunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		io.ReadFull(r, chunk)
+		b.StartTimer()
+		if _, err := w.Write(chunk); err != nil {
+			b.Fatalf("Write failed: %s", err)
+		}
+	}
+}
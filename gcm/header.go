@@ -0,0 +1,211 @@
+package gcm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Streams that use any feature beyond plain chunked encryption start with a
+// header, which is authenticated along with every record that follows it:
+//
+//	magic   [8]byte  headerMagic
+//	version uint8    headerVersion
+//	length  uint16   size of the fields that follow
+//	fields  ...      type uint8, size uint16, value [size]byte
+//
+// Streams without a header are the original format, so existing files and
+// test vectors decrypt unchanged. Unknown fields are rejected, since they may
+// change how the stream must be decrypted.
+
+var headerMagic = []byte("\x89GCM\r\n\x1a\n")
+
+const (
+	headerVersion = 1
+
+	// headerPrefixSize is the size of the magic, version and length.
+	headerPrefixSize = 8 + 1 + 2
+
+	// maxMetadataSize limits the sealed metadata record, whose size is read
+	// from the header before anything is authenticated.
+	maxMetadataSize = 64*1024 + tagSize
+)
+
+// header field types
+const (
+	// fieldMetadata holds the uint32 size of the sealed metadata record
+	// that follows the header.
+	fieldMetadata = 1
+	// fieldCompression holds the uint8 Compression of the plaintext.
+	fieldCompression = 2
+	// fieldPadding holds the uint8 PaddingScheme and uint64 bucket size.
+	fieldPadding = 3
+	// fieldCommitment holds the key commitment of the stream.
+	fieldCommitment = 4
+	// fieldMerkle marks a stream that ends with a Merkle tree trailer. It
+	// has no value.
+	fieldMerkle = 5
+	// fieldSigner holds the Ed25519 public key that signed the stream.
+	fieldSigner = 6
+	// fieldFEC holds the uint8 data and parity chunk counts of the
+	// ErrorCorrection of the stream.
+	fieldFEC = 7
+)
+
+// header holds the decoded header fields of a stream.
+type header struct {
+	metadataSize uint32
+	compression  Compression
+	padding      Padding
+	commitment   []byte
+	merkle       bool
+	signer       []byte
+	fec          ErrorCorrection
+}
+
+// trailerSize returns the number of bytes that follow the final chunk.
+func (h *header) trailerSize() int {
+	size := 0
+	if h.merkle {
+		size += merkleTrailerSize
+	}
+	if h.signer != nil {
+		size += ed25519.SignatureSize
+	}
+	return size
+}
+
+func (h *header) marshal() []byte {
+	var fields []byte
+	if h.metadataSize > 0 {
+		fields = appendField(fields, fieldMetadata, binary.BigEndian.AppendUint32(nil, h.metadataSize))
+	}
+	if h.compression != CompressionNone {
+		fields = appendField(fields, fieldCompression, []byte{byte(h.compression)})
+	}
+	if h.padding.enabled() {
+		value := binary.BigEndian.AppendUint64([]byte{byte(h.padding.Scheme)}, uint64(h.padding.BucketSize))
+		fields = appendField(fields, fieldPadding, value)
+	}
+	if h.commitment != nil {
+		fields = appendField(fields, fieldCommitment, h.commitment)
+	}
+	if h.merkle {
+		fields = appendField(fields, fieldMerkle, nil)
+	}
+	if h.signer != nil {
+		fields = appendField(fields, fieldSigner, h.signer)
+	}
+	if h.fec.enabled() {
+		fields = appendField(fields, fieldFEC, []byte{byte(h.fec.DataChunks), byte(h.fec.ParityChunks)})
+	}
+	b := make([]byte, 0, headerPrefixSize+len(fields))
+	b = append(b, headerMagic...)
+	b = append(b, headerVersion)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+	return append(b, fields...)
+}
+
+func appendField(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// hasHeaderMagic reports whether b starts with the header magic. b must hold
+// at least len(headerMagic) bytes.
+func hasHeaderMagic(b []byte) bool {
+	return bytes.Equal(b[:len(headerMagic)], headerMagic)
+}
+
+// headerSizeFromPrefix returns the total header size given its first
+// headerPrefixSize bytes.
+func headerSizeFromPrefix(prefix []byte) (int, error) {
+	if !hasHeaderMagic(prefix) {
+		return 0, errors.New("Missing header magic")
+	}
+	if version := prefix[len(headerMagic)]; version != headerVersion {
+		return 0, fmt.Errorf("Unsupported format version %d", version)
+	}
+	return headerPrefixSize + int(binary.BigEndian.Uint16(prefix[len(headerMagic)+1:])), nil
+}
+
+// parseHeader decodes a complete header.
+func parseHeader(b []byte) (*header, error) {
+	size, err := headerSizeFromPrefix(b)
+	if err != nil {
+		return nil, err
+	}
+	if size != len(b) {
+		return nil, errors.New("Invalid header size")
+	}
+	h := &header{}
+	fields := b[headerPrefixSize:]
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return nil, errors.New("Truncated header field")
+		}
+		typ := fields[0]
+		n := int(binary.BigEndian.Uint16(fields[1:]))
+		if len(fields) < 3+n {
+			return nil, errors.New("Truncated header field")
+		}
+		value := fields[3 : 3+n]
+		fields = fields[3+n:]
+		switch typ {
+		case fieldMetadata:
+			if n != 4 {
+				return nil, errors.New("Invalid metadata field")
+			}
+			h.metadataSize = binary.BigEndian.Uint32(value)
+			if h.metadataSize < tagSize || h.metadataSize > maxMetadataSize {
+				return nil, fmt.Errorf("Invalid metadata size %d", h.metadataSize)
+			}
+		case fieldCompression:
+			if n != 1 || !Compression(value[0]).valid() {
+				return nil, errors.New("Invalid compression field")
+			}
+			h.compression = Compression(value[0])
+		case fieldPadding:
+			if n != 9 {
+				return nil, errors.New("Invalid padding field")
+			}
+			h.padding = Padding{
+				Scheme:     PaddingScheme(value[0]),
+				BucketSize: int64(binary.BigEndian.Uint64(value[1:])),
+			}
+			if err := h.padding.validate(); err != nil {
+				return nil, err
+			}
+		case fieldCommitment:
+			if n != commitmentSize {
+				return nil, errors.New("Invalid commitment field")
+			}
+			h.commitment = value
+		case fieldMerkle:
+			if n != 0 {
+				return nil, errors.New("Invalid Merkle field")
+			}
+			h.merkle = true
+		case fieldSigner:
+			if n != ed25519.PublicKeySize {
+				return nil, errors.New("Invalid signer field")
+			}
+			// the header buffer is reused for the records that follow
+			h.signer = append([]byte{}, value...)
+		case fieldFEC:
+			if n != 2 {
+				return nil, errors.New("Invalid error correction field")
+			}
+			h.fec = ErrorCorrection{DataChunks: int(value[0]), ParityChunks: int(value[1])}
+			if err := h.fec.validate(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Unknown header field %d", typ)
+		}
+	}
+	return h, nil
+}
@@ -0,0 +1,362 @@
+package gcm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// An encrypted log is written in segments, one for each time the log is
+// opened for appending. A segment starts with a header
+//
+//	magic   [4]byte  "GCML"
+//	version uint8
+//	salt    [16]byte random
+//	first   uint64   sequence number of the first record of the segment
+//
+// followed by records
+//
+//	length  uint32   size of the sealed data
+//	sealed  [length]byte
+//
+// Each record holds the data of one write of at most a chunk, sealed with a
+// key and IV derived from the master key and the segment's salt, the IV
+// incremented for each record of the segment. The associated data ends with
+// the record's sequence number, which runs on across segments, so records
+// cannot be reordered or removed from the middle of a log.
+//
+// Because every segment has its own key, a record torn by a crash can be cut
+// off and the log continued without ever reusing an IV. A log has no end
+// marker, so records removed from its end cannot be detected.
+
+const (
+	logVersion    = 1
+	logHeaderSize = 4 + 1 + saltSize + 8
+	logMaxRecord  = chunkSize + tagSize
+	logInfo       = "gcm log"
+)
+
+var logMagic = []byte("GCML")
+
+// logSegment holds the cipher of a segment.
+type logSegment struct {
+	aead cipher.AEAD
+	iv   []byte
+	// next is the index within the segment of the next record
+	next int
+}
+
+func newLogSegment(key, salt []byte) (*logSegment, error) {
+	k, iv, err := deriveKeyIV(key, salt, logInfo)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(k, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	return &logSegment{aead: aead, iv: iv}, nil
+}
+
+func logAAD(aad []byte, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, aad...), seq)
+}
+
+// parseLogHeader returns the salt and first sequence number of a segment
+// header.
+func parseLogHeader(b []byte) ([]byte, uint64, error) {
+	if b[len(logMagic)] != logVersion {
+		return nil, 0, fmt.Errorf("Unsupported log version %d", b[len(logMagic)])
+	}
+	salt := b[len(logMagic)+1 : len(logMagic)+1+saltSize]
+	return salt, binary.BigEndian.Uint64(b[logHeaderSize-8:]), nil
+}
+
+// LogWriter appends records to an encrypted log file.
+type LogWriter struct {
+	f   *os.File
+	key []byte
+	aad []byte
+
+	seg *logSegment
+	seq uint64
+	err error
+
+	discarded int64
+}
+
+// OpenLog opens the encrypted log at path for appending, creating it if it
+// does not exist. The last records of an existing log are authenticated, and
+// a record torn by a crash is cut off. Every write is sealed as records of
+// at most a chunk.
+func OpenLog(path string, key, aad []byte) (*LogWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &LogWriter{f: f, key: key, aad: aad}
+	if err := w.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// logRecord locates a record found while scanning a log.
+type logRecord struct {
+	off   int64
+	size  int64
+	salt  []byte
+	index int
+	seq   uint64
+}
+
+// recover finds the end of the last intact record and the next sequence
+// number, and cuts off anything after it.
+func (w *LogWriter) recover() error {
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	var off, segOff int64
+	var salt []byte
+	var index int
+	var last []logRecord
+	segOff = -1
+	buf := make([]byte, logHeaderSize)
+	for off < size {
+		b := buf[:4]
+		if _, err := w.f.ReadAt(b, off); err != nil {
+			break
+		}
+		if bytes.Equal(b, logMagic) {
+			if _, err := w.f.ReadAt(buf, off); err != nil {
+				break
+			}
+			s, first, err := parseLogHeader(buf)
+			if err != nil {
+				return err
+			}
+			if first != w.seq {
+				return fmt.Errorf("The log is missing records %d to %d", w.seq, first-1)
+			}
+			salt = append([]byte{}, s...)
+			index = 0
+			segOff = off
+			off += logHeaderSize
+			continue
+		}
+		length := int64(binary.BigEndian.Uint32(b))
+		if length < tagSize || length > logMaxRecord || off+4+length > size {
+			break
+		}
+		if salt == nil {
+			return errors.New("The log does not start with a segment header")
+		}
+		last = append(last, logRecord{off: off, size: 4 + length, salt: salt, index: index, seq: w.seq})
+		if len(last) > 2 {
+			last = last[1:]
+		}
+		index++
+		w.seq++
+		off += 4 + length
+	}
+
+	// the last record may be torn even if it is complete, since a crash can
+	// leave a file extended with zeros
+	for i := len(last) - 1; i >= 0; i-- {
+		if w.authentic(last[i]) {
+			break
+		}
+		if i < len(last)-1 {
+			return fmt.Errorf("The log is damaged at offset %d", last[i].off)
+		}
+		off = last[i].off
+		w.seq--
+	}
+	if segOff >= 0 && off == segOff+logHeaderSize {
+		// a segment without records
+		off = segOff
+	}
+	if size-off > logHeaderSize+4+logMaxRecord {
+		return fmt.Errorf("The log is damaged at offset %d", off)
+	}
+	if off < size {
+		w.discarded = size - off
+		if err := w.f.Truncate(off); err != nil {
+			return err
+		}
+		if err := w.f.Sync(); err != nil {
+			return err
+		}
+	}
+	_, err = w.f.Seek(off, io.SeekStart)
+	return err
+}
+
+// authentic reports whether a record found while scanning opens.
+func (w *LogWriter) authentic(r logRecord) bool {
+	seg, err := newLogSegment(w.key, r.salt)
+	if err != nil {
+		return false
+	}
+	sealed := make([]byte, r.size-4)
+	if _, err := w.f.ReadAt(sealed, r.off+4); err != nil {
+		return false
+	}
+	_, err = seg.aead.Open(nil, advanceIV(seg.iv, r.index), sealed, logAAD(w.aad, r.seq))
+	return err == nil
+}
+
+// Discarded returns the number of bytes of a torn record that OpenLog cut
+// off the end of the log.
+func (w *LogWriter) Discarded() int64 {
+	return w.discarded
+}
+
+// Records returns the number of records in the log.
+func (w *LogWriter) Records() uint64 {
+	return w.seq
+}
+
+// Write seals p as records of at most a chunk and appends them to the log,
+// each with a single write. The first write after the log is opened also
+// starts a new segment. Once a write fails the log must be opened again.
+func (w *LogWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for n < len(p) {
+		end := n + chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := w.writeRecord(p[n:end]); err != nil {
+			w.err = err
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+func (w *LogWriter) writeRecord(p []byte) error {
+	var record []byte
+	if w.seg == nil {
+		salt, err := newSalt()
+		if err != nil {
+			return err
+		}
+		seg, err := newLogSegment(w.key, salt)
+		if err != nil {
+			return err
+		}
+		w.seg = seg
+		record = append(record, logMagic...)
+		record = append(record, logVersion)
+		record = append(record, salt...)
+		record = binary.BigEndian.AppendUint64(record, w.seq)
+	}
+	record = binary.BigEndian.AppendUint32(record, uint32(len(p)+tagSize))
+	record = w.seg.aead.Seal(record, advanceIV(w.seg.iv, w.seg.next), p, logAAD(w.aad, w.seq))
+	if _, err := w.f.Write(record); err != nil {
+		// the file may now end in a torn record, which the next OpenLog
+		// cuts off
+		return err
+	}
+	w.seg.next++
+	w.seq++
+	return nil
+}
+
+// Sync commits the records written so far to stable storage.
+func (w *LogWriter) Sync() error {
+	return w.f.Sync()
+}
+
+// Close closes the log file.
+func (w *LogWriter) Close() error {
+	return w.f.Close()
+}
+
+// LogReader reads the data of an encrypted log, authenticating every record.
+// It returns io.ErrUnexpectedEOF if the log ends in a torn record.
+type LogReader struct {
+	src *bufio.Reader
+	key []byte
+	aad []byte
+
+	seg     *logSegment
+	seq     uint64
+	pending []byte
+	err     error
+}
+
+// NewLogReader creates a LogReader over the log read from src.
+func NewLogReader(src io.Reader, key, aad []byte) *LogReader {
+	return &LogReader{src: bufio.NewReader(src), key: key, aad: aad}
+}
+
+func (r *LogReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pending, r.err = r.next()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// next reads the next record, and any segment header before it.
+func (r *LogReader) next() ([]byte, error) {
+	b := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r.src, b[:4]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b[:4], logMagic) {
+		if _, err := io.ReadFull(r.src, b[4:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		salt, first, err := parseLogHeader(b)
+		if err != nil {
+			return nil, err
+		}
+		if first != r.seq {
+			return nil, fmt.Errorf("The log is missing records %d to %d", r.seq, first-1)
+		}
+		if r.seg, err = newLogSegment(r.key, salt); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r.src, b[:4]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	if r.seg == nil {
+		return nil, errors.New("The log does not start with a segment header")
+	}
+	length := binary.BigEndian.Uint32(b[:4])
+	if length < tagSize || length > logMaxRecord {
+		return nil, fmt.Errorf("Invalid record size %d", length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	opened, err := r.seg.aead.Open(sealed[:0], advanceIV(r.seg.iv, r.seg.next), sealed, logAAD(r.aad, r.seq))
+	if err != nil {
+		return nil, fmt.Errorf("Record %d failed to authenticate", r.seq)
+	}
+	r.seg.next++
+	r.seq++
+	return opened, nil
+}
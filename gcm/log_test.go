@@ -0,0 +1,152 @@
+package gcm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readLog(t *testing.T, path string, key, aad []byte) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer f.Close()
+	return ioutil.ReadAll(NewLogReader(f, key, aad))
+}
+
+func appendLog(t *testing.T, path string, key, aad []byte, lines ...string) *LogWriter {
+	w, err := OpenLog(path, key, aad)
+	if err != nil {
+		t.Fatalf("OpenLog failed: %s", err)
+	}
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	return w
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcm-log")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	key := bytes.Repeat([]byte{4}, 32)
+	aad := []byte("audit")
+
+	appendLog(t, path, key, aad, "one\n", "two\n")
+	appendLog(t, path, key, aad)
+	big := bytes.Repeat([]byte{'x'}, chunkSize+10)
+	w := appendLog(t, path, key, aad, "three\n", string(big))
+	if w.Records() != 5 {
+		t.Errorf("Failed. Expected 5 records, got %d", w.Records())
+	}
+	read, err := readLog(t, path, key, aad)
+	if err != nil {
+		t.Fatalf("Failed reading the log: %s", err)
+	}
+	if want := "one\ntwo\nthree\n" + string(big); string(read) != want {
+		t.Errorf("Failed. Read %d bytes, expected %d", len(read), len(want))
+	}
+	if _, err := readLog(t, path, bytes.Repeat([]byte{5}, 32), aad); err == nil {
+		t.Errorf("Failed. Expected the wrong key to be rejected")
+	}
+	if _, err := OpenLog(path, key, []byte("other")); err == nil {
+		t.Errorf("Failed. Expected different AAD to be rejected on reopening")
+	}
+}
+
+func TestLogTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcm-log")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	key := make([]byte, 32)
+
+	appendLog(t, path, key, nil, "one\n", "two\n")
+	info, _ := os.Stat(path)
+	intact := info.Size()
+	appendLog(t, path, key, nil, "three\n")
+	f, _ := os.OpenFile(path, os.O_RDWR, 0)
+	f.Truncate(intact + logHeaderSize + 4 + 3)
+	f.Close()
+
+	if _, err := readLog(t, path, key, nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("Failed. Expected the torn record to be reported, got %v", err)
+	}
+	w := appendLog(t, path, key, nil, "four\n")
+	if w.Discarded() != logHeaderSize+4+3 {
+		t.Errorf("Failed. Expected the torn segment to be discarded, got %d bytes", w.Discarded())
+	}
+	if read, err := readLog(t, path, key, nil); err != nil || string(read) != "one\ntwo\nfour\n" {
+		t.Errorf("Failed. Unexpected log after recovery %q, %v", read, err)
+	}
+
+	// a complete record of zeros left by a crash
+	f, _ = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	f.Write(append([]byte{0, 0, 0, 30}, make([]byte, 30)...))
+	f.Close()
+	w = appendLog(t, path, key, nil, "five\n")
+	if w.Discarded() != 34 || w.Records() != 4 {
+		t.Errorf("Failed. Expected the zeroed record to be discarded, got %d bytes, %d records", w.Discarded(), w.Records())
+	}
+	if read, err := readLog(t, path, key, nil); err != nil || string(read) != "one\ntwo\nfour\nfive\n" {
+		t.Errorf("Failed. Unexpected log after recovery %q, %v", read, err)
+	}
+}
+
+func TestLogTampering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcm-log")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	key := make([]byte, 32)
+
+	appendLog(t, path, key, nil, "one\n")
+	info, _ := os.Stat(path)
+	first := info.Size()
+	appendLog(t, path, key, nil, "two\n")
+	info, _ = os.Stat(path)
+	second := info.Size()
+	appendLog(t, path, key, nil, "three\n", "four\n")
+	data, _ := ioutil.ReadFile(path)
+
+	// removing a whole segment from the middle
+	removed := append(append([]byte{}, data[:first]...), data[second:]...)
+	if _, err := ioutil.ReadAll(NewLogReader(bytes.NewReader(removed), key, nil)); err == nil {
+		t.Errorf("Failed. Expected a removed segment to be detected")
+	}
+	ioutil.WriteFile(path, removed, 0600)
+	if _, err := OpenLog(path, key, nil); err == nil {
+		t.Errorf("Failed. Expected OpenLog to reject a removed segment")
+	}
+
+	// changing a record before the last
+	changed := append([]byte{}, data...)
+	changed[second+logHeaderSize+5] ^= 1
+	if _, err := ioutil.ReadAll(NewLogReader(bytes.NewReader(changed), key, nil)); err == nil {
+		t.Errorf("Failed. Expected a changed record to be detected")
+	}
+
+	// OpenLog cuts off a last record that fails to authenticate as torn,
+	// but not the record before it
+	changed[len(changed)-5] ^= 1
+	ioutil.WriteFile(path, changed, 0600)
+	if _, err := OpenLog(path, key, nil); err == nil {
+		t.Errorf("Failed. Expected OpenLog to reject a changed record before the last")
+	}
+}
@@ -0,0 +1,222 @@
+package gcm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+)
+
+// Streams encrypted with the Merkle option end with a trailer holding the
+// root of a SHA-256 Merkle tree over the ciphertext chunks, followed by a tag
+// that authenticates the root under the stream key. The tree has the shape
+// and leaf and node hashing of RFC 6962, so inclusion proofs can be checked
+// by anyone who trusts the root, without the key.
+
+const (
+	merkleRootSize    = sha256.Size
+	merkleTrailerSize = merkleRootSize + tagSize
+)
+
+func merkleLeaf(chunk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleRoot returns the root hash of the tree over the given leaf hashes.
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return merkleNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// splitPoint returns the largest power of two smaller than n.
+func splitPoint(n int) int {
+	return 1 << uint(bits.Len(uint(n-1))-1)
+}
+
+func merklePath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(merklePath(index, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(index-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// MerkleTree holds the leaf hashes of the ciphertext chunks of an encrypted
+// stream, and produces inclusion proofs for them.
+type MerkleTree struct {
+	leaves [][]byte
+	root   []byte
+
+	// dataOffset is the offset of the first chunk in the stream.
+	dataOffset int64
+	// lastSize is the size of the final chunk.
+	lastSize int64
+}
+
+// ReadMerkleTree reads an encrypted stream created with the Merkle option,
+// and returns the tree over its chunks. No key is needed, so the root read
+// from the trailer is only checked for consistency with the chunks; it must
+// be obtained from a trusted source, or authenticated by decrypting the
+// stream, before proofs can be relied upon.
+func ReadMerkleTree(r io.Reader) (*MerkleTree, error) {
+	br := bufio.NewReaderSize(r, chunkSize+tagSize+merkleTrailerSize)
+	prefix, err := br.Peek(headerPrefixSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read stream header: %s", err)
+	}
+	size, err := headerSizeFromPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, size)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	h, err := parseHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	if !h.merkle {
+		return nil, errors.New("The stream has no Merkle tree")
+	}
+	if h.fec.enabled() {
+		// parity between the groups moves the chunks from their offsets
+		return nil, errors.New("Merkle trees of streams with error correction are not supported")
+	}
+	if _, err := br.Discard(int(h.metadataSize)); err != nil {
+		return nil, err
+	}
+
+	// the trailer may also hold a signature after the Merkle root and tag
+	trailer := h.trailerSize()
+	t := &MerkleTree{dataOffset: int64(size) + int64(h.metadataSize)}
+	buf := make([]byte, chunkSize+tagSize, chunkSize+tagSize+trailer+tagSize)
+	for {
+		n, err := io.ReadFull(br, buf[:chunkSize+tagSize])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		data := buf[:n]
+		if err == nil {
+			// a full read is only a chunk if at least the trailer and a
+			// final chunk follow it
+			if next, _ := br.Peek(tagSize + trailer); len(next) == tagSize+trailer {
+				t.leaves = append(t.leaves, merkleLeaf(data))
+				continue
+			}
+			rest, err := ioutil.ReadAll(br)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, rest...)
+		}
+		if len(data) < tagSize+trailer {
+			return nil, errors.New("The stream is truncated")
+		}
+		last := len(data) - trailer
+		t.leaves = append(t.leaves, merkleLeaf(data[:last]))
+		t.lastSize = int64(last)
+		t.root = merkleRoot(t.leaves)
+		if !bytes.Equal(t.root, data[last:last+merkleRootSize]) {
+			return nil, errors.New("The Merkle root does not match the chunks")
+		}
+		return t, nil
+	}
+}
+
+// Root returns the root hash of the tree.
+func (t *MerkleTree) Root() []byte {
+	return t.root
+}
+
+// Len returns the number of chunks in the tree.
+func (t *MerkleTree) Len() int {
+	return len(t.leaves)
+}
+
+// Proof returns the inclusion proof for the chunk at the given index.
+func (t *MerkleTree) Proof(index int) ([][]byte, error) {
+	if index < 0 || index >= len(t.leaves) {
+		return nil, fmt.Errorf("Chunk index %d out of range", index)
+	}
+	return merklePath(index, t.leaves), nil
+}
+
+// Chunk reads the ciphertext of the chunk at the given index from the
+// stream, so it can be passed to VerifyChunkProof.
+func (t *MerkleTree) Chunk(r io.ReaderAt, index int) ([]byte, error) {
+	if index < 0 || index >= len(t.leaves) {
+		return nil, fmt.Errorf("Chunk index %d out of range", index)
+	}
+	size := int64(chunkSize + tagSize)
+	if index == len(t.leaves)-1 {
+		size = t.lastSize
+	}
+	chunk := make([]byte, size)
+	off := t.dataOffset + int64(index)*(chunkSize+tagSize)
+	if _, err := r.ReadAt(chunk, off); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// ChunkRange returns the indexes of the first and last chunks that hold the
+// given range of plaintext bytes of a stream without compression or padding.
+func ChunkRange(offset, length int64) (int, int) {
+	if length <= 0 {
+		length = 1
+	}
+	return int(offset / chunkSize), int((offset + length - 1) / chunkSize)
+}
+
+// VerifyChunkProof reports whether the ciphertext chunk at index is part of
+// a stream of count chunks with the given Merkle root.
+func VerifyChunkProof(root []byte, index, count int, chunk []byte, proof [][]byte) bool {
+	if index < 0 || index >= count {
+		return false
+	}
+	fn, sn := index, count-1
+	r := merkleLeaf(chunk)
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNode(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNode(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
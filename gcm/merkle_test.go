@@ -0,0 +1,105 @@
+package gcm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMerkle(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	for _, size := range []int{0, 100, chunkSize, 4*chunkSize + 17} {
+		plainText := bytes.Repeat([]byte{7}, size)
+		opts := &Options{Merkle: true, Metadata: &Metadata{Name: "x"}}
+		r, err := NewEncryptReaderWithOptions(bytes.NewReader(plainText), key, iv, nil, opts)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %s", err)
+		}
+		cipherText, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Size %d encryption failed: %s", size, err)
+		}
+		if expected, _ := CiphertextSize(int64(size), opts); expected != int64(len(cipherText)) {
+			t.Errorf("Size %d failed. CiphertextSize %d != %d", size, expected, len(cipherText))
+		}
+
+		var out bytes.Buffer
+		w, err := NewDecryptWriteCloser(nopCloser{&out}, key, iv, nil)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %s", err)
+		}
+		if _, err := w.Write(cipherText); err != nil {
+			t.Fatalf("Size %d decryption failed: %s", size, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Size %d decryption failed: %s", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plainText) {
+			t.Errorf("Size %d failed. Plaintext differs", size)
+		}
+
+		tree, err := ReadMerkleTree(bytes.NewReader(cipherText))
+		if err != nil {
+			t.Fatalf("Size %d failed to read tree: %s", size, err)
+		}
+		if tree.Len() != size/chunkSize+1 {
+			t.Errorf("Size %d failed. Expected %d chunks, got %d", size, size/chunkSize+1, tree.Len())
+		}
+		for i := 0; i < tree.Len(); i++ {
+			chunk, err := tree.Chunk(bytes.NewReader(cipherText), i)
+			if err != nil {
+				t.Fatalf("Size %d failed to read chunk %d: %s", size, i, err)
+			}
+			proof, err := tree.Proof(i)
+			if err != nil {
+				t.Fatalf("Size %d failed to create proof %d: %s", size, i, err)
+			}
+			if !VerifyChunkProof(tree.Root(), i, tree.Len(), chunk, proof) {
+				t.Errorf("Size %d failed. Proof for chunk %d did not verify", size, i)
+			}
+			chunk[0] ^= 1
+			if VerifyChunkProof(tree.Root(), i, tree.Len(), chunk, proof) {
+				t.Errorf("Size %d failed. Proof for modified chunk %d verified", size, i)
+			}
+		}
+
+		// the root in the trailer is authenticated
+		damaged := append([]byte{}, cipherText...)
+		damaged[len(damaged)-merkleTrailerSize] ^= 1
+		w, _ = NewDecryptWriteCloser(nopCloser{ioutil.Discard}, key, iv, nil)
+		w.Write(damaged)
+		if err := w.Close(); err == nil {
+			t.Errorf("Size %d failed. Expected a modified root to be detected", size)
+		}
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for count := 1; count <= 17; count++ {
+		var leaves [][]byte
+		var chunks [][]byte
+		for i := 0; i < count; i++ {
+			chunk := []byte{byte(i)}
+			chunks = append(chunks, chunk)
+			leaves = append(leaves, merkleLeaf(chunk))
+		}
+		root := merkleRoot(leaves)
+		for i := 0; i < count; i++ {
+			proof := merklePath(i, leaves)
+			if !VerifyChunkProof(root, i, count, chunks[i], proof) {
+				t.Errorf("Proof for leaf %d of %d did not verify", i, count)
+			}
+			if count > 1 && VerifyChunkProof(root, (i+1)%count, count, chunks[i], proof) {
+				t.Errorf("Proof for leaf %d of %d verified at the wrong index", i, count)
+			}
+		}
+	}
+
+	// RFC 6962 hashes a single leaf as SHA-256(0x00 || data)
+	sum := sha256.Sum256([]byte{0, 'a'})
+	if !bytes.Equal(merkleRoot([][]byte{merkleLeaf([]byte("a"))}), sum[:]) {
+		t.Error("Unexpected leaf hash")
+	}
+}
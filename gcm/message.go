@@ -0,0 +1,170 @@
+package gcm
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+)
+
+// Messages are small values such as database columns, queue messages and
+// cookies, sealed in one piece. A message is
+//
+//	version uint8
+//	idlen   uint8
+//	keyid   [idlen]byte
+//	nonce   [12]byte random
+//	sealed  ciphertext and tag
+//
+// The version and key ID are authenticated along with any associated data.
+// Nonces are random, so a key should seal no more than 2^32 messages.
+
+const (
+	messageVersion   = 1
+	messageNonceSize = 12
+)
+
+// KeyFunc returns the key with the given ID.
+type KeyFunc func(keyID []byte) ([]byte, error)
+
+// SealMessage encrypts plaintext with key, recording keyID so the key can be
+// found again when the message is opened. The key ID may be empty and is
+// not secret.
+func SealMessage(plaintext, key, keyID, aad []byte) ([]byte, error) {
+	if len(keyID) > 255 {
+		return nil, errors.New("The key ID is longer than 255 bytes")
+	}
+	gcm, err := newGCM(key, messageNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, messageNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append([]byte{messageVersion, byte(len(keyID))}, keyID...)
+	message := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+tagSize)
+	message = append(append(message, header...), nonce...)
+	return gcm.Seal(message, nonce, plaintext, append(header, aad...)), nil
+}
+
+// OpenMessage decrypts a message sealed by SealMessage with the key that keys
+// returns for its key ID.
+func OpenMessage(message []byte, keys KeyFunc, aad []byte) ([]byte, error) {
+	keyID, err := MessageKeyID(message)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys(keyID)
+	if err != nil {
+		return nil, err
+	}
+	header := message[:2+len(keyID)]
+	rest := message[len(header):]
+	if len(rest) < messageNonceSize+tagSize {
+		return nil, errors.New("The message is truncated")
+	}
+	gcm, err := newGCM(key, messageNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, rest[:messageNonceSize], rest[messageNonceSize:], append(append([]byte{}, header...), aad...))
+}
+
+// MessageKeyID returns the key ID of a message without opening it.
+func MessageKeyID(message []byte) ([]byte, error) {
+	if len(message) < 2 {
+		return nil, errors.New("The message is truncated")
+	}
+	if message[0] != messageVersion {
+		return nil, fmt.Errorf("Unsupported message version %d", message[0])
+	}
+	if len(message) < 2+int(message[1]) {
+		return nil, errors.New("The message is truncated")
+	}
+	return message[2 : 2+int(message[1])], nil
+}
+
+// Keyring holds keys by ID, one of which seals new messages, so keys can be
+// rotated while messages sealed with older keys still open.
+type Keyring struct {
+	// Primary is the ID of the key that seals new messages.
+	Primary string
+	// Keys maps key IDs to keys.
+	Keys map[string][]byte
+}
+
+// Key returns the key with the given ID. It is a KeyFunc.
+func (k *Keyring) Key(keyID []byte) ([]byte, error) {
+	key, ok := k.Keys[string(keyID)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key ID %q", keyID)
+	}
+	return key, nil
+}
+
+// Seal seals a message with the primary key.
+func (k *Keyring) Seal(plaintext, aad []byte) ([]byte, error) {
+	key, err := k.Key([]byte(k.Primary))
+	if err != nil {
+		return nil, err
+	}
+	return SealMessage(plaintext, key, []byte(k.Primary), aad)
+}
+
+// Open opens a message sealed with any key of the keyring.
+func (k *Keyring) Open(message, aad []byte) ([]byte, error) {
+	return OpenMessage(message, k.Key, aad)
+}
+
+// SealedValue is a database/sql value that is stored as a message sealed
+// with the primary key of Keyring, and opened with any key of it when
+// scanned. An invalid value is stored as NULL.
+//
+//	db.Exec("INSERT INTO users (ssn) VALUES (?)", gcm.SealedValue{Keyring: k, Data: ssn, Valid: true})
+//	v := gcm.SealedValue{Keyring: k}
+//	row.Scan(&v)
+type SealedValue struct {
+	Keyring *Keyring
+	// AAD binds the value to its context, such as its table and column,
+	// so it cannot be moved to another. It must match when scanned.
+	AAD   []byte
+	Data  []byte
+	Valid bool
+}
+
+// Value implements driver.Valuer.
+func (v SealedValue) Value() (driver.Value, error) {
+	if !v.Valid {
+		return nil, nil
+	}
+	if v.Keyring == nil {
+		return nil, errors.New("The sealed value has no keyring")
+	}
+	return v.Keyring.Seal(v.Data, v.AAD)
+}
+
+// Scan implements sql.Scanner.
+func (v *SealedValue) Scan(src interface{}) error {
+	var message []byte
+	switch src := src.(type) {
+	case nil:
+		v.Data, v.Valid = nil, false
+		return nil
+	case []byte:
+		message = src
+	case string:
+		message = []byte(src)
+	default:
+		return fmt.Errorf("Cannot scan %T into a sealed value", src)
+	}
+	if v.Keyring == nil {
+		return errors.New("The sealed value has no keyring")
+	}
+	data, err := v.Keyring.Open(message, v.AAD)
+	if err != nil {
+		return err
+	}
+	v.Data, v.Valid = data, true
+	return nil
+}
@@ -0,0 +1,98 @@
+package gcm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	keys := func(keyID []byte) ([]byte, error) { return key, nil }
+	plainText := []byte("4111 1111 1111 1111")
+	message, err := SealMessage(plainText, key, []byte("k1"), []byte("cards.number"))
+	if err != nil {
+		t.Fatalf("SealMessage failed: %s", err)
+	}
+	if len(message) != 2+2+messageNonceSize+len(plainText)+tagSize {
+		t.Errorf("Failed. Unexpected message size %d", len(message))
+	}
+	if keyID, err := MessageKeyID(message); err != nil || string(keyID) != "k1" {
+		t.Errorf("Failed. Unexpected key ID %q, %v", keyID, err)
+	}
+	opened, err := OpenMessage(message, keys, []byte("cards.number"))
+	if err != nil {
+		t.Fatalf("OpenMessage failed: %s", err)
+	}
+	if !bytes.Equal(opened, plainText) {
+		t.Errorf("Failed. Opened text differs")
+	}
+	if again, _ := SealMessage(plainText, key, []byte("k1"), []byte("cards.number")); bytes.Equal(again, message) {
+		t.Errorf("Failed. Expected a new nonce for every message")
+	}
+
+	if _, err := OpenMessage(message, keys, []byte("cards.cvv")); err == nil {
+		t.Errorf("Failed. Expected different AAD to be rejected")
+	}
+	for i := range message {
+		damaged := append([]byte{}, message...)
+		damaged[i] ^= 1
+		if _, err := OpenMessage(damaged, keys, []byte("cards.number")); err == nil {
+			t.Errorf("Failed. Expected a change to byte %d to be rejected", i)
+		}
+	}
+	if _, err := OpenMessage(message[:10], keys, nil); err == nil {
+		t.Errorf("Failed. Expected a truncated message to be rejected")
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	old := &Keyring{Primary: "2023", Keys: map[string][]byte{"2023": make([]byte, 16)}}
+	message, err := old.Seal([]byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Seal failed: %s", err)
+	}
+	rotated := &Keyring{Primary: "2024", Keys: map[string][]byte{"2023": make([]byte, 16), "2024": bytes.Repeat([]byte{1}, 32)}}
+	if opened, err := rotated.Open(message, nil); err != nil || string(opened) != "secret" {
+		t.Errorf("Failed. Expected a message sealed with a rotated key to open, got %q, %v", opened, err)
+	}
+	fresh, _ := rotated.Seal([]byte("secret"), nil)
+	if keyID, _ := MessageKeyID(fresh); string(keyID) != "2024" {
+		t.Errorf("Failed. Expected the primary key to seal, got %q", keyID)
+	}
+	if _, err := old.Open(fresh, nil); err == nil {
+		t.Errorf("Failed. Expected an unknown key ID to be rejected")
+	}
+}
+
+func TestSealedValue(t *testing.T) {
+	k := &Keyring{Primary: "a", Keys: map[string][]byte{"a": make([]byte, 32)}}
+	value, err := SealedValue{Keyring: k, AAD: []byte("users.ssn"), Data: []byte("078-05-1120"), Valid: true}.Value()
+	if err != nil {
+		t.Fatalf("Value failed: %s", err)
+	}
+	stored, ok := value.([]byte)
+	if !ok || bytes.Contains(stored, []byte("078-05-1120")) {
+		t.Fatalf("Failed. Expected a sealed []byte value")
+	}
+
+	v := SealedValue{Keyring: k, AAD: []byte("users.ssn")}
+	if err := v.Scan(stored); err != nil {
+		t.Fatalf("Scan failed: %s", err)
+	}
+	if !v.Valid || string(v.Data) != "078-05-1120" {
+		t.Errorf("Failed. Unexpected scanned value %+v", v)
+	}
+	if err := v.Scan(string(stored)); err != nil || string(v.Data) != "078-05-1120" {
+		t.Errorf("Failed. Expected a string to scan, got %v", err)
+	}
+	if err := v.Scan(nil); err != nil || v.Valid {
+		t.Errorf("Failed. Expected NULL to scan as invalid")
+	}
+	if value, err := (SealedValue{Keyring: k}).Value(); err != nil || value != nil {
+		t.Errorf("Failed. Expected an invalid value to be stored as NULL")
+	}
+	moved := SealedValue{Keyring: k, AAD: []byte("users.name")}
+	if err := moved.Scan(stored); err == nil {
+		t.Errorf("Failed. Expected a value moved to another column to be rejected")
+	}
+}
@@ -0,0 +1,132 @@
+package gcm
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Metadata describes the original file of an encrypted stream. It is
+// encrypted and authenticated in a record that follows the stream header.
+type Metadata struct {
+	// Name is the base name of the original file.
+	Name string `json:"name,omitempty"`
+	// Mode holds the permission bits of the original file.
+	Mode os.FileMode `json:"mode,omitempty"`
+	// ModTime is the modification time of the original file.
+	ModTime time.Time `json:"mtime"`
+	// ContentType is the MIME type of the plaintext.
+	ContentType string `json:"content_type,omitempty"`
+	// SHA256 is the digest of the plaintext. If set, it is verified when
+	// the stream is closed after decryption.
+	SHA256 []byte `json:"sha256,omitempty"`
+}
+
+// fileMetadata returns a copy of meta with any unset fields filled in from
+// the file at p, hashing the file if no digest was given.
+func fileMetadata(meta *Metadata, p string, info os.FileInfo) (*Metadata, error) {
+	m := *meta
+	if m.Name == "" {
+		m.Name = filepath.Base(p)
+	}
+	if m.Mode == 0 {
+		m.Mode = info.Mode().Perm()
+	}
+	if m.ModTime.IsZero() {
+		m.ModTime = info.ModTime()
+	}
+	if m.ContentType == "" || m.SHA256 == nil {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if m.ContentType == "" {
+			m.ContentType = mime.TypeByExtension(filepath.Ext(p))
+		}
+		if m.ContentType == "" {
+			head := make([]byte, 512)
+			n, err := io.ReadFull(f, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			m.ContentType = http.DetectContentType(head[:n])
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		if m.SHA256 == nil {
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err != nil {
+				return nil, err
+			}
+			m.SHA256 = h.Sum(nil)
+		}
+	}
+	return &m, nil
+}
+
+// restore applies the mode and modification time to the file at p.
+func (m *Metadata) restore(p string) error {
+	if m.Mode != 0 {
+		if err := os.Chmod(p, m.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if !m.ModTime.IsZero() {
+		return os.Chtimes(p, m.ModTime, m.ModTime)
+	}
+	return nil
+}
+
+// safeName returns the metadata file name if it is usable as a single path
+// element.
+func (m *Metadata) safeName() (string, error) {
+	name := m.Name
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name || filepath.ToSlash(name) != name {
+		return "", fmt.Errorf("Invalid file name in metadata: %q", m.Name)
+	}
+	return name, nil
+}
+
+// Inspect authenticates and returns the metadata at the start of an
+// encrypted stream without decrypting its contents. The stream may be
+// armored.
+func Inspect(r io.Reader, key, iv, aad []byte) (*Metadata, error) {
+	r = Dearmor(r)
+	w, err := NewDecryptWriteCloser(nopCloser{ioutil.Discard}, key, iv, aad)
+	if err != nil {
+		return nil, err
+	}
+	for w.prefixing() {
+		buf := make([]byte, w.prefixNeed-len(w.prefix))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	if w.metadata == nil {
+		return nil, errors.New("The stream has no metadata")
+	}
+	return w.metadata, nil
+}
+
+// InspectFile authenticates and returns the metadata of the encrypted file at
+// the specified path.
+func InspectFile(inFilePath string, key, iv, aad []byte) (*Metadata, error) {
+	f, err := os.Open(inFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Inspect(f, key, iv, aad)
+}
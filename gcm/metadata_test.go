@@ -0,0 +1,141 @@
+package gcm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcm-metadata")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	plainText := bytes.Repeat([]byte("<html></html>\n"), chunkSize/7)
+	inPath := filepath.Join(tmp, "report.html")
+	encPath := filepath.Join(tmp, "data.enc")
+	outDir := filepath.Join(tmp, "out")
+	mtime := time.Date(2016, 10, 14, 12, 0, 0, 0, time.UTC)
+
+	if err := ioutil.WriteFile(inPath, plainText, 0640); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+	if err := os.Chtimes(inPath, mtime, mtime); err != nil {
+		t.Fatalf("Failed to set file times: %s", err)
+	}
+	if err := os.Mkdir(outDir, 0700); err != nil {
+		t.Fatalf("Failed to create dir: %s", err)
+	}
+
+	opts := &Options{Metadata: &Metadata{}}
+	if err := EncryptFileWithOptions(inPath, encPath, key, iv, nil, opts); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	cipherText, err := ioutil.ReadFile(encPath)
+	if err != nil {
+		t.Fatalf("Failed to read file: %s", err)
+	}
+	if bytes.Contains(cipherText, []byte("report")) {
+		t.Error("Encrypted file leaks the file name")
+	}
+
+	meta, err := InspectFile(encPath, key, iv, nil)
+	if err != nil {
+		t.Fatalf("Inspection failed: %s", err)
+	}
+	digest := sha256.Sum256(plainText)
+	if meta.Name != "report.html" || meta.Mode != 0640 || !meta.ModTime.Equal(mtime) ||
+		meta.ContentType != "text/html; charset=utf-8" || !bytes.Equal(meta.SHA256, digest[:]) {
+		t.Errorf("Unexpected metadata: %+v", meta)
+	}
+	if _, err := InspectFile(encPath, make([]byte, 32), append([]byte{1}, iv[1:]...), nil); err == nil {
+		t.Error("Expected inspection with the wrong IV to fail")
+	}
+
+	if err := DecryptFile(encPath, outDir, key, iv, nil); err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	outPath := filepath.Join(outDir, "report.html")
+	out, err := ioutil.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %s", err)
+	}
+	if !bytes.Equal(out, plainText) {
+		t.Error("Decrypted file differs")
+	}
+	info, err := os.Stat(outPath)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %s", err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Metadata was not restored: %s %s", info.Mode(), info.ModTime())
+	}
+
+	size, err := CiphertextSize(int64(len(plainText)), &Options{Metadata: meta})
+	if err != nil || size != int64(len(cipherText)) {
+		t.Errorf("CiphertextSize %d != %d (%v)", size, len(cipherText), err)
+	}
+
+	// a stream with a header must end with a short chunk
+	last := len(plainText)%chunkSize + tagSize
+	if err := decryptBytes(cipherText[:len(cipherText)-last], key, iv); err == nil {
+		t.Error("Expected decryption of a truncated stream to fail")
+	}
+
+	// the digest in the metadata is verified
+	opts = &Options{Metadata: &Metadata{SHA256: make([]byte, sha256.Size)}}
+	r, err := NewEncryptReaderWithOptions(bytes.NewReader(plainText), key, iv, nil, opts)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %s", err)
+	}
+	cipherText, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if err := decryptBytes(cipherText, key, iv); err == nil {
+		t.Error("Expected a digest mismatch")
+	}
+}
+
+func decryptBytes(cipherText, key, iv []byte) error {
+	w, err := NewDecryptWriteCloser(nopCloser{ioutil.Discard}, key, iv, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(cipherText); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestMetadataSizeLimit(t *testing.T) {
+	// a header claiming a huge metadata record must not be trusted before
+	// it is authenticated
+	hdr := (&header{metadataSize: 1 << 31}).marshal()
+	if _, err := parseHeader(hdr); err == nil {
+		t.Errorf("Failed. Expected an oversized metadata record to be rejected")
+	}
+	w, err := NewDecryptWriteCloser(nopCloser{ioutil.Discard}, make([]byte, 32), make([]byte, 12), nil)
+	if err != nil {
+		t.Fatalf("NewDecryptWriteCloser failed: %s", err)
+	}
+	if _, err := w.Write(hdr); err == nil {
+		t.Errorf("Failed. Expected the header to be rejected on decryption")
+	}
+	if _, err := Inspect(bytes.NewReader(hdr), make([]byte, 32), make([]byte, 12), nil); err == nil {
+		t.Errorf("Failed. Expected the header to be rejected by Inspect")
+	}
+
+	big := &Metadata{ContentType: string(bytes.Repeat([]byte{'x'}, 64*1024))}
+	if _, err := NewEncryptReaderWithOptions(bytes.NewReader(nil), make([]byte, 32), make([]byte, 12), nil, &Options{Metadata: big}); err == nil {
+		t.Errorf("Failed. Expected oversized metadata to be rejected on encryption")
+	}
+}
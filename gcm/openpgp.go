@@ -0,0 +1,890 @@
+package gcm
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// OpenPGP messages as defined by RFC 9580 are sequences of packets. A
+// passphrase protected message holds a version 6 Symmetric-Key Encrypted
+// Session Key (SKESK) packet, which seals a random session key with a key
+// derived from the passphrase, followed by a version 2 Symmetrically
+// Encrypted and Integrity Protected Data (SEIPD) packet. The latter is a
+// chunked AEAD stream much like the streams of this package:
+//
+//	version   uint8  2
+//	cipher    uint8  AES-128, AES-192 or AES-256
+//	aead      uint8  GCM
+//	chunkSize uint8  chunks of 1 << (chunkSize + 6) bytes
+//	salt      [32]byte
+//	chunks    ...    each followed by its tag
+//	final tag [16]byte
+//
+// The message key and IV are derived from the session key and salt with
+// HKDF-SHA-256. Chunk nonces are the IV followed by the big-endian chunk
+// index, and the final tag authenticates the total plaintext size. The
+// plaintext is a Literal Data packet holding the message.
+//
+// Passphrases use the Argon2 S2K by default, or the iterated and salted S2K
+// for readers without Argon2. Only the GCM AEAD mode is supported.
+
+// OpenPGP packet tags
+const (
+	pgpTagPKESK      = 1
+	pgpTagSKESK      = 3
+	pgpTagCompressed = 8
+	pgpTagLiteral    = 11
+	pgpTagSEIPD      = 18
+	pgpTagPadding    = 21
+)
+
+const (
+	pgpCipherAES128 = 7
+	pgpCipherAES192 = 8
+	pgpCipherAES256 = 9
+	pgpAEADGCM      = 3
+
+	pgpS2KIterated = 3
+	pgpS2KArgon2   = 4
+
+	pgpArgon2SaltSize = 16
+	// the largest Argon2 cost accepted: 2 GiB of memory, the most RFC 9580
+	// recommends, and 16 passes
+	pgpMaxArgon2Memory = 21
+	pgpMaxArgon2Passes = 16
+
+	pgpSaltSize    = 32
+	pgpNonceSize   = 12
+	pgpIVSize      = pgpNonceSize - 8
+	pgpMaxChunk    = 16
+	pgpDefaultS2K  = 0xff
+	pgpPartialSize = 1 << 16
+)
+
+// OpenPGPS2K selects how the key that seals the session key is derived from
+// the passphrase.
+type OpenPGPS2K uint8
+
+const (
+	// OpenPGPS2KArgon2 uses Argon2id, as RFC 9580 recommends.
+	OpenPGPS2KArgon2 OpenPGPS2K = iota
+	// OpenPGPS2KIterated uses the iterated and salted S2K with SHA-256,
+	// for readers that do not support Argon2.
+	OpenPGPS2KIterated
+)
+
+// OpenPGPParams configures the messages written by NewOpenPGPEncryptWriter.
+type OpenPGPParams struct {
+	// KeySize selects AES-128, AES-192 or AES-256. It defaults to 32.
+	KeySize int
+	// ChunkSize is the size of the AEAD chunks: a power of two from 64
+	// bytes to 4 MiB. It defaults to 1 MiB.
+	ChunkSize int
+	// S2K selects the passphrase S2K. It defaults to Argon2.
+	S2K OpenPGPS2K
+	// S2KCount is the coded iteration count of the iterated and salted
+	// S2K. It defaults to 255, the largest count of 65011712 bytes.
+	S2KCount byte
+	// Argon2Passes, Argon2Parallelism and Argon2Memory set the cost of the
+	// Argon2 S2K, the memory as the base-2 logarithm of its size in KiB.
+	// They default to 3, 4 and 16, which uses 64 MiB, as RFC 9580
+	// recommends where memory is constrained.
+	Argon2Passes      byte
+	Argon2Parallelism byte
+	Argon2Memory      byte
+	// FileName and ModTime are stored in the Literal Data packet.
+	FileName string
+	ModTime  time.Time
+}
+
+func pgpCipher(keySize int) (byte, error) {
+	switch keySize {
+	case 16:
+		return pgpCipherAES128, nil
+	case 24:
+		return pgpCipherAES192, nil
+	case 32:
+		return pgpCipherAES256, nil
+	}
+	return 0, fmt.Errorf("Invalid OpenPGP key size %d", keySize)
+}
+
+func pgpKeySize(algo byte) (int, error) {
+	switch algo {
+	case pgpCipherAES128:
+		return 16, nil
+	case pgpCipherAES192:
+		return 24, nil
+	case pgpCipherAES256:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("Unsupported OpenPGP cipher %d", algo)
+}
+
+func pgpGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func pgpHash(algo byte) (func() hash.Hash, error) {
+	switch algo {
+	case 2:
+		return sha1.New, nil
+	case 8:
+		return sha256.New, nil
+	case 9:
+		return sha512.New384, nil
+	case 10:
+		return sha512.New, nil
+	case 11:
+		return sha256.New224, nil
+	}
+	return nil, fmt.Errorf("Unsupported OpenPGP hash %d", algo)
+}
+
+// s2kIterated derives a key from a passphrase with the iterated and salted
+// S2K of RFC 9580 section 3.7.1.3.
+func s2kIterated(h func() hash.Hash, passphrase, salt []byte, coded byte, keySize int) []byte {
+	count := (16 + int(coded&15)) << (uint(coded>>4) + 6)
+	combined := append(append([]byte{}, salt...), passphrase...)
+	if count < len(combined) {
+		count = len(combined)
+	}
+	// hash the repeated input in large writes
+	block := combined
+	for len(block) < 64*1024 {
+		block = append(block, combined...)
+	}
+	var key []byte
+	for i := 0; len(key) < keySize; i++ {
+		d := h()
+		d.Write(make([]byte, i))
+		for n := count; n > 0; {
+			w := len(block)
+			if w > n {
+				w = n
+			}
+			d.Write(block[:w])
+			n -= w
+		}
+		key = d.Sum(key)
+	}
+	return key[:keySize]
+}
+
+// validArgon2 reports whether the Argon2 S2K parameters are allowed: the
+// memory must hold at least 8 KiB per lane.
+func validArgon2(passes, parallelism, memory byte) bool {
+	return passes > 0 && passes <= pgpMaxArgon2Passes && parallelism > 0 &&
+		memory <= pgpMaxArgon2Memory && uint32(1)<<memory >= 8*uint32(parallelism)
+}
+
+// newS2K returns an S2K specifier with a random salt for the params.
+func newS2K(p *OpenPGPParams) ([]byte, error) {
+	if p.S2K == OpenPGPS2KIterated {
+		s2k := make([]byte, 11)
+		s2k[0], s2k[1], s2k[10] = pgpS2KIterated, 8, p.S2KCount
+		_, err := rand.Read(s2k[2:10])
+		return s2k, err
+	}
+	s2k := make([]byte, 1+pgpArgon2SaltSize+3)
+	s2k[0] = pgpS2KArgon2
+	s2k[1+pgpArgon2SaltSize] = p.Argon2Passes
+	s2k[2+pgpArgon2SaltSize] = p.Argon2Parallelism
+	s2k[3+pgpArgon2SaltSize] = p.Argon2Memory
+	_, err := rand.Read(s2k[1 : 1+pgpArgon2SaltSize])
+	return s2k, err
+}
+
+// s2kKey derives a key of keySize bytes from the passphrase as the S2K
+// specifier describes.
+func s2kKey(s2k, passphrase []byte, keySize int) ([]byte, error) {
+	if len(s2k) == 0 {
+		return nil, errors.New("Invalid OpenPGP S2K specifier")
+	}
+	switch s2k[0] {
+	case pgpS2KIterated:
+		if len(s2k) != 11 {
+			return nil, errors.New("Invalid OpenPGP S2K specifier")
+		}
+		h, err := pgpHash(s2k[1])
+		if err != nil {
+			return nil, err
+		}
+		return s2kIterated(h, passphrase, s2k[2:10], s2k[10], keySize), nil
+	case pgpS2KArgon2:
+		if len(s2k) != 1+pgpArgon2SaltSize+3 {
+			return nil, errors.New("Invalid OpenPGP S2K specifier")
+		}
+		salt := s2k[1 : 1+pgpArgon2SaltSize]
+		passes, parallelism, memory := s2k[1+pgpArgon2SaltSize], s2k[2+pgpArgon2SaltSize], s2k[3+pgpArgon2SaltSize]
+		if !validArgon2(passes, parallelism, memory) {
+			return nil, fmt.Errorf("Unsupported Argon2 parameters t=%d p=%d m=2^%d", passes, parallelism, memory)
+		}
+		return argon2.IDKey(passphrase, salt, uint32(passes), uint32(1)<<memory, parallelism, uint32(keySize)), nil
+	}
+	return nil, fmt.Errorf("Unsupported OpenPGP S2K type %d", s2k[0])
+}
+
+// appendPGPLength appends a definite OpenPGP packet body length.
+func appendPGPLength(b []byte, n int) []byte {
+	switch {
+	case n < 192:
+		return append(b, byte(n))
+	case n < 8384:
+		n -= 192
+		return append(b, byte(n>>8)+192, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xff), uint32(n))
+}
+
+// pgpPacketWriter writes a packet whose size is not known in advance, using
+// partial body lengths.
+type pgpPacketWriter struct {
+	dst io.Writer
+	tag byte
+	buf []byte
+	hdr bool
+}
+
+func (w *pgpPacketWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > pgpPartialSize {
+		piece := []byte{0xe0 | 16}
+		if !w.hdr {
+			piece = append([]byte{0xc0 | w.tag}, piece...)
+			w.hdr = true
+		}
+		if _, err := w.dst.Write(append(piece, w.buf[:pgpPartialSize]...)); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[pgpPartialSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close writes the last part of the packet with a definite length.
+func (w *pgpPacketWriter) Close() error {
+	var out []byte
+	if !w.hdr {
+		out = append(out, 0xc0|w.tag)
+	}
+	out = appendPGPLength(out, len(w.buf))
+	_, err := w.dst.Write(append(out, w.buf...))
+	return err
+}
+
+// pgpChunkWriter seals the SEIPD plaintext written to it in chunks.
+type pgpChunkWriter struct {
+	dst   io.WriteCloser
+	aead  cipher.AEAD
+	iv    []byte
+	ad    []byte
+	buf   []byte
+	size  int
+	index uint64
+	total uint64
+}
+
+func (w *pgpChunkWriter) nonce() []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, w.iv...), w.index)
+}
+
+func (w *pgpChunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		read := w.size - len(w.buf)
+		if read > len(p) {
+			read = len(p)
+		}
+		w.buf = append(w.buf, p[:read]...)
+		p = p[read:]
+		if len(w.buf) == w.size {
+			if err := w.seal(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *pgpChunkWriter) seal() error {
+	sealed := w.aead.Seal(nil, w.nonce(), w.buf, w.ad)
+	w.total += uint64(len(w.buf))
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk and the final tag.
+func (w *pgpChunkWriter) Close() error {
+	if len(w.buf) > 0 {
+		if err := w.seal(); err != nil {
+			return err
+		}
+	}
+	ad := binary.BigEndian.AppendUint64(append([]byte{}, w.ad...), w.total)
+	if _, err := w.dst.Write(w.aead.Seal(nil, w.nonce(), nil, ad)); err != nil {
+		return err
+	}
+	return w.dst.Close()
+}
+
+// pgpEncryptWriter writes the Literal Data packet into the encrypted chunks.
+type pgpEncryptWriter struct {
+	literal *pgpPacketWriter
+	chunks  *pgpChunkWriter
+}
+
+// NewOpenPGPEncryptWriter returns a writer that encrypts the data written to
+// it into a passphrase protected OpenPGP message in dst. The message is only
+// complete once the writer is closed; dst is not closed. The params may be
+// nil.
+func NewOpenPGPEncryptWriter(dst io.Writer, passphrase []byte, params *OpenPGPParams) (io.WriteCloser, error) {
+	p := OpenPGPParams{}
+	if params != nil {
+		p = *params
+	}
+	if p.KeySize == 0 {
+		p.KeySize = 32
+	}
+	if p.ChunkSize == 0 {
+		p.ChunkSize = chunkSize
+	}
+	if p.S2KCount == 0 {
+		p.S2KCount = pgpDefaultS2K
+	}
+	if p.Argon2Passes == 0 {
+		p.Argon2Passes = 3
+	}
+	if p.Argon2Parallelism == 0 {
+		p.Argon2Parallelism = 4
+	}
+	if p.Argon2Memory == 0 {
+		p.Argon2Memory = 16
+	}
+	switch {
+	case p.S2K > OpenPGPS2KIterated:
+		return nil, fmt.Errorf("Invalid OpenPGP S2K %d", p.S2K)
+	case p.S2K == OpenPGPS2KArgon2 && !validArgon2(p.Argon2Passes, p.Argon2Parallelism, p.Argon2Memory):
+		return nil, errors.New("Invalid Argon2 parameters")
+	}
+	algo, err := pgpCipher(p.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	chunkOctet := -1
+	for c := 0; c <= pgpMaxChunk; c++ {
+		if 1<<uint(c+6) == p.ChunkSize {
+			chunkOctet = c
+		}
+	}
+	if chunkOctet < 0 {
+		return nil, fmt.Errorf("Invalid OpenPGP chunk size %d", p.ChunkSize)
+	}
+
+	sessionKey := make([]byte, p.KeySize)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+	skesk, err := sealSKESK(sessionKey, passphrase, algo, &p)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{0xc0 | pgpTagSKESK}, appendPGPLength(nil, len(skesk))...)
+	if _, err := dst.Write(append(out, skesk...)); err != nil {
+		return nil, err
+	}
+
+	seipd := &pgpPacketWriter{dst: dst, tag: pgpTagSEIPD}
+	hdr := make([]byte, 4+pgpSaltSize)
+	hdr[0], hdr[1], hdr[2], hdr[3] = 2, algo, pgpAEADGCM, byte(chunkOctet)
+	if _, err := rand.Read(hdr[4:]); err != nil {
+		return nil, err
+	}
+	if _, err := seipd.Write(hdr); err != nil {
+		return nil, err
+	}
+	chunks, err := newPGPChunkWriter(seipd, sessionKey, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	literal := &pgpPacketWriter{dst: chunks, tag: pgpTagLiteral}
+	name := p.FileName
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	var date uint32
+	if !p.ModTime.IsZero() {
+		date = uint32(p.ModTime.Unix())
+	}
+	lit := append([]byte{'b', byte(len(name))}, name...)
+	if _, err := literal.Write(binary.BigEndian.AppendUint32(lit, date)); err != nil {
+		return nil, err
+	}
+	return &pgpEncryptWriter{literal: literal, chunks: chunks}, nil
+}
+
+func (w *pgpEncryptWriter) Write(p []byte) (int, error) {
+	return w.literal.Write(p)
+}
+
+func (w *pgpEncryptWriter) Close() error {
+	if err := w.literal.Close(); err != nil {
+		return err
+	}
+	return w.chunks.Close()
+}
+
+// seipdInfo returns the SEIPD associated data, which is also the HKDF info.
+func seipdInfo(hdr []byte) []byte {
+	return []byte{0xc0 | pgpTagSEIPD, hdr[0], hdr[1], hdr[2], hdr[3]}
+}
+
+// seipdKeys derives the message cipher and IV from the session key and the
+// SEIPD header.
+func seipdKeys(sessionKey, hdr []byte) (cipher.AEAD, []byte, error) {
+	keySize := len(sessionKey)
+	derived, err := hkdf.Key(sha256.New, sessionKey, hdr[4:4+pgpSaltSize], string(seipdInfo(hdr)), keySize+pgpIVSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := pgpGCM(derived[:keySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, derived[keySize:], nil
+}
+
+func newPGPChunkWriter(dst io.WriteCloser, sessionKey, hdr []byte) (*pgpChunkWriter, error) {
+	aead, iv, err := seipdKeys(sessionKey, hdr)
+	if err != nil {
+		return nil, err
+	}
+	size := 1 << uint(hdr[3]+6)
+	return &pgpChunkWriter{
+		dst:  dst,
+		aead: aead,
+		iv:   iv,
+		ad:   seipdInfo(hdr),
+		buf:  make([]byte, 0, size),
+		size: size,
+	}, nil
+}
+
+// skeskKEK derives the key that seals the session key in a v6 SKESK packet.
+func skeskKEK(s2kKey []byte, algo byte) (cipher.AEAD, []byte, error) {
+	info := []byte{0xc0 | pgpTagSKESK, 6, algo, pgpAEADGCM}
+	kek, err := hkdf.Key(sha256.New, s2kKey, nil, string(info), len(s2kKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := pgpGCM(kek)
+	return aead, info, err
+}
+
+// sealSKESK returns the body of a v6 SKESK packet sealing the session key.
+func sealSKESK(sessionKey, passphrase []byte, algo byte, p *OpenPGPParams) ([]byte, error) {
+	s2k, err := newS2K(p)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s2kKey(s2k, passphrase, len(sessionKey))
+	if err != nil {
+		return nil, err
+	}
+	aead, info, err := skeskKEK(key, algo)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, pgpNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	b := []byte{6, byte(3 + len(s2k) + len(nonce)), algo, pgpAEADGCM, byte(len(s2k))}
+	b = append(append(b, s2k...), nonce...)
+	return aead.Seal(b, nonce, sessionKey, info), nil
+}
+
+// openSKESK returns the session key sealed in a v6 SKESK packet body, or
+// ErrWrongKey if the passphrase does not open it.
+func openSKESK(b, passphrase []byte) ([]byte, error) {
+	if len(b) < 5 || b[0] != 6 {
+		return nil, errors.New("Unsupported OpenPGP SKESK packet version")
+	}
+	algo, mode, s2kSize := b[2], b[3], int(b[4])
+	if mode != pgpAEADGCM {
+		return nil, fmt.Errorf("Unsupported OpenPGP AEAD mode %d", mode)
+	}
+	keySize, err := pgpKeySize(algo)
+	if err != nil {
+		return nil, err
+	}
+	if int(b[1]) != 3+s2kSize+pgpNonceSize || len(b) < 5+s2kSize+pgpNonceSize+tagSize {
+		return nil, errors.New("Invalid OpenPGP SKESK packet")
+	}
+	s2k := b[5 : 5+s2kSize]
+	nonce := b[5+s2kSize : 5+s2kSize+pgpNonceSize]
+	sealed := b[5+s2kSize+pgpNonceSize:]
+
+	key, err := s2kKey(s2k, passphrase, keySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, info, err := skeskKEK(key, algo)
+	if err != nil {
+		return nil, err
+	}
+	sessionKey, err := aead.Open(nil, nonce, sealed, info)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return sessionKey, nil
+}
+
+// readPGPPacket reads the header of the next packet and returns its tag and
+// a reader of its body. It returns io.EOF at the end of the input.
+func readPGPPacket(br *bufio.Reader) (byte, io.Reader, error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if first&0xc0 != 0xc0 {
+		return 0, nil, errors.New("Unsupported OpenPGP packet format")
+	}
+	body := &pgpBodyReader{br: br}
+	if err := body.readLength(); err != nil {
+		return 0, nil, err
+	}
+	return first & 0x3f, body, nil
+}
+
+// pgpBodyReader reads a packet body, following partial body lengths.
+type pgpBodyReader struct {
+	br      *bufio.Reader
+	remain  int64
+	partial bool
+}
+
+func (r *pgpBodyReader) readLength() error {
+	b, err := r.br.ReadByte()
+	if err != nil {
+		return errors.New("The OpenPGP message is truncated")
+	}
+	r.partial = false
+	switch {
+	case b < 192:
+		r.remain = int64(b)
+	case b < 224:
+		b2, err := r.br.ReadByte()
+		if err != nil {
+			return errors.New("The OpenPGP message is truncated")
+		}
+		r.remain = int64(b-192)<<8 + int64(b2) + 192
+	case b < 255:
+		r.remain = 1 << uint(b&0x1f)
+		r.partial = true
+	default:
+		var n [4]byte
+		if _, err := io.ReadFull(r.br, n[:]); err != nil {
+			return errors.New("The OpenPGP message is truncated")
+		}
+		r.remain = int64(binary.BigEndian.Uint32(n[:]))
+	}
+	return nil
+}
+
+func (r *pgpBodyReader) Read(p []byte) (int, error) {
+	for r.remain == 0 {
+		if !r.partial {
+			return 0, io.EOF
+		}
+		if err := r.readLength(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	n, err := r.br.Read(p)
+	r.remain -= int64(n)
+	if err == io.EOF {
+		err = errors.New("The OpenPGP message is truncated")
+	}
+	return n, err
+}
+
+// pgpChunkReader opens the chunks of a SEIPD packet body, returning
+// io.EOF only once the final tag has been authenticated.
+type pgpChunkReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	iv    []byte
+	ad    []byte
+	size  int
+	index uint64
+	total uint64
+	out   []byte
+	done  bool
+}
+
+func (r *pgpChunkReader) nonce() []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, r.iv...), r.index)
+}
+
+func (r *pgpChunkReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// next opens the next chunk. A full chunk is only the last one if nothing
+// but the final tag follows it.
+func (r *pgpChunkReader) next() error {
+	full := r.size + tagSize
+	peek, err := r.src.Peek(full + tagSize + 1)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	if len(peek) == full+tagSize+1 {
+		opened, err := r.aead.Open(nil, r.nonce(), peek[:full], r.ad)
+		if err != nil {
+			return err
+		}
+		r.src.Discard(full)
+		r.index++
+		r.total += uint64(len(opened))
+		r.out = opened
+		return nil
+	}
+	if len(peek) < tagSize || (len(peek) > tagSize && len(peek) < 2*tagSize) {
+		return errors.New("The OpenPGP message is truncated")
+	}
+	last := peek[:len(peek)-tagSize]
+	final := append([]byte{}, peek[len(peek)-tagSize:]...)
+	if len(last) > 0 {
+		opened, err := r.aead.Open(nil, r.nonce(), last, r.ad)
+		if err != nil {
+			return err
+		}
+		r.index++
+		r.total += uint64(len(opened))
+		r.out = opened
+	}
+	r.src.Discard(len(peek))
+	ad := binary.BigEndian.AppendUint64(append([]byte{}, r.ad...), r.total)
+	if _, err := r.aead.Open(nil, r.nonce(), final, ad); err != nil {
+		return errors.New("The OpenPGP message is truncated or modified")
+	}
+	r.done = true
+	return nil
+}
+
+// pgpLiteralReader reads the data of the Literal Data packet, and on reaching
+// its end checks that the rest of the encrypted data authenticates.
+type pgpLiteralReader struct {
+	body   io.Reader
+	inner  *bufio.Reader
+	chunks *pgpChunkReader
+}
+
+func (r *pgpLiteralReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	// only padding may follow the literal data
+	for {
+		tag, body, err := readPGPPacket(r.inner)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if tag != pgpTagPadding {
+			return n, fmt.Errorf("Unexpected OpenPGP packet %d after the literal data", tag)
+		}
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return n, err
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, r.chunks); err != nil {
+		return n, err
+	}
+	return n, io.EOF
+}
+
+// NewOpenPGPDecryptReader returns a reader of the data in a passphrase
+// protected OpenPGP message read from src. As with DecryptWriteCloser, data
+// is returned as each chunk authenticates, and the message is only known to
+// be complete once the reader returns io.EOF.
+func NewOpenPGPDecryptReader(src io.Reader, passphrase []byte) (io.Reader, error) {
+	br := bufio.NewReader(src)
+	var sessionKey []byte
+	sawSKESK := false
+	for {
+		tag, body, err := readPGPPacket(br)
+		if err == io.EOF {
+			return nil, errors.New("The OpenPGP message has no encrypted data")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case pgpTagPKESK:
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+		case pgpTagSKESK:
+			b, err := ioutil.ReadAll(io.LimitReader(body, 1024))
+			if err != nil {
+				return nil, err
+			}
+			sawSKESK = true
+			if sessionKey == nil {
+				key, err := openSKESK(b, passphrase)
+				if err != nil && err != ErrWrongKey {
+					return nil, err
+				}
+				sessionKey = key
+			}
+		case pgpTagSEIPD:
+			if sessionKey == nil {
+				if sawSKESK {
+					return nil, ErrWrongKey
+				}
+				return nil, errors.New("The OpenPGP message is not passphrase protected")
+			}
+			return openSEIPD(body, sessionKey)
+		default:
+			return nil, fmt.Errorf("Unsupported OpenPGP packet %d", tag)
+		}
+	}
+}
+
+// openSEIPD returns a reader of the literal data in a v2 SEIPD packet body.
+func openSEIPD(body io.Reader, sessionKey []byte) (io.Reader, error) {
+	hdr := make([]byte, 4+pgpSaltSize)
+	if _, err := io.ReadFull(body, hdr); err != nil {
+		return nil, errors.New("The OpenPGP message is truncated")
+	}
+	if hdr[0] != 2 {
+		return nil, fmt.Errorf("Unsupported OpenPGP SEIPD packet version %d", hdr[0])
+	}
+	if hdr[2] != pgpAEADGCM {
+		return nil, fmt.Errorf("Unsupported OpenPGP AEAD mode %d", hdr[2])
+	}
+	if hdr[3] > pgpMaxChunk {
+		return nil, fmt.Errorf("Invalid OpenPGP chunk size %d", hdr[3])
+	}
+	if keySize, err := pgpKeySize(hdr[1]); err != nil {
+		return nil, err
+	} else if keySize != len(sessionKey) {
+		return nil, errors.New("The OpenPGP session key does not match the cipher")
+	}
+	aead, iv, err := seipdKeys(sessionKey, hdr)
+	if err != nil {
+		return nil, err
+	}
+	size := 1 << uint(hdr[3]+6)
+	chunks := &pgpChunkReader{
+		src:  bufio.NewReaderSize(body, size+2*tagSize+1),
+		aead: aead,
+		iv:   iv,
+		ad:   seipdInfo(hdr),
+		size: size,
+	}
+	inner := bufio.NewReader(chunks)
+	for {
+		tag, body, err := readPGPPacket(inner)
+		if err == io.EOF {
+			return nil, errors.New("The OpenPGP message has no literal data")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case pgpTagPadding:
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+		case pgpTagCompressed:
+			// the compressed data holds the remaining packets
+			decompressed, err := pgpDecompress(body)
+			if err != nil {
+				return nil, err
+			}
+			inner = bufio.NewReader(decompressed)
+		case pgpTagLiteral:
+			if err := skipLiteralHeader(body); err != nil {
+				return nil, err
+			}
+			return &pgpLiteralReader{body: body, inner: inner, chunks: chunks}, nil
+		default:
+			return nil, fmt.Errorf("Unsupported OpenPGP packet %d", tag)
+		}
+	}
+}
+
+func pgpDecompress(body io.Reader) (io.Reader, error) {
+	var algo [1]byte
+	if _, err := io.ReadFull(body, algo[:]); err != nil {
+		return nil, errors.New("The OpenPGP message is truncated")
+	}
+	switch algo[0] {
+	case 0:
+		return body, nil
+	case 1:
+		return flate.NewReader(body), nil
+	case 2:
+		return zlib.NewReader(body)
+	case 3:
+		return bzip2.NewReader(body), nil
+	}
+	return nil, fmt.Errorf("Unsupported OpenPGP compression %d", algo[0])
+}
+
+// skipLiteralHeader reads the format, file name and date of a Literal Data
+// packet.
+func skipLiteralHeader(body io.Reader) error {
+	var b [2]byte
+	if _, err := io.ReadFull(body, b[:]); err != nil {
+		return errors.New("Invalid OpenPGP literal data packet")
+	}
+	if _, err := io.CopyN(ioutil.Discard, body, int64(b[1])+4); err != nil {
+		return errors.New("Invalid OpenPGP literal data packet")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package gcm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func pgpEncrypt(t *testing.T, plainText, passphrase []byte, params *OpenPGPParams) []byte {
+	var buf bytes.Buffer
+	w, err := NewOpenPGPEncryptWriter(&buf, passphrase, params)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %s", err)
+	}
+	if _, err := w.Write(plainText); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func pgpDecrypt(message, passphrase []byte) ([]byte, error) {
+	r, err := NewOpenPGPDecryptReader(bytes.NewReader(message), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestOpenPGP(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	for _, params := range []*OpenPGPParams{
+		{ChunkSize: 64, S2K: OpenPGPS2KIterated, S2KCount: 0x10},
+		{KeySize: 16, ChunkSize: 4096, S2K: OpenPGPS2KIterated, S2KCount: 0x10, FileName: "data.bin"},
+		{KeySize: 24, Argon2Passes: 1, Argon2Parallelism: 1, Argon2Memory: 3},
+		nil,
+	} {
+		for _, size := range []int{0, 1, 57, 58, 4090, 100000, 200000} {
+			plainText := make([]byte, size)
+			for i := range plainText {
+				plainText[i] = byte(i * 13)
+			}
+			message := pgpEncrypt(t, plainText, passphrase, params)
+			out, err := pgpDecrypt(message, passphrase)
+			if err != nil {
+				t.Fatalf("Params %+v size %d decryption failed: %s", params, size, err)
+			}
+			if !bytes.Equal(out, plainText) {
+				t.Errorf("Params %+v size %d failed. Plaintext differs", params, size)
+			}
+			if params == nil {
+				// the default Argon2 cost is slow, so only check the layout
+				break
+			}
+
+			if _, err := pgpDecrypt(message, []byte("wrong")); err != ErrWrongKey {
+				t.Errorf("Params %+v size %d failed. Expected ErrWrongKey, got %v", params, size, err)
+			}
+			for _, cut := range []int{1, tagSize, tagSize + 1} {
+				if _, err := pgpDecrypt(message[:len(message)-cut], passphrase); err == nil {
+					t.Errorf("Params %+v size %d failed. Expected truncation by %d to be detected", params, size, cut)
+				}
+			}
+			damaged := append([]byte{}, message...)
+			damaged[len(damaged)/2+40] ^= 1
+			if _, err := pgpDecrypt(damaged, passphrase); err == nil {
+				t.Errorf("Params %+v size %d failed. Expected modification to be detected", params, size)
+			}
+		}
+	}
+}
+
+func TestOpenPGPUnsupported(t *testing.T) {
+	message := pgpEncrypt(t, []byte("hello"), []byte("pass"), &OpenPGPParams{S2K: OpenPGPS2KIterated, S2KCount: 0x10})
+	// replace the S2K type, after the packet header and the version,
+	// count, cipher, AEAD and S2K size octets
+	damaged := append([]byte{}, message...)
+	if damaged[7] != pgpS2KIterated {
+		t.Fatalf("Failed. Unexpected S2K type %d", damaged[7])
+	}
+	damaged[7] = 100
+	if _, err := pgpDecrypt(damaged, []byte("pass")); err == nil || !strings.Contains(err.Error(), "S2K type") {
+		t.Errorf("Failed. Expected an unknown S2K to be rejected, got %v", err)
+	}
+
+	// an Argon2 cost above the limit is refused before deriving the key
+	message = pgpEncrypt(t, []byte("hello"), []byte("pass"), &OpenPGPParams{Argon2Passes: 1, Argon2Parallelism: 1, Argon2Memory: 3})
+	damaged = append([]byte{}, message...)
+	memory := 7 + 1 + pgpArgon2SaltSize + 2
+	if damaged[7] != pgpS2KArgon2 || damaged[memory] != 3 {
+		t.Fatalf("Failed. Unexpected Argon2 S2K specifier")
+	}
+	damaged[memory] = pgpMaxArgon2Memory + 1
+	if _, err := pgpDecrypt(damaged, []byte("pass")); err == nil || !strings.Contains(err.Error(), "Argon2") {
+		t.Errorf("Failed. Expected excessive Argon2 memory to be rejected, got %v", err)
+	}
+
+	for _, params := range []*OpenPGPParams{
+		{KeySize: 20}, {ChunkSize: 1000}, {ChunkSize: 1 << 23}, {S2K: 2},
+		{Argon2Parallelism: 4, Argon2Memory: 4}, {Argon2Memory: pgpMaxArgon2Memory + 1}, {Argon2Passes: pgpMaxArgon2Passes + 1},
+	} {
+		if _, err := NewOpenPGPEncryptWriter(ioutil.Discard, []byte("pass"), params); err == nil {
+			t.Errorf("Params %+v failed. Expected an error", params)
+		}
+	}
+}
+
+// TestS2KIterated checks the iteration count encoding of RFC 9580 section
+// 3.7.1.3 against a direct implementation.
+func TestS2KIterated(t *testing.T) {
+	salt := []byte("saltsalt")
+	pass := []byte("pw")
+	key := s2kIterated(sha256.New, pass, salt, 0x00, 32)
+	// a coded count of 0 hashes 1024 bytes of the repeated salt and passphrase
+	var input []byte
+	for len(input) < 1024 {
+		input = append(input, salt...)
+		input = append(input, pass...)
+	}
+	h := sha256.New()
+	h.Write(input[:1024])
+	if !bytes.Equal(key, h.Sum(nil)) {
+		t.Errorf("Failed. S2K key differs")
+	}
+}
+
+// TestOpenPGPInterop decrypts a message written by another OpenPGP
+// implementation, see testdata/openpgp.
+func TestOpenPGPInterop(t *testing.T) {
+	message, err := ioutil.ReadFile(filepath.Join("testdata", "openpgp", "argon2-gcm.pgp"))
+	if err != nil {
+		t.Fatalf("Failed to read message: %s", err)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "openpgp", "argon2-gcm.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read plaintext: %s", err)
+	}
+	out, err := pgpDecrypt(message, []byte("password"))
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Failed. Plaintext differs")
+	}
+	if _, err := pgpDecrypt(message, []byte("Password")); err != ErrWrongKey {
+		t.Errorf("Failed. Expected ErrWrongKey, got %v", err)
+	}
+}
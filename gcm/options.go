@@ -0,0 +1,167 @@
+package gcm
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Options configures optional behavior of the encryption and decryption
+// streams. A nil *Options is valid and selects the defaults.
+type Options struct {
+	// Progress, if set, is called after every chunk is sealed or opened.
+	Progress ProgressFunc
+
+	// Size is the total number of input bytes, if known. It is only used
+	// for progress reporting; zero means the size is unknown.
+	Size int64
+
+	// Metadata, if set, is encrypted into a record at the start of the
+	// stream. EncryptFile fills in any unset fields from the input file.
+	Metadata *Metadata
+
+	// Compression selects how the plaintext is compressed before it is
+	// encrypted. The exact size of compressed output cannot be calculated
+	// in advance.
+	Compression Compression
+
+	// Padding hides the exact plaintext size by padding the stream.
+	Padding Padding
+
+	// KeyCommitment stores a commitment to the key in the stream header,
+	// so decryption with a wrong key fails with ErrWrongKey before any
+	// chunk is read.
+	KeyCommitment bool
+	// RequireKeyCommitment makes decryption fail with ErrNoKeyCommitment if
+	// the stream has no key commitment, so a stream crafted to decrypt
+	// under more than one key cannot simply leave it out.
+	RequireKeyCommitment bool
+
+	// Merkle appends a trailer with the root of a Merkle tree over the
+	// ciphertext chunks, so single chunks can be proven to belong to the
+	// stream without the key. See ReadMerkleTree.
+	Merkle bool
+
+	// SigningKey, if set, signs the stream so its producer can be verified
+	// by holders of the public key.
+	SigningKey ed25519.PrivateKey
+	// TrustedKeys, if set, requires decrypted streams to be signed by one of
+	// the keys. The signature is checked when the stream is closed.
+	TrustedKeys []ed25519.PublicKey
+
+	// ErrorCorrection adds Reed-Solomon parity over the ciphertext chunks,
+	// so decryption can repair a limited number of damaged chunks.
+	ErrorCorrection ErrorCorrection
+
+	// Armor makes EncryptFile write the stream in ASCII armor. Streams can
+	// be armored with NewArmorWriter. Decryption detects armor by itself.
+	Armor bool
+}
+
+// needsHeader reports whether the options require a stream header.
+func (o *Options) needsHeader() bool {
+	return o != nil && (o.Metadata != nil || o.Compression != CompressionNone || o.Padding.enabled() || o.KeyCommitment || o.Merkle || o.SigningKey != nil || o.ErrorCorrection.enabled())
+}
+
+// header returns the stream header for the options along with the encoded
+// metadata, if any.
+func (o *Options) header() (*header, []byte, error) {
+	h := &header{}
+	var meta []byte
+	if o.Metadata != nil {
+		var err error
+		if meta, err = json.Marshal(o.Metadata); err != nil {
+			return nil, nil, err
+		}
+		if len(meta)+tagSize > maxMetadataSize {
+			return nil, nil, errors.New("The metadata is larger than 64 KiB")
+		}
+		h.metadataSize = uint32(len(meta) + tagSize)
+	}
+	if !o.Compression.valid() {
+		return nil, nil, fmt.Errorf("Unsupported compression %s", o.Compression)
+	}
+	h.compression = o.Compression
+	if err := o.Padding.validate(); err != nil {
+		return nil, nil, err
+	}
+	h.merkle = o.Merkle
+	if o.ErrorCorrection.enabled() {
+		if err := o.ErrorCorrection.validate(); err != nil {
+			return nil, nil, err
+		}
+		h.fec = o.ErrorCorrection
+	}
+	if o.SigningKey != nil {
+		h.signer = o.SigningKey.Public().(ed25519.PublicKey)
+	}
+	if o.KeyCommitment {
+		// only the size matters here; the real value is set by the reader
+		h.commitment = make([]byte, commitmentSize)
+	}
+	if o.Padding.Scheme == PaddingPadme {
+		// the bucket size is only meaningful for PaddingBuckets
+		h.padding = Padding{Scheme: PaddingPadme}
+	} else {
+		h.padding = o.Padding
+	}
+	return h, meta, nil
+}
+
+// withSize returns a copy of the options with the input size set.
+func (o *Options) withSize(size int64) *Options {
+	c := Options{}
+	if o != nil {
+		c = *o
+	}
+	c.Size = size
+	return &c
+}
+
+func (o *Options) progressTracker() progressTracker {
+	if o == nil {
+		return progressTracker{}
+	}
+	return progressTracker{fn: o.Progress, total: o.Size}
+}
+
+// overhead returns the number of bytes that precede the first chunk and
+// follow the final chunk.
+func (o *Options) overhead() (int64, error) {
+	if !o.needsHeader() {
+		return 0, nil
+	}
+	h, _, err := o.header()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(h.marshal())) + int64(h.metadataSize) + int64(h.trailerSize()), nil
+}
+
+func (o *Options) compressed() bool {
+	return o != nil && o.Compression != CompressionNone
+}
+
+func (o *Options) padded() bool {
+	return o != nil && o.Padding.enabled()
+}
+
+func (o *Options) corrected() bool {
+	return o != nil && o.ErrorCorrection.enabled()
+}
+
+func (o *Options) trustedKeys() []ed25519.PublicKey {
+	if o == nil {
+		return nil
+	}
+	return o.TrustedKeys
+}
+
+func (o *Options) requiresCommitment() bool {
+	return o != nil && o.RequireKeyCommitment
+}
+
+func (o *Options) armored() bool {
+	return o != nil && o.Armor
+}
@@ -0,0 +1,205 @@
+package gcm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// PaddingScheme selects how the length of the plaintext is hidden.
+type PaddingScheme uint8
+
+const (
+	// PaddingNone adds no padding, so the exact plaintext size can be
+	// derived from the ciphertext size.
+	PaddingNone PaddingScheme = iota
+	// PaddingBuckets pads the plaintext up to a multiple of a bucket size.
+	PaddingBuckets
+	// PaddingPadme pads the plaintext as described in "Reducing Metadata
+	// Leakage from Encrypted Files and Communication with PURBs", leaking
+	// O(log log n) bits of the size with at most 12% overhead.
+	PaddingPadme
+)
+
+// Padding configures length-hiding padding. Padded streams end with zero
+// bytes followed by the 8 byte big-endian length of the unpadded plaintext,
+// all inside the final authenticated chunks, and the decryptor strips them.
+// Any two plaintexts whose padded lengths are equal encrypt to the same size.
+type Padding struct {
+	Scheme PaddingScheme
+	// BucketSize is the multiple that streams are padded to when using
+	// PaddingBuckets.
+	BucketSize int64
+}
+
+// paddingTrailerSize is the size of the length that ends a padded stream.
+const paddingTrailerSize = 8
+
+func (p Padding) enabled() bool {
+	return p.Scheme != PaddingNone
+}
+
+func (p Padding) validate() error {
+	switch p.Scheme {
+	case PaddingNone, PaddingPadme:
+		return nil
+	case PaddingBuckets:
+		if p.BucketSize <= 0 {
+			return fmt.Errorf("Invalid padding bucket size %d", p.BucketSize)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown padding scheme %d", p.Scheme)
+}
+
+// paddedSize returns the padded length of a stream holding size bytes of
+// plaintext, including the trailer.
+func (p Padding) paddedSize(size int64) int64 {
+	n := size + paddingTrailerSize
+	switch p.Scheme {
+	case PaddingBuckets:
+		if rem := n % p.BucketSize; rem != 0 {
+			n += p.BucketSize - rem
+		}
+	case PaddingPadme:
+		n = padme(n)
+	}
+	return n
+}
+
+// padme rounds n up so that only the top O(log log n) bits may be set.
+func padme(n int64) int64 {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len64(uint64(n)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<uint(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// padReader appends padding and the length trailer to the data read from
+// src.
+type padReader struct {
+	src     io.Reader
+	padding Padding
+
+	n       int64
+	eof     bool
+	tail    []byte
+	pending int64
+}
+
+func (r *padReader) Read(p []byte) (int, error) {
+	if !r.eof {
+		n, err := r.src.Read(p)
+		r.n += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+		r.eof = true
+		r.pending = r.padding.paddedSize(r.n) - r.n - paddingTrailerSize
+		r.tail = binary.BigEndian.AppendUint64(nil, uint64(r.n))
+		if n > 0 {
+			return n, nil
+		}
+	}
+	off := 0
+	for off < len(p) && r.pending > 0 {
+		p[off] = 0
+		off++
+		r.pending--
+	}
+	read := copy(p[off:], r.tail)
+	r.tail = r.tail[read:]
+	off += read
+	if off == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return off, nil
+}
+
+// padStripper removes the padding and trailer from a padded stream before
+// passing it to dst. It holds back the last trailer-sized bytes and only
+// counts runs of zeros, so padding of any size needs no buffering.
+type padStripper struct {
+	dst     io.Writer
+	padding Padding
+
+	tail    []byte
+	zeros   int64
+	written int64
+}
+
+func (s *padStripper) Write(p []byte) (int, error) {
+	n := len(p)
+	buf := append(s.tail, p...)
+	if len(buf) <= paddingTrailerSize {
+		s.tail = buf
+		return n, nil
+	}
+	out := buf[:len(buf)-paddingTrailerSize]
+	s.tail = append([]byte{}, buf[len(buf)-paddingTrailerSize:]...)
+
+	// everything up to the last nonzero byte is plaintext
+	last := len(out) - 1
+	for last >= 0 && out[last] == 0 {
+		last--
+	}
+	if last >= 0 {
+		if err := s.flushZeros(s.zeros); err != nil {
+			return 0, err
+		}
+		if _, err := s.dst.Write(out[:last+1]); err != nil {
+			return 0, err
+		}
+		s.written += int64(last + 1)
+	}
+	s.zeros += int64(len(out) - last - 1)
+	return n, nil
+}
+
+// Close verifies the trailer and padding length and writes any zeros that
+// belong to the plaintext.
+func (s *padStripper) Close() error {
+	if len(s.tail) != paddingTrailerSize {
+		return errors.New("The padded stream is truncated")
+	}
+	size := int64(binary.BigEndian.Uint64(s.tail))
+	total := s.written + s.zeros + paddingTrailerSize
+	if size < s.written || size > s.written+s.zeros || s.padding.paddedSize(size) != total {
+		return errors.New("Invalid padding")
+	}
+	return s.flushZeros(size - s.written)
+}
+
+func (s *padStripper) flushZeros(n int64) error {
+	var zeros [4096]byte
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		if _, err := s.dst.Write(zeros[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+		s.zeros -= chunk
+		s.written += chunk
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,83 @@
+package gcm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var paddingTestData = []struct {
+	padding Padding
+	sizes   []int
+}{
+	{Padding{Scheme: PaddingBuckets, BucketSize: 4096}, []int{0, 1, 100, 4096 - paddingTrailerSize}},
+	{Padding{Scheme: PaddingBuckets, BucketSize: chunkSize}, []int{1, chunkSize / 2, chunkSize - paddingTrailerSize}},
+	{Padding{Scheme: PaddingPadme}, []int{1000 - paddingTrailerSize, 1010 - paddingTrailerSize, 1024 - paddingTrailerSize}},
+}
+
+func TestPadding(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	for _, test := range paddingTestData {
+		opts := &Options{Padding: test.padding}
+		expected := -1
+		for _, size := range test.sizes {
+			// end with zeros to make sure they are not mistaken for padding
+			plainText := bytes.Repeat([]byte{1, 0, 0}, size/3+1)[:size]
+			r, err := NewEncryptReaderWithOptions(bytes.NewReader(plainText), key, iv, nil, opts)
+			if err != nil {
+				t.Fatalf("Failed to create reader: %s", err)
+			}
+			cipherText, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("%+v size %d encryption failed: %s", test.padding, size, err)
+				continue
+			}
+			if expected == -1 {
+				expected = len(cipherText)
+			}
+			if len(cipherText) != expected {
+				t.Errorf("%+v size %d failed. Ciphertext size %d != %d", test.padding, size, len(cipherText), expected)
+			}
+			if total := r.CalculateTotalSize(size); total != len(cipherText) {
+				t.Errorf("%+v size %d failed. CalculateTotalSize %d != %d", test.padding, size, total, len(cipherText))
+			}
+
+			var out bytes.Buffer
+			w, err := NewDecryptWriteCloser(nopCloser{&out}, key, iv, nil)
+			if err != nil {
+				t.Fatalf("Failed to create writer: %s", err)
+			}
+			if _, err := w.Write(cipherText); err != nil {
+				t.Errorf("%+v size %d decryption failed: %s", test.padding, size, err)
+				continue
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("%+v size %d decryption failed: %s", test.padding, size, err)
+				continue
+			}
+			if !bytes.Equal(out.Bytes(), plainText) {
+				t.Errorf("%+v size %d failed. Plaintext differs", test.padding, size)
+			}
+		}
+	}
+}
+
+func TestPadme(t *testing.T) {
+	for n := int64(1); n < 1<<20; n = n*3/2 + 1 {
+		padded := padme(n)
+		if padded < n || float64(padded-n) > 0.12*float64(n)+1 {
+			t.Errorf("padme(%d) = %d", n, padded)
+		}
+	}
+	if padded := padme(1000); padded != 1024 {
+		t.Errorf("padme(1000) = %d, expected 1024", padded)
+	}
+}
+
+func TestInvalidPadding(t *testing.T) {
+	opts := &Options{Padding: Padding{Scheme: PaddingBuckets}}
+	if _, err := NewEncryptReaderWithOptions(bytes.NewReader(nil), make([]byte, 32), make([]byte, 12), nil, opts); err == nil {
+		t.Error("Expected a bucket size of zero to be rejected")
+	}
+}
@@ -0,0 +1,39 @@
+package gcm
+
+// Progress describes how much of a stream has been processed so far.
+type Progress struct {
+	// Chunks is the number of chunks sealed or opened.
+	Chunks int64
+	// Bytes is the number of input bytes consumed: plaintext bytes when
+	// encrypting and ciphertext bytes when decrypting.
+	Bytes int64
+	// Total is the total number of input bytes, or zero if unknown.
+	Total int64
+}
+
+// ProgressFunc receives progress updates from an EncryptReader or
+// DecryptWriteCloser. It is called synchronously after each chunk, so it
+// should return quickly.
+type ProgressFunc func(Progress)
+
+type progressTracker struct {
+	fn    ProgressFunc
+	total int64
+
+	chunks int64
+	bytes  int64
+}
+
+func (t *progressTracker) chunk(n int) {
+	if t.fn == nil {
+		return
+	}
+	t.chunks++
+	t.bytes += int64(n)
+	t.fn(Progress{Chunks: t.chunks, Bytes: t.bytes, Total: t.total})
+}
+
+// skip counts input bytes that are not part of a chunk, such as a header.
+func (t *progressTracker) skip(n int) {
+	t.bytes += int64(n)
+}
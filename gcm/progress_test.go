@@ -0,0 +1,52 @@
+package gcm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	plainText := make([]byte, 2*chunkSize+100)
+
+	var updates []Progress
+	opts := &Options{
+		Progress: func(p Progress) { updates = append(updates, p) },
+		Size:     int64(len(plainText)),
+	}
+	r, err := NewEncryptReaderWithOptions(bytes.NewReader(plainText), key, iv, nil, opts)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %s", err)
+	}
+	cipherText, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if len(updates) != 3 {
+		t.Fatalf("Expected 3 encryption progress updates, got %d", len(updates))
+	}
+	last := updates[len(updates)-1]
+	if last.Chunks != 3 || last.Bytes != int64(len(plainText)) || last.Total != int64(len(plainText)) {
+		t.Errorf("Unexpected final encryption progress: %+v", last)
+	}
+
+	updates = nil
+	opts.Size = int64(len(cipherText))
+	var out bytes.Buffer
+	w, err := NewDecryptWriteCloserWithOptions(nopCloser{&out}, key, iv, nil, opts)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %s", err)
+	}
+	if _, err := w.Write(cipherText); err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	last = updates[len(updates)-1]
+	if last.Chunks != 3 || last.Bytes != int64(len(cipherText)) {
+		t.Errorf("Unexpected final decryption progress: %+v", last)
+	}
+}
@@ -0,0 +1,154 @@
+package gcm
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Chunks sit at fixed offsets and are sealed with IVs given by their index,
+// so any chunk can be decrypted on its own. A stream whose last chunk is
+// shorter than the chunk size, as every complete stream's is, can therefore
+// be read at random without decrypting what comes before.
+
+// DecryptReaderAt decrypts an encrypted stream at random, one chunk at a
+// time. Every chunk read is authenticated, and the stream's size is checked
+// against its final chunk, but trailers such as a signature are not checked.
+// It is safe for concurrent use.
+type DecryptReaderAt struct {
+	src  io.ReaderAt
+	gcm  cipher.AEAD
+	iv   []byte
+	aad  []byte
+	off  int64
+	body int64
+	size int64
+
+	metadata *Metadata
+
+	// the last chunk decrypted, kept for sequential reads
+	mu     sync.Mutex
+	index  int64
+	opened []byte
+}
+
+// NewDecryptReaderAt creates a DecryptReaderAt over the size bytes of
+// encrypted stream in src. Streams with compression, padding or error
+// correction cannot be read at random.
+func NewDecryptReaderAt(src io.ReaderAt, size int64, key, iv, aad []byte) (*DecryptReaderAt, error) {
+	gcm, err := newGCM(key, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	r := &DecryptReaderAt{src: src, gcm: gcm, iv: append([]byte{}, iv...), aad: aad, index: -1}
+
+	var trailer int64
+	prefix := make([]byte, headerPrefixSize)
+	if n, _ := src.ReadAt(prefix, 0); n == len(prefix) && hasHeaderMagic(prefix) {
+		hdrSize, err := headerSizeFromPrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		hdr := make([]byte, hdrSize)
+		if _, err := src.ReadAt(hdr, 0); err != nil {
+			return nil, errors.New("The stream header is truncated")
+		}
+		h, err := parseHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if h.compression != CompressionNone || h.padding.enabled() || h.fec.enabled() {
+			return nil, errors.New("Streams with compression, padding or error correction cannot be read at random")
+		}
+		if h.commitment != nil {
+			commitment, err := keyCommitment(key, iv)
+			if err != nil {
+				return nil, err
+			}
+			if !hmac.Equal(commitment, h.commitment) {
+				return nil, ErrWrongKey
+			}
+		}
+		r.aad = append(append([]byte{}, aad...), hdr...)
+		r.off = int64(hdrSize)
+		trailer = int64(h.trailerSize())
+		if h.metadataSize > 0 {
+			sealed := make([]byte, h.metadataSize)
+			if _, err := src.ReadAt(sealed, r.off); err != nil {
+				return nil, errors.New("The stream is truncated")
+			}
+			opened, err := gcm.Open(nil, r.iv, sealed, r.aad)
+			if err != nil {
+				return nil, err
+			}
+			r.metadata = &Metadata{}
+			if err := json.Unmarshal(opened, r.metadata); err != nil {
+				return nil, err
+			}
+			incrementIV(r.iv)
+			r.off += int64(h.metadataSize)
+		}
+	}
+	r.body = size - r.off - trailer
+	if r.size, err = PlaintextSize(r.body, nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *DecryptReaderAt) Size() int64 {
+	return r.size
+}
+
+// Metadata returns the metadata of the stream, or nil if it has none.
+func (r *DecryptReaderAt) Metadata() *Metadata {
+	return r.metadata
+}
+
+func (r *DecryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Invalid offset %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		index := off / chunkSize
+		read, err := r.readChunk(p[n:], index, off-index*chunkSize)
+		if err != nil {
+			return n, err
+		}
+		n += read
+		off += int64(read)
+	}
+	return n, nil
+}
+
+// readChunk copies the plaintext of chunk index from offset off into p.
+func (r *DecryptReaderAt) readChunk(p []byte, index, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if index != r.index {
+		start := index * (chunkSize + tagSize)
+		sealed := make([]byte, chunkSize+tagSize)
+		if rest := r.body - start; rest < int64(len(sealed)) {
+			sealed = sealed[:rest]
+		}
+		if _, err := r.src.ReadAt(sealed, r.off+start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		opened, err := r.gcm.Open(sealed[:0], advanceIV(r.iv, int(index)), sealed, r.aad)
+		if err != nil {
+			return 0, fmt.Errorf("Chunk %d failed to authenticate", index)
+		}
+		r.index = index
+		r.opened = opened
+	}
+	return copy(p, r.opened[off:]), nil
+}
@@ -0,0 +1,64 @@
+package gcm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDecryptReaderAt(t *testing.T) {
+	key := make([]byte, 32)
+	iv := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xfe}
+	plainText := make([]byte, 3*chunkSize+777)
+	for i := range plainText {
+		plainText[i] = byte(i % 239)
+	}
+	for _, opts := range []*Options{nil, {Metadata: &Metadata{Name: "x"}, Merkle: true}} {
+		cipherText := encryptBytes(t, plainText, key, iv, opts)
+		r, err := NewDecryptReaderAt(bytes.NewReader(cipherText), int64(len(cipherText)), key, iv, nil)
+		if err != nil {
+			t.Fatalf("NewDecryptReaderAt failed: %s", err)
+		}
+		if r.Size() != int64(len(plainText)) {
+			t.Fatalf("Failed. Expected size %d, got %d", len(plainText), r.Size())
+		}
+		if opts != nil && (r.Metadata() == nil || r.Metadata().Name != "x") {
+			t.Errorf("Failed. Expected the metadata")
+		}
+		for _, c := range []struct{ off, n int }{{0, 10}, {chunkSize - 5, 10}, {2*chunkSize + 1, chunkSize + 700}, {3 * chunkSize, 777}} {
+			buf := make([]byte, c.n)
+			n, err := r.ReadAt(buf, int64(c.off))
+			if err != nil && err != io.EOF {
+				t.Fatalf("ReadAt failed: %s", err)
+			}
+			if n != c.n || !bytes.Equal(buf, plainText[c.off:c.off+c.n]) {
+				t.Errorf("Failed. ReadAt(%d, %d) returned different data", c.off, c.n)
+			}
+		}
+		if n, err := r.ReadAt(make([]byte, 10), int64(len(plainText))-4); n != 4 || err != io.EOF {
+			t.Errorf("Failed. Expected a short read at the end, got %d, %v", n, err)
+		}
+	}
+
+	cipherText := encryptBytes(t, plainText, key, iv, nil)
+	if _, err := NewDecryptReaderAt(bytes.NewReader(cipherText), 2*(chunkSize+tagSize), key, iv, nil); err == nil {
+		t.Errorf("Failed. Expected a stream cut at a chunk boundary to be rejected")
+	}
+	// swapped chunks fail to authenticate
+	swapped := append([]byte{}, cipherText...)
+	copy(swapped, cipherText[chunkSize+tagSize:2*(chunkSize+tagSize)])
+	r, err := NewDecryptReaderAt(bytes.NewReader(swapped), int64(len(swapped)), key, iv, nil)
+	if err != nil {
+		t.Fatalf("NewDecryptReaderAt failed: %s", err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Errorf("Failed. Expected a swapped chunk to fail")
+	}
+	if _, err := NewDecryptReaderAt(bytes.NewReader(cipherText), int64(len(cipherText)), key, iv, nil); err != nil {
+		t.Errorf("NewDecryptReaderAt failed: %s", err)
+	}
+	compressed := encryptBytes(t, plainText, key, iv, &Options{Compression: CompressionGzip})
+	if _, err := NewDecryptReaderAt(bytes.NewReader(compressed), int64(len(compressed)), key, iv, nil); err == nil {
+		t.Errorf("Failed. Expected compressed streams to be rejected")
+	}
+}
@@ -0,0 +1,230 @@
+package gcm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"os"
+)
+
+// Chunk n of a stream holds the plaintext at offset n*chunkSize and is sealed
+// with IV+n, so an interrupted encryption or decryption can be continued from
+// the last complete chunk of its output. Every complete chunk is
+// authenticated and compared with the input first, since sealing different
+// plaintext with an IV already used would leak both, and output kept from a
+// changed input would not match it. This reads back the work already done,
+// which is still much cheaper than redoing it.
+//
+// Resuming cannot recover the state of compression, padding, error
+// correction, Merkle trees or signatures, so those options are not supported,
+// and neither is armor.
+
+var (
+	errCannotResume = errors.New("The existing output does not match the input, key and options, so it cannot be resumed")
+	errNotResumable = errors.New("Streams with compression, padding, error correction, a Merkle trailer, a signature or armor cannot be resumed")
+)
+
+// checkResumable returns an error if a stream with the options cannot be
+// resumed.
+func checkResumable(opts *Options) error {
+	if opts.compressed() || opts.padded() || opts.corrected() || opts.armored() || (opts != nil && (opts.Merkle || opts.SigningKey != nil)) {
+		return errNotResumable
+	}
+	return nil
+}
+
+// ResumeEncryptFile continues an EncryptFileWithOptions of the same input,
+// key, IV and options that was interrupted, keeping the complete chunks
+// already written to outFilePath. The input must not have changed. If the
+// output does not exist, the whole file is encrypted.
+func ResumeEncryptFile(inFilePath, outFilePath string, key, iv, aad []byte, opts *Options) error {
+	if err := checkResumable(opts); err != nil {
+		return err
+	}
+	inFile, r, err := openEncryptReader(inFilePath, key, iv, aad, opts)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	outFile, err := os.OpenFile(outFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	info, err := outFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the header and metadata record are queued to be read first
+	prefix := r.sealed
+	off := int64(0)
+	if info.Size() >= int64(len(prefix)) && info.Size() > 0 {
+		existing := make([]byte, len(prefix))
+		if _, err := outFile.ReadAt(existing, 0); err != nil {
+			return err
+		}
+		if !bytes.Equal(existing, prefix) {
+			return errCannotResume
+		}
+		n := int((info.Size() - int64(len(prefix))) / (chunkSize + tagSize))
+		if !chunksMatch(r.gcm, r.iv, r.aad, outFile, inFile, int64(len(prefix)), n) {
+			return errCannotResume
+		}
+		if _, err := inFile.Seek(int64(n)*chunkSize, io.SeekStart); err != nil {
+			return err
+		}
+		r.skipChunks(n)
+		off = int64(len(prefix)) + int64(n)*(chunkSize+tagSize)
+	}
+	if err := outFile.Truncate(off); err != nil {
+		return err
+	}
+	if _, err := outFile.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(outFile, r)
+	return err
+}
+
+// chunksMatch reports whether the first n chunks of the stream in sealed,
+// whose chunks start at offset start, open to the start of plain.
+func chunksMatch(gcm cipher.AEAD, iv, aad []byte, sealed, plain io.ReaderAt, start int64, n int) bool {
+	chunk := make([]byte, chunkSize+tagSize)
+	opened := make([]byte, 0, chunkSize)
+	expected := make([]byte, chunkSize)
+	nonce := append([]byte{}, iv...)
+	for i := 0; i < n; i++ {
+		if _, err := sealed.ReadAt(chunk, start+int64(i)*int64(len(chunk))); err != nil {
+			return false
+		}
+		var err error
+		if opened, err = gcm.Open(opened[:0], nonce, chunk, aad); err != nil {
+			return false
+		}
+		if _, err := plain.ReadAt(expected, int64(i)*chunkSize); err != nil {
+			return false
+		}
+		if !bytes.Equal(opened, expected) {
+			return false
+		}
+		incrementIV(nonce)
+	}
+	return true
+}
+
+// skipChunks drops the queued prefix and moves on n chunks, whose input
+// the caller has skipped.
+func (r *EncryptReader) skipChunks(n int) {
+	r.sealed = nil
+	r.off = 0
+	r.iv = advanceIV(r.iv, n)
+	r.progress.skip(n * chunkSize)
+}
+
+// ResumeDecryptFile continues a DecryptFileWithOptions of the same input,
+// key, IV and options that was interrupted, keeping the complete chunks of
+// plaintext already written to outFilePath. If the output does not exist,
+// the whole file is decrypted. Unlike DecryptFileWithOptions, outFilePath
+// must be a file, and plaintext is written before it is authenticated.
+func ResumeDecryptFile(inFilePath, outFilePath string, key, iv, aad []byte, opts *Options) error {
+	if err := checkResumable(opts); err != nil {
+		return err
+	}
+	inFile, err := os.Open(inFilePath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	if isArmored(bufio.NewReader(io.NewSectionReader(inFile, 0, inInfo.Size()))) {
+		return errNotResumable
+	}
+	prefix, err := readStreamPrefix(inFile)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.OpenFile(outFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	info, err := outFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	w, err := NewDecryptWriteCloserWithOptions(outFile, key, iv, aad, opts.withSize(inInfo.Size()))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	if h := w.header; h != nil && (h.compression != CompressionNone || h.padding.enabled() || h.fec.enabled() || h.merkle || h.signer != nil) {
+		return errNotResumable
+	}
+
+	n := int(info.Size() / chunkSize)
+	if !chunksMatch(w.gcm, w.iv, w.aad, inFile, outFile, int64(len(prefix)), n) {
+		return errCannotResume
+	}
+	if w.hash != nil {
+		if _, err := io.Copy(w.hash, io.NewSectionReader(outFile, 0, int64(n)*chunkSize)); err != nil {
+			return err
+		}
+	}
+	if err := outFile.Truncate(int64(n) * chunkSize); err != nil {
+		return err
+	}
+	if _, err := outFile.Seek(int64(n)*chunkSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := inFile.Seek(int64(len(prefix))+int64(n)*(chunkSize+tagSize), io.SeekStart); err != nil {
+		return err
+	}
+	w.skipChunks(n)
+	if _, err := io.Copy(w, inFile); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// skipChunks moves on n chunks, whose input the caller has skipped.
+func (w *DecryptWriteCloser) skipChunks(n int) {
+	w.iv = advanceIV(w.iv, n)
+	w.progress.skip(n * (chunkSize + tagSize))
+}
+
+// readStreamPrefix returns the header of the stream in src and the metadata
+// record that follows it, or nothing if the stream has no header.
+func readStreamPrefix(src io.ReaderAt) ([]byte, error) {
+	prefix := make([]byte, headerPrefixSize)
+	if n, _ := src.ReadAt(prefix, 0); n < len(prefix) || !hasHeaderMagic(prefix) {
+		return nil, nil
+	}
+	hdrSize, err := headerSizeFromPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, hdrSize)
+	if _, err := src.ReadAt(hdr, 0); err != nil {
+		return nil, errors.New("The stream header is truncated")
+	}
+	h, err := parseHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = make([]byte, hdrSize+int(h.metadataSize))
+	if _, err := src.ReadAt(prefix, 0); err != nil {
+		return nil, errors.New("The stream is truncated")
+	}
+	return prefix, nil
+}
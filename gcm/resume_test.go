@@ -0,0 +1,106 @@
+package gcm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcm-resume")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	key := make([]byte, 32)
+	iv := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xfe}
+	plainText := make([]byte, 4*chunkSize+321)
+	for i := range plainText {
+		plainText[i] = byte(i % 251)
+	}
+	in := filepath.Join(dir, "in")
+	enc := filepath.Join(dir, "enc")
+	dec := filepath.Join(dir, "dec")
+	ioutil.WriteFile(in, plainText, 0600)
+
+	for _, opts := range []*Options{nil, {Metadata: &Metadata{}, KeyCommitment: true}} {
+		if err := EncryptFileWithOptions(in, enc, key, iv, nil, opts); err != nil {
+			t.Fatalf("EncryptFileWithOptions failed: %s", err)
+		}
+		full, _ := ioutil.ReadFile(enc)
+
+		// cut off in the middle of the header, a chunk and the final chunk
+		for _, cut := range []int{0, 5, 2*(chunkSize+tagSize) + 100, len(full) - 3, len(full)} {
+			ioutil.WriteFile(enc, full[:cut], 0600)
+			if err := ResumeEncryptFile(in, enc, key, iv, nil, opts); err != nil {
+				t.Fatalf("ResumeEncryptFile failed after %d bytes: %s", cut, err)
+			}
+			if resumed, _ := ioutil.ReadFile(enc); !bytes.Equal(resumed, full) {
+				t.Errorf("Failed. Resumed encryption after %d bytes differs", cut)
+			}
+		}
+
+		for _, cut := range []int{0, 100, 3*chunkSize + 1, len(plainText)} {
+			ioutil.WriteFile(dec, plainText[:cut], 0600)
+			if err := ResumeDecryptFile(enc, dec, key, iv, nil, opts); err != nil {
+				t.Fatalf("ResumeDecryptFile failed after %d bytes: %s", cut, err)
+			}
+			if resumed, _ := ioutil.ReadFile(dec); !bytes.Equal(resumed, plainText) {
+				t.Errorf("Failed. Resumed decryption after %d bytes differs", cut)
+			}
+		}
+	}
+}
+
+func TestResumeMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcm-resume")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	plainText := bytes.Repeat([]byte{1}, 3*chunkSize)
+	in := filepath.Join(dir, "in")
+	enc := filepath.Join(dir, "enc")
+	dec := filepath.Join(dir, "dec")
+	ioutil.WriteFile(in, plainText, 0600)
+	if err := EncryptFile(in, enc, key, iv, nil); err != nil {
+		t.Fatalf("EncryptFile failed: %s", err)
+	}
+	full, _ := ioutil.ReadFile(enc)
+	ioutil.WriteFile(enc, full[:2*(chunkSize+tagSize)+10], 0600)
+
+	// the input changed, so continuing would reuse IVs for new plaintext
+	changed := append([]byte{}, plainText...)
+	changed[chunkSize+1] = 2
+	ioutil.WriteFile(in, changed, 0600)
+	if err := ResumeEncryptFile(in, enc, key, iv, nil, nil); err != errCannotResume {
+		t.Errorf("Failed. Expected a changed input to be rejected, got %v", err)
+	}
+	if err := ResumeEncryptFile(in, enc, bytes.Repeat([]byte{1}, 32), iv, nil, nil); err != errCannotResume {
+		t.Errorf("Failed. Expected a different key to be rejected, got %v", err)
+	}
+
+	ioutil.WriteFile(dec, changed[:2*chunkSize], 0600)
+	if err := ResumeDecryptFile(enc, dec, key, iv, nil, nil); err != errCannotResume {
+		t.Errorf("Failed. Expected different plaintext to be rejected, got %v", err)
+	}
+	// a change before the last complete chunk is found as well
+	earlier := append([]byte{}, plainText...)
+	earlier[10] = 2
+	ioutil.WriteFile(in, earlier, 0600)
+	if err := ResumeEncryptFile(in, enc, key, iv, nil, nil); err != errCannotResume {
+		t.Errorf("Failed. Expected an input changed in the first chunk to be rejected, got %v", err)
+	}
+	ioutil.WriteFile(dec, earlier[:2*chunkSize], 0600)
+	if err := ResumeDecryptFile(enc, dec, key, iv, nil, nil); err != errCannotResume {
+		t.Errorf("Failed. Expected output changed in the first chunk to be rejected, got %v", err)
+	}
+
+	if err := ResumeEncryptFile(in, enc, key, iv, nil, &Options{Compression: CompressionGzip}); err != errNotResumable {
+		t.Errorf("Failed. Expected compression to be rejected, got %v", err)
+	}
+}
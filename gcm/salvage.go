@@ -0,0 +1,233 @@
+package gcm
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// Every chunk of a stream is sealed on its own, at a fixed offset and with an
+// IV given by its index, so damage to one chunk does not prevent the others
+// from being decrypted. Salvage makes use of this to recover what it can from
+// a damaged file.
+
+// DamagedChunk describes a chunk that failed to authenticate.
+type DamagedChunk struct {
+	// Index is the index of the chunk in the stream.
+	Index int
+	// Offset and Size give the range of the chunk in the encrypted input.
+	Offset int64
+	Size   int64
+	// OutputOffset and OutputSize give the range of the missing plaintext in
+	// the output. OutputSize is zero if damaged chunks are omitted.
+	OutputOffset int64
+	OutputSize   int64
+}
+
+// SalvageReport describes the result of salvaging a stream.
+type SalvageReport struct {
+	// Chunks is the number of chunks found, damaged or not.
+	Chunks int
+	// Damaged lists the chunks that failed to authenticate.
+	Damaged []DamagedChunk
+	// Repaired is the number of damaged chunks of a stream with error
+	// correction that were repaired from its parity.
+	Repaired int
+	// Metadata is the metadata of the stream, if it has any and it
+	// authenticated.
+	Metadata *Metadata
+	// MetadataDamaged reports whether the metadata record failed to
+	// authenticate.
+	MetadataDamaged bool
+	// Truncated reports whether the stream ends with a full chunk, so
+	// chunks are missing from its end.
+	Truncated bool
+	// Written is the number of bytes written to the output.
+	Written int64
+}
+
+// SalvageFile decrypts every chunk of the encrypted file at inFilePath that
+// still authenticates into outFilePath. Damaged chunks are replaced with zeros
+// of the same size, or left out if omitDamaged is set.
+func SalvageFile(inFilePath, outFilePath string, key, iv, aad []byte, omitDamaged bool) (*SalvageReport, error) {
+	inFile, err := os.Open(inFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+	info, err := inFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	outFile, err := os.OpenFile(outFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	report, err := Salvage(outFile, inFile, info.Size(), key, iv, aad, omitDamaged)
+	if err != nil {
+		return nil, err
+	}
+	return report, outFile.Close()
+}
+
+// Salvage decrypts every chunk of the size bytes of encrypted stream in src
+// that still authenticates into dst. Damaged chunks are replaced with zeros of
+// the same size, or left out if omitDamaged is set.
+//
+// The chunks are written as stored, so the output of a compressed or padded
+// stream is the compressed or padded plaintext. Trailers are not checked.
+// Chunks of a stream with error correction are repaired where the parity
+// allows.
+func Salvage(dst io.Writer, src io.ReaderAt, size int64, key, iv, aad []byte, omitDamaged bool) (*SalvageReport, error) {
+	gcm, err := newGCM(key, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	nonce := append([]byte{}, iv...)
+	report := &SalvageReport{}
+
+	// find the chunks after the optional header and metadata
+	var off int64
+	var trailer int64
+	var ec ErrorCorrection
+	prefix := make([]byte, headerPrefixSize)
+	if n, _ := src.ReadAt(prefix, 0); n == len(prefix) && hasHeaderMagic(prefix) {
+		hdrSize, err := headerSizeFromPrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		hdr := make([]byte, hdrSize)
+		if _, err := src.ReadAt(hdr, 0); err != nil {
+			return nil, errors.New("The stream header is truncated")
+		}
+		h, err := parseHeader(hdr)
+		if err != nil {
+			return nil, errors.New("The stream header is damaged")
+		}
+		if h.commitment != nil {
+			commitment, err := keyCommitment(key, iv)
+			if err != nil {
+				return nil, err
+			}
+			if !hmac.Equal(commitment, h.commitment) {
+				return nil, ErrWrongKey
+			}
+		}
+		aad = append(append([]byte{}, aad...), hdr...)
+		off = int64(hdrSize)
+		trailer = int64(h.trailerSize())
+		ec = h.fec
+		if h.metadataSize > 0 {
+			sealed := make([]byte, h.metadataSize)
+			if _, err := src.ReadAt(sealed, off); err != nil {
+				return nil, errors.New("The stream is truncated")
+			}
+			if opened, err := gcm.Open(nil, nonce, sealed, aad); err == nil {
+				meta := &Metadata{}
+				if json.Unmarshal(opened, meta) == nil {
+					report.Metadata = meta
+				}
+			}
+			report.MetadataDamaged = report.Metadata == nil
+			incrementIV(nonce)
+			off += int64(h.metadataSize)
+		}
+	}
+	end := size - trailer
+	if end < off {
+		return nil, errors.New("The stream is truncated")
+	}
+
+	zeros := make([]byte, chunkSize)
+	good := 0
+	// salvage decrypts the next chunk, found at off, or writes zeros in its
+	// place
+	salvage := func(chunk []byte, off int64) error {
+		n := int64(len(chunk))
+		opened, err := gcm.Open(nil, nonce, chunk, aad)
+		if err == nil {
+			if _, err := dst.Write(opened); err != nil {
+				return err
+			}
+			report.Written += int64(len(opened))
+			good++
+		} else {
+			damaged := DamagedChunk{Index: report.Chunks, Offset: off, Size: n, OutputOffset: report.Written}
+			if !omitDamaged && n > tagSize {
+				damaged.OutputSize = n - tagSize
+				if _, err := dst.Write(zeros[:damaged.OutputSize]); err != nil {
+					return err
+				}
+				report.Written += damaged.OutputSize
+			}
+			report.Damaged = append(report.Damaged, damaged)
+		}
+		report.Chunks++
+		report.Truncated = n == chunkSize+tagSize
+		incrementIV(nonce)
+		return nil
+	}
+
+	if ec.enabled() {
+		// damaged chunks are found by opening them into scratch
+		scratch := make([]byte, 0, chunkSize)
+		for first := true; off < end || first; first = false {
+			g, shards := ec.fullGroup(), ec.ParityChunks
+			truncated := false
+			if rest := int(end - off); rest <= ec.fullGroupSize() {
+				last, err := ec.lastGroup(rest)
+				if err != nil {
+					// the parity of a truncated group cannot be found
+					last, shards, truncated = ec.truncatedGroup(rest), 0, true
+				}
+				g = last
+			}
+			buf := make([]byte, g.size(shards))
+			if _, err := src.ReadAt(buf, off); err != nil && err != io.EOF {
+				return nil, err
+			}
+			chunks, parity := g.split(buf, shards)
+			repaired, _ := ec.repair(chunks, parity, func(i int, chunk []byte) bool {
+				_, err := gcm.Open(scratch[:0], advanceIV(nonce, i), chunk, aad)
+				return err == nil
+			})
+			report.Repaired += repaired
+			for _, chunk := range chunks {
+				if err := salvage(chunk, off); err != nil {
+					return nil, err
+				}
+				off += int64(len(chunk))
+			}
+			off += int64(shards * g.parity)
+			if truncated {
+				report.Truncated = true
+				break
+			}
+		}
+	} else {
+		sealed := make([]byte, chunkSize+tagSize)
+		for first := true; off < end || first; first = false {
+			n := end - off
+			if n > chunkSize+tagSize {
+				n = chunkSize + tagSize
+			}
+			chunk := sealed[:n]
+			if _, err := src.ReadAt(chunk, off); err != nil && err != io.EOF {
+				return nil, err
+			}
+			if err := salvage(chunk, off); err != nil {
+				return nil, err
+			}
+			off += n
+		}
+	}
+	if good == 0 && report.Metadata == nil {
+		return nil, errors.New("No chunk could be decrypted. The key or IV may be wrong")
+	}
+	return report, nil
+}
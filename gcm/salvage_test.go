@@ -0,0 +1,85 @@
+package gcm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSalvage(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	plainText := make([]byte, 4*chunkSize+100)
+	for i := range plainText {
+		plainText[i] = byte(i%251 + 1)
+	}
+	for _, opts := range []*Options{nil, {Metadata: &Metadata{Name: "x"}, Merkle: true, KeyCommitment: true}} {
+		cipherText := encryptBytes(t, plainText, key, iv, opts)
+		overhead, _ := opts.overhead()
+		header := int(overhead)
+		if opts.needsHeader() {
+			h, _, _ := opts.header()
+			header -= h.trailerSize()
+		}
+
+		// damage chunk 1 and the final chunk
+		damaged := append([]byte{}, cipherText...)
+		damaged[header+chunkSize+tagSize+10] ^= 1
+		damaged[len(damaged)-1-merkleTrailerSizeIf(opts)] ^= 1
+
+		var out bytes.Buffer
+		report, err := Salvage(&out, bytes.NewReader(damaged), int64(len(damaged)), key, iv, nil, false)
+		if err != nil {
+			t.Fatalf("Salvage failed: %s", err)
+		}
+		if report.Chunks != 5 || len(report.Damaged) != 2 || report.Truncated {
+			t.Fatalf("Failed. Unexpected report %+v", report)
+		}
+		if d := report.Damaged[0]; d.Index != 1 || d.Offset != int64(header+chunkSize+tagSize) || d.OutputOffset != chunkSize || d.OutputSize != chunkSize {
+			t.Errorf("Failed. Unexpected damaged chunk %+v", d)
+		}
+		if d := report.Damaged[1]; d.Index != 4 || d.OutputOffset != 4*chunkSize || d.OutputSize != 100 {
+			t.Errorf("Failed. Unexpected damaged chunk %+v", d)
+		}
+		expected := append([]byte{}, plainText...)
+		copy(expected[chunkSize:2*chunkSize], make([]byte, chunkSize))
+		copy(expected[4*chunkSize:], make([]byte, 100))
+		if !bytes.Equal(out.Bytes(), expected) {
+			t.Errorf("Failed. Salvaged plaintext differs")
+		}
+		if opts != nil && (report.Metadata == nil || report.Metadata.Name != "x") {
+			t.Errorf("Failed. Expected the metadata to be recovered")
+		}
+
+		out.Reset()
+		report, err = Salvage(&out, bytes.NewReader(damaged), int64(len(damaged)), key, iv, nil, true)
+		if err != nil {
+			t.Fatalf("Salvage failed: %s", err)
+		}
+		omitted := append(append([]byte{}, plainText[:chunkSize]...), plainText[2*chunkSize:4*chunkSize]...)
+		if !bytes.Equal(out.Bytes(), omitted) || report.Damaged[1].OutputOffset != 3*chunkSize {
+			t.Errorf("Failed. Salvaged plaintext with omitted chunks differs")
+		}
+
+		// a stream cut at a chunk boundary is reported as truncated
+		cut := damaged[:header+2*(chunkSize+tagSize)+merkleTrailerSizeIf(opts)]
+		report, err = Salvage(&out, bytes.NewReader(cut), int64(len(cut)), key, iv, nil, false)
+		if err != nil {
+			t.Fatalf("Salvage failed: %s", err)
+		}
+		if !report.Truncated {
+			t.Errorf("Failed. Expected truncation to be reported")
+		}
+	}
+
+	cipherText := encryptBytes(t, plainText, key, iv, nil)
+	if _, err := Salvage(&bytes.Buffer{}, bytes.NewReader(cipherText), int64(len(cipherText)), key, make([]byte, 12), []byte("x"), false); err == nil {
+		t.Errorf("Failed. Expected a wrong key to be detected")
+	}
+}
+
+func merkleTrailerSizeIf(opts *Options) int {
+	if opts != nil && opts.Merkle {
+		return merkleTrailerSize
+	}
+	return 0
+}
@@ -0,0 +1,134 @@
+package gcm
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Signed streams name the Ed25519 public key of their producer in the
+// header and end with a signature over the SHA-256 digest of every byte of
+// the stream before it. GCM tags only show that the stream was produced by
+// someone holding the shared key, and anyone holding the key can also craft
+// different chunks that share a tag, so the signature covers the full
+// ciphertext rather than just the tags.
+
+const signatureContext = "gcm signature v1\n"
+
+// ErrUntrustedSigner is returned when a stream is signed by a key that is not
+// in Options.TrustedKeys.
+var ErrUntrustedSigner = errors.New("The stream is signed by an untrusted key")
+
+// ErrNotSigned is returned when Options.TrustedKeys is set but the stream is
+// not signed.
+var ErrNotSigned = errors.New("The stream is not signed")
+
+func newSignatureHash() hash.Hash {
+	return sha256.New()
+}
+
+func signatureMessage(digest hash.Hash) []byte {
+	return append([]byte(signatureContext), digest.Sum(nil)...)
+}
+
+// checkSigner verifies that signer is one of the trusted keys. Any signer is
+// accepted if no trusted keys are given, so the signature still detects
+// corruption.
+func checkSigner(signer []byte, trusted []ed25519.PublicKey) error {
+	if len(trusted) == 0 {
+		return nil
+	}
+	for _, key := range trusted {
+		if key.Equal(ed25519.PublicKey(signer)) {
+			return nil
+		}
+	}
+	return ErrUntrustedSigner
+}
+
+// VerifyFile decrypts and authenticates the file at the specified path
+// without writing the plaintext anywhere, and returns the key that signed it.
+// opts.TrustedKeys should be set, or any valid signature is accepted.
+func VerifyFile(inFilePath string, key, iv, aad []byte, opts *Options) (ed25519.PublicKey, error) {
+	inFile, err := os.Open(inFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+	w, err := NewDecryptWriteCloserWithOptions(nopCloser{ioutil.Discard}, key, iv, aad, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, Dearmor(inFile)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	signer := w.Signer()
+	if signer == nil {
+		return nil, ErrNotSigned
+	}
+	return signer, nil
+}
+
+// GenerateSigningKey creates a new Ed25519 key pair.
+func GenerateSigningKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(nil)
+}
+
+// ReadSigningKey reads a hex encoded Ed25519 seed from the file at the
+// specified path.
+func ReadSigningKey(p string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Invalid signing key in %s", p)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ReadTrustedKeys reads hex encoded Ed25519 public keys, one per line, from
+// the file at the specified path. Blank lines and lines starting with # are
+// ignored.
+func ReadTrustedKeys(p string) ([]ed25519.PublicKey, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseTrustedKeys(f)
+}
+
+func parseTrustedKeys(r io.Reader) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// allow a comment after the key
+		text = strings.Fields(text)[0]
+		key, err := hex.DecodeString(text)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid public key on line %d", line)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
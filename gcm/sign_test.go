@@ -0,0 +1,122 @@
+package gcm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func encryptBytes(t *testing.T, plainText, key, iv []byte, opts *Options) []byte {
+	r, err := NewEncryptReaderWithOptions(bytes.NewReader(plainText), key, iv, nil, opts)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %s", err)
+	}
+	cipherText, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	return cipherText
+}
+
+func decryptSigned(cipherText, key, iv []byte, opts *Options) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := NewDecryptWriteCloserWithOptions(nopCloser{&out}, key, iv, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(cipherText); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func TestSignature(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	pub, priv, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	other, _, _ := GenerateSigningKey()
+	trusted := &Options{TrustedKeys: []ed25519.PublicKey{other, pub}}
+
+	for _, size := range []int{0, 100, chunkSize, 2*chunkSize + 5} {
+		for _, merkle := range []bool{false, true} {
+			plainText := bytes.Repeat([]byte{3}, size)
+			opts := &Options{SigningKey: priv, Merkle: merkle, Metadata: &Metadata{Name: "x"}}
+			cipherText := encryptBytes(t, plainText, key, iv, opts)
+			if expected, _ := CiphertextSize(int64(size), opts); expected != int64(len(cipherText)) {
+				t.Errorf("Size %d failed. CiphertextSize %d != %d", size, expected, len(cipherText))
+			}
+
+			out, err := decryptSigned(cipherText, key, iv, trusted)
+			if err != nil {
+				t.Fatalf("Size %d decryption failed: %s", size, err)
+			}
+			if !bytes.Equal(out, plainText) {
+				t.Errorf("Size %d failed. Plaintext differs", size)
+			}
+			// signed streams are still checked without trusted keys
+			if _, err := decryptSigned(cipherText, key, iv, nil); err != nil {
+				t.Errorf("Size %d decryption without trusted keys failed: %s", size, err)
+			}
+
+			if _, err := decryptSigned(cipherText, key, iv, &Options{TrustedKeys: []ed25519.PublicKey{other}}); err != ErrUntrustedSigner {
+				t.Errorf("Size %d failed. Expected ErrUntrustedSigner, got %v", size, err)
+			}
+
+			damaged := append([]byte{}, cipherText...)
+			damaged[len(damaged)-1] ^= 1
+			if _, err := decryptSigned(damaged, key, iv, trusted); err == nil {
+				t.Errorf("Size %d failed. Expected a modified signature to be detected", size)
+			}
+			if _, err := decryptSigned(cipherText[:len(cipherText)-1], key, iv, trusted); err == nil {
+				t.Errorf("Size %d failed. Expected truncation to be detected", size)
+			}
+
+			if merkle {
+				tree, err := ReadMerkleTree(bytes.NewReader(cipherText))
+				if err != nil {
+					t.Fatalf("Size %d failed to read tree: %s", size, err)
+				}
+				if tree.Len() != size/chunkSize+1 {
+					t.Errorf("Size %d failed. Expected %d chunks, got %d", size, size/chunkSize+1, tree.Len())
+				}
+			}
+		}
+	}
+}
+
+func TestSignatureRequired(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	pub, _, _ := GenerateSigningKey()
+	trusted := &Options{TrustedKeys: []ed25519.PublicKey{pub}}
+	for _, opts := range []*Options{nil, {Merkle: true}} {
+		cipherText := encryptBytes(t, []byte("unsigned"), key, iv, opts)
+		if _, err := decryptSigned(cipherText, key, iv, trusted); err != ErrNotSigned {
+			t.Errorf("Failed. Expected ErrNotSigned, got %v", err)
+		}
+	}
+}
+
+func TestParseTrustedKeys(t *testing.T) {
+	pub, _, _ := GenerateSigningKey()
+	list := "# deploy keys\n\n" + hex.EncodeToString(pub) + " build server\n"
+	keys, err := parseTrustedKeys(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("Failed to parse keys: %s", err)
+	}
+	if len(keys) != 1 || !keys[0].Equal(pub) {
+		t.Errorf("Failed. Unexpected keys %x", keys)
+	}
+	if _, err := parseTrustedKeys(strings.NewReader("abcd\n")); err == nil {
+		t.Errorf("Failed. Expected a short key to be rejected")
+	}
+}
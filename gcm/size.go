@@ -0,0 +1,76 @@
+package gcm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// tagSize is the size of the authentication tag appended to every chunk.
+const tagSize = 16
+
+var errCompressedSize = errors.New("The size of compressed data cannot be calculated in advance")
+
+// CiphertextSize returns the exact size of the encrypted output produced for
+// plaintext bytes of input with the given options, including any padding.
+// The options may be nil.
+//
+// Every stream ends with a chunk shorter than the chunk size, so empty input
+// and input that is an exact multiple of the chunk size are followed by an
+// empty chunk that consists of only its tag.
+func CiphertextSize(plaintext int64, opts *Options) (int64, error) {
+	if plaintext < 0 {
+		return 0, fmt.Errorf("Invalid plaintext size %d", plaintext)
+	}
+	if opts.compressed() {
+		return 0, errCompressedSize
+	}
+	overhead, err := opts.overhead()
+	if err != nil {
+		return 0, err
+	}
+	if opts.padded() {
+		plaintext = opts.Padding.paddedSize(plaintext)
+	}
+	chunks := plaintext/chunkSize + 1
+	body := plaintext + chunks*tagSize
+	size := overhead + body
+	if opts.corrected() {
+		size += opts.ErrorCorrection.paritySize(body)
+	}
+	if opts.armored() {
+		size = armoredSize(size)
+	}
+	return size, nil
+}
+
+// PlaintextSize returns the size of the plaintext that decrypts from
+// ciphertext bytes of encrypted input with the given options. The options
+// may be nil. An error is returned if no valid stream has the given size.
+func PlaintextSize(ciphertext int64, opts *Options) (int64, error) {
+	if opts.compressed() {
+		return 0, errCompressedSize
+	}
+	if opts.padded() {
+		return 0, errors.New("The size of padded data cannot be calculated from the ciphertext size")
+	}
+	if opts.armored() {
+		return 0, errors.New("The size of armored data cannot be calculated from the ciphertext size")
+	}
+	if opts.corrected() {
+		return 0, errors.New("The size of data with error correction cannot be calculated from the ciphertext size")
+	}
+	overhead, err := opts.overhead()
+	if err != nil {
+		return 0, err
+	}
+	body := ciphertext - overhead
+	if body < tagSize {
+		return 0, errors.New("Ciphertext is too short")
+	}
+	full := body / (chunkSize + tagSize)
+	last := body % (chunkSize + tagSize)
+	if last < tagSize {
+		return 0, errors.New("Ciphertext is truncated")
+	}
+	return full*chunkSize + last - tagSize, nil
+}
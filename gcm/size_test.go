@@ -0,0 +1,67 @@
+package gcm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var sizeTestData = []int64{
+	0,
+	1,
+	chunkSize - 1,
+	chunkSize,
+	chunkSize + 1,
+	2 * chunkSize,
+	3*chunkSize + 12345,
+}
+
+func TestSizes(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	for _, size := range sizeTestData {
+		r, err := NewEncryptReader(bytes.NewReader(make([]byte, size)), key, iv, nil)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %s", err)
+		}
+		cipherText, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("Size %d encryption failed: %s", size, err)
+			continue
+		}
+
+		expected, err := CiphertextSize(size, nil)
+		if err != nil {
+			t.Errorf("Size %d failed. CiphertextSize returned an error: %s", size, err)
+			continue
+		}
+		if expected != int64(len(cipherText)) {
+			t.Errorf("Size %d failed. CiphertextSize %d != %d", size, expected, len(cipherText))
+			continue
+		}
+		if total := r.CalculateTotalSize(int(size)); int64(total) != expected {
+			t.Errorf("Size %d failed. CalculateTotalSize %d != %d", size, total, expected)
+			continue
+		}
+
+		plainText, err := PlaintextSize(int64(len(cipherText)), nil)
+		if err != nil {
+			t.Errorf("Size %d failed. PlaintextSize returned an error: %s", size, err)
+			continue
+		}
+		if plainText != size {
+			t.Errorf("Size %d failed. PlaintextSize %d != %d", size, plainText, size)
+		}
+	}
+}
+
+func TestInvalidSizes(t *testing.T) {
+	if _, err := CiphertextSize(-1, nil); err == nil {
+		t.Error("Expected an error for a negative plaintext size")
+	}
+	for _, size := range []int64{0, tagSize - 1, chunkSize + tagSize + 1} {
+		if _, err := PlaintextSize(size, nil); err == nil {
+			t.Errorf("Expected an error for ciphertext size %d", size)
+		}
+	}
+}
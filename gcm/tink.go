@@ -0,0 +1,293 @@
+package gcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Tink's AES-GCM-HKDF streaming AEAD splits the plaintext into segments like
+// the streams of this package. A stream starts with a header
+//
+//	length      uint8     size of the header
+//	salt        [KeySize]byte
+//	noncePrefix [7]byte
+//
+// The segment key is derived from the key material and the salt with
+// HKDF-SHA-256, using the associated data as the info. Each segment is sealed
+// with the nonce noncePrefix || uint32 segment number || last segment flag,
+// and no associated data. The first segment is shorter by the header size.
+//
+// Only HKDF-SHA-256 and a first segment offset of zero are supported, which
+// covers Tink's AES128_GCM_HKDF_* and AES256_GCM_HKDF_* key templates.
+
+const (
+	tinkNoncePrefixSize = 7
+	tinkNonceSize       = tinkNoncePrefixSize + 4 + 1
+)
+
+// TinkParams holds the parameters of a Tink AES-GCM-HKDF streaming AEAD key.
+type TinkParams struct {
+	// KeySize is the size of the derived AES key: 16 or 32.
+	KeySize int
+	// SegmentSize is the size of each ciphertext segment, including its
+	// tag, such as 4096 or 1048576.
+	SegmentSize int
+}
+
+func (p *TinkParams) headerSize() int {
+	return 1 + p.KeySize + tinkNoncePrefixSize
+}
+
+func (p *TinkParams) validate(ikm []byte) error {
+	if p.KeySize != 16 && p.KeySize != 32 {
+		return fmt.Errorf("Invalid Tink key size %d", p.KeySize)
+	}
+	if len(ikm) < p.KeySize {
+		return errors.New("The key material is shorter than the derived key")
+	}
+	if p.SegmentSize <= p.headerSize()+tagSize {
+		return fmt.Errorf("Invalid Tink segment size %d", p.SegmentSize)
+	}
+	return nil
+}
+
+func tinkCipher(ikm, salt, aad []byte, keySize int) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, ikm, salt, string(aad), keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func tinkNonce(prefix []byte, segment uint32, last bool) []byte {
+	nonce := make([]byte, 0, tinkNonceSize)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, segment)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// TinkEncryptReader encrypts the data read from its source into a Tink
+// AES-GCM-HKDF streaming AEAD ciphertext.
+type TinkEncryptReader struct {
+	src  io.Reader
+	eof  bool
+	aead cipher.AEAD
+
+	prefix  []byte
+	segment uint32
+
+	sealed []byte
+	off    int
+	// buff holds the plaintext of the next segment plus one byte that shows
+	// whether another segment follows
+	buff    []byte
+	held    int
+	plainSz int
+}
+
+// NewTinkEncryptReader creates a TinkEncryptReader that encrypts src with the
+// given key material, associated data and parameters.
+func NewTinkEncryptReader(src io.Reader, ikm, aad []byte, params TinkParams) (*TinkEncryptReader, error) {
+	if err := params.validate(ikm); err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, params.headerSize())
+	hdr[0] = byte(len(hdr))
+	if _, err := rand.Read(hdr[1:]); err != nil {
+		return nil, err
+	}
+	return newTinkEncryptReader(src, ikm, aad, params, hdr)
+}
+
+// newTinkEncryptReader creates a TinkEncryptReader that writes the given
+// header, whose salt and nonce prefix must be random.
+func newTinkEncryptReader(src io.Reader, ikm, aad []byte, params TinkParams, hdr []byte) (*TinkEncryptReader, error) {
+	salt := hdr[1 : 1+params.KeySize]
+	aead, err := tinkCipher(ikm, salt, aad, params.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return &TinkEncryptReader{
+		src:     src,
+		aead:    aead,
+		prefix:  hdr[1+params.KeySize:],
+		sealed:  hdr,
+		buff:    make([]byte, params.SegmentSize-tagSize+1),
+		plainSz: params.SegmentSize - len(hdr) - tagSize,
+	}, nil
+}
+
+func (r *TinkEncryptReader) Read(p []byte) (int, error) {
+	n := len(p)
+	off := 0
+	for off < n {
+		if r.off >= len(r.sealed) {
+			if r.eof {
+				return off, io.EOF
+			}
+			if err := r.seal(); err != nil {
+				return off, err
+			}
+		}
+		read := copy(p[off:], r.sealed[r.off:])
+		r.off += read
+		off += read
+	}
+	return off, nil
+}
+
+func (r *TinkEncryptReader) seal() error {
+	n, err := io.ReadFull(r.src, r.buff[r.held:r.plainSz+1])
+	n += r.held
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.eof = true
+	} else if err != nil {
+		return err
+	}
+	plain := r.buff[:n]
+	var extra byte
+	if !r.eof {
+		// the extra byte starts the next segment
+		plain = r.buff[:n-1]
+		extra = r.buff[n-1]
+	}
+	if !r.eof && r.segment == ^uint32(0) {
+		return errors.New("Too many segments")
+	}
+	r.sealed = r.aead.Seal(nil, tinkNonce(r.prefix, r.segment, r.eof), plain, nil)
+	r.segment++
+	r.off = 0
+	r.held = 0
+	// segments after the first are not shortened by the header
+	r.plainSz = len(r.buff) - 1
+	if !r.eof {
+		r.buff[0] = extra
+		r.held = 1
+	}
+	return nil
+}
+
+// TinkDecryptWriteCloser decrypts a Tink AES-GCM-HKDF streaming AEAD
+// ciphertext written to it, writing the plaintext to dst. The stream is only
+// known to be complete and authentic once Close returns without error.
+type TinkDecryptWriteCloser struct {
+	dst    io.WriteCloser
+	ikm    []byte
+	aad    []byte
+	params TinkParams
+	aead   cipher.AEAD
+
+	header  []byte
+	prefix  []byte
+	segment uint32
+
+	sealed []byte
+	off    int
+}
+
+// NewTinkDecryptWriteCloser creates a TinkDecryptWriteCloser that decrypts
+// with the given key material, associated data and parameters.
+func NewTinkDecryptWriteCloser(dst io.WriteCloser, ikm, aad []byte, params TinkParams) (*TinkDecryptWriteCloser, error) {
+	if err := params.validate(ikm); err != nil {
+		return nil, err
+	}
+	return &TinkDecryptWriteCloser{
+		dst:    dst,
+		ikm:    ikm,
+		aad:    aad,
+		params: params,
+		header: make([]byte, 0, params.headerSize()),
+	}, nil
+}
+
+func (w *TinkDecryptWriteCloser) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.aead == nil {
+		need := cap(w.header) - len(w.header)
+		if need > len(p) {
+			need = len(p)
+		}
+		w.header = append(w.header, p[:need]...)
+		p = p[need:]
+		if len(w.header) < cap(w.header) {
+			return n, nil
+		}
+		if err := w.readHeader(); err != nil {
+			return n - len(p), err
+		}
+	}
+	off := 0
+	for off < len(p) {
+		// a full segment is only opened once more data shows it is not
+		// the last one
+		if w.off == len(w.sealed) {
+			if err := w.open(false); err != nil {
+				return n - len(p) + off, err
+			}
+		}
+		written := copy(w.sealed[w.off:], p[off:])
+		w.off += written
+		off += written
+	}
+	return n, nil
+}
+
+func (w *TinkDecryptWriteCloser) readHeader() error {
+	if int(w.header[0]) != len(w.header) {
+		return fmt.Errorf("Invalid Tink header size %d", w.header[0])
+	}
+	salt := w.header[1 : 1+w.params.KeySize]
+	aead, err := tinkCipher(w.ikm, salt, w.aad, w.params.KeySize)
+	if err != nil {
+		return err
+	}
+	w.aead = aead
+	w.prefix = w.header[1+w.params.KeySize:]
+	w.sealed = make([]byte, w.params.SegmentSize-len(w.header), w.params.SegmentSize)
+	return nil
+}
+
+func (w *TinkDecryptWriteCloser) open(last bool) error {
+	if !last && w.segment == ^uint32(0) {
+		return errors.New("Too many segments")
+	}
+	plain, err := w.aead.Open(nil, tinkNonce(w.prefix, w.segment, last), w.sealed[:w.off], nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.dst.Write(plain); err != nil {
+		return err
+	}
+	w.segment++
+	w.off = 0
+	w.sealed = w.sealed[:cap(w.sealed)]
+	return nil
+}
+
+// Close decrypts the last segment and closes dst.
+func (w *TinkDecryptWriteCloser) Close() error {
+	if w.aead == nil {
+		return errors.New("The Tink header is truncated")
+	}
+	if w.off < tagSize {
+		return errors.New("The stream is truncated")
+	}
+	if err := w.open(true); err != nil {
+		return err
+	}
+	return w.dst.Close()
+}
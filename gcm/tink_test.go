@@ -0,0 +1,199 @@
+package gcm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func tinkEncrypt(t *testing.T, plainText, ikm, aad []byte, params TinkParams) []byte {
+	r, err := NewTinkEncryptReader(bytes.NewReader(plainText), ikm, aad, params)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %s", err)
+	}
+	cipherText, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	return cipherText
+}
+
+func tinkDecrypt(cipherText, ikm, aad []byte, params TinkParams) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := NewTinkDecryptWriteCloser(nopCloser{&out}, ikm, aad, params)
+	if err != nil {
+		return nil, err
+	}
+	// write in pieces to exercise segment boundaries
+	for len(cipherText) > 0 {
+		n := 1000
+		if n > len(cipherText) {
+			n = len(cipherText)
+		}
+		if _, err := w.Write(cipherText[:n]); err != nil {
+			return nil, err
+		}
+		cipherText = cipherText[n:]
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func TestTinkRoundTrip(t *testing.T) {
+	ikm := bytes.Repeat([]byte{0x42}, 32)
+	aad := []byte("associated data")
+	for _, params := range []TinkParams{{16, 4096}, {32, 4096}, {32, 512}} {
+		first := params.SegmentSize - params.headerSize() - tagSize
+		rest := params.SegmentSize - tagSize
+		for _, size := range []int{0, 1, first - 1, first, first + 1, first + rest, first + 3*rest + 5} {
+			plainText := make([]byte, size)
+			for i := range plainText {
+				plainText[i] = byte(i)
+			}
+			cipherText := tinkEncrypt(t, plainText, ikm, aad, params)
+			segments := 1
+			if size > first {
+				segments += (size - first + rest - 1) / rest
+			}
+			if expected := params.headerSize() + size + segments*tagSize; len(cipherText) != expected {
+				t.Errorf("Params %v size %d failed. Expected %d bytes, got %d", params, size, expected, len(cipherText))
+			}
+			out, err := tinkDecrypt(cipherText, ikm, aad, params)
+			if err != nil {
+				t.Fatalf("Params %v size %d decryption failed: %s", params, size, err)
+			}
+			if !bytes.Equal(out, plainText) {
+				t.Errorf("Params %v size %d failed. Plaintext differs", params, size)
+			}
+
+			if _, err := tinkDecrypt(cipherText, ikm, []byte("other"), params); err == nil {
+				t.Errorf("Params %v size %d failed. Expected wrong associated data to be detected", params, size)
+			}
+			if size > first {
+				// dropping the last segment must be detected
+				if _, err := tinkDecrypt(cipherText[:params.SegmentSize], ikm, aad, params); err == nil {
+					t.Errorf("Params %v size %d failed. Expected truncation to be detected", params, size)
+				}
+			}
+		}
+	}
+}
+
+// TestTinkLayout decrypts a stream with the standard library alone, following
+// Tink's description of the format.
+func TestTinkLayout(t *testing.T) {
+	ikm := bytes.Repeat([]byte{7}, 16)
+	aad := []byte("aad")
+	params := TinkParams{KeySize: 16, SegmentSize: 256}
+	plainText := bytes.Repeat([]byte("tink"), 100)
+	cipherText := tinkEncrypt(t, plainText, ikm, aad, params)
+
+	if cipherText[0] != 24 {
+		t.Fatalf("Failed. Expected a header size of 24, got %d", cipherText[0])
+	}
+	salt := cipherText[1:17]
+	prefix := cipherText[17:24]
+	key, _ := hkdf.Key(sha256.New, ikm, salt, string(aad), 16)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+
+	var out []byte
+	rest := cipherText[24:]
+	segment := params.SegmentSize - 24
+	for i := uint32(0); len(rest) > 0; i++ {
+		n := segment
+		last := byte(0)
+		if n >= len(rest) {
+			n = len(rest)
+			last = 1
+		}
+		nonce := binary.BigEndian.AppendUint32(append([]byte{}, prefix...), i)
+		opened, err := aead.Open(nil, append(nonce, last), rest[:n], nil)
+		if err != nil {
+			t.Fatalf("Failed to open segment %d: %s", i, err)
+		}
+		out = append(out, opened...)
+		rest = rest[n:]
+		segment = params.SegmentSize
+	}
+	if !bytes.Equal(out, plainText) {
+		t.Errorf("Failed. Plaintext differs")
+	}
+}
+
+func TestTinkParams(t *testing.T) {
+	ikm := make([]byte, 32)
+	for _, params := range []TinkParams{{24, 4096}, {16, 40}, {32, 0}} {
+		if _, err := NewTinkEncryptReader(nil, ikm, nil, params); err == nil {
+			t.Errorf("Params %v failed. Expected an error", params)
+		}
+	}
+	if _, err := NewTinkEncryptReader(nil, ikm[:16], nil, TinkParams{32, 4096}); err == nil {
+		t.Errorf("Failed. Expected short key material to be rejected")
+	}
+}
+
+// tinkVector is a ciphertext produced by Tink, see testdata/tink.
+type tinkVector struct {
+	TcID        int    `json:"tcId"`
+	KeySize     int    `json:"keySize"`
+	SegmentSize int    `json:"segmentSize"`
+	IKM         string `json:"ikm"`
+	AAD         string `json:"aad"`
+	Msg         string `json:"msg"`
+	CT          string `json:"ct"`
+}
+
+func TestTinkVectors(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "tink", "aes_gcm_hkdf.json"))
+	if err != nil {
+		t.Fatalf("Failed to read the Tink test vectors: %s", err)
+	}
+	var file struct {
+		Tests []tinkVector `json:"tests"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("Failed to parse the Tink test vectors: %s", err)
+	}
+	if len(file.Tests) == 0 {
+		t.Fatalf("Failed. No Tink test vectors")
+	}
+	for _, v := range file.Tests {
+		ikm, _ := hex.DecodeString(v.IKM)
+		aad, _ := hex.DecodeString(v.AAD)
+		msg, _ := hex.DecodeString(v.Msg)
+		ct, _ := hex.DecodeString(v.CT)
+		params := TinkParams{KeySize: v.KeySize, SegmentSize: v.SegmentSize}
+
+		out, err := tinkDecrypt(ct, ikm, aad, params)
+		if err != nil {
+			t.Errorf("Vector %d decryption failed: %s", v.TcID, err)
+		} else if !bytes.Equal(out, msg) {
+			t.Errorf("Vector %d failed. Plaintext differs", v.TcID)
+		}
+
+		// with Tink's salt and nonce prefix, encryption is deterministic
+		hdr := append([]byte{}, ct[:params.headerSize()]...)
+		r, err := newTinkEncryptReader(bytes.NewReader(msg), ikm, aad, params, hdr)
+		if err != nil {
+			t.Fatalf("Vector %d failed to create reader: %s", v.TcID, err)
+		}
+		sealed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Vector %d encryption failed: %s", v.TcID, err)
+		}
+		if !bytes.Equal(sealed, ct) {
+			t.Errorf("Vector %d failed. Ciphertext differs from Tink's", v.TcID)
+		}
+	}
+}
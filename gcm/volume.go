@@ -0,0 +1,393 @@
+package gcm
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An encrypted stream can be split across volumes of a limited size. Each
+// volume holds the next part of the stream after a header
+//
+//	magic   [4]byte  "GCMV"
+//	version uint8
+//	set     [16]byte random ID shared by the volumes of a set
+//	index   uint32   index of the volume, from zero
+//	count   uint32   number of volumes in the set
+//	tag     [32]byte
+//
+// The tag is an HMAC-SHA-256 over the fields before it and the SHA-256 of the
+// data of the volume, keyed with a key derived from the key and IV of the
+// stream. The count is only known once the whole stream has been written, so
+// the headers are completed last.
+
+const (
+	volumeVersion    = 1
+	volumeSetSize    = 16
+	volumeTagSize    = sha256.Size
+	volumeFieldsSize = 4 + 1 + volumeSetSize + 4 + 4
+	volumeHeaderSize = volumeFieldsSize + volumeTagSize
+	volumeKeyInfo    = "gcm volume"
+)
+
+var volumeMagic = []byte("GCMV")
+
+func volumeKey(key, iv []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, iv, volumeKeyInfo, sha256.Size)
+}
+
+func volumeFields(set []byte, index, count uint32) []byte {
+	b := make([]byte, 0, volumeFieldsSize)
+	b = append(b, volumeMagic...)
+	b = append(b, volumeVersion)
+	b = append(b, set...)
+	b = binary.BigEndian.AppendUint32(b, index)
+	return binary.BigEndian.AppendUint32(b, count)
+}
+
+func volumeTag(macKey, fields, digest []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(fields)
+	mac.Write(digest)
+	return mac.Sum(nil)
+}
+
+// VolumePath returns the path of the volume with the given index for an
+// output path, such as out.enc.001 for the first volume of out.enc.
+func VolumePath(outFilePath string, index int) string {
+	return fmt.Sprintf("%s.%03d", outFilePath, index+1)
+}
+
+// VolumePaths returns the paths of the volumes that exist for an output path,
+// ordered by their number.
+func VolumePaths(outFilePath string) ([]string, error) {
+	matches, err := filepath.Glob(outFilePath + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	numbers := make(map[string]int)
+	var paths []string
+	for _, path := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(path, outFilePath+"."))
+		if err != nil {
+			continue
+		}
+		numbers[path] = n
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No volumes exist for %s", outFilePath)
+	}
+	sort.Slice(paths, func(i, j int) bool { return numbers[paths[i]] < numbers[paths[j]] })
+	return paths, nil
+}
+
+// EncryptFileToVolumes encrypts the file at inFilePath like
+// EncryptFileWithOptions, splitting the output into volumes of at most
+// volumeSize bytes named as by VolumePath. The options may be nil. It returns
+// the paths of the volumes written. Once they are complete, other numbered
+// files at the output path, such as the later volumes of an earlier, longer
+// encryption, are removed so that VolumePaths finds this set alone.
+func EncryptFileToVolumes(inFilePath, outFilePath string, volumeSize int64, key, iv, aad []byte, opts *Options) ([]string, error) {
+	if volumeSize <= volumeHeaderSize {
+		return nil, fmt.Errorf("Invalid volume size %d. Must be larger than %d bytes", volumeSize, volumeHeaderSize)
+	}
+	if opts.armored() {
+		return nil, errors.New("Armored output cannot be split into volumes")
+	}
+	macKey, err := volumeKey(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	inFile, r, err := openEncryptReader(inFilePath, key, iv, aad, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	w := &volumeWriter{path: outFilePath, size: volumeSize - volumeHeaderSize, macKey: macKey}
+	defer w.abort()
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := removeStaleVolumes(outFilePath, w.paths); err != nil {
+		return nil, err
+	}
+	return w.paths, nil
+}
+
+// removeStaleVolumes removes the files VolumePaths finds for an output path
+// that are not among the volumes just written.
+func removeStaleVolumes(outFilePath string, written []string) error {
+	found, err := VolumePaths(outFilePath)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool)
+	for _, path := range written {
+		keep[path] = true
+	}
+	for _, path := range found {
+		if !keep[path] {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// volumeWriter writes a stream to volume files, leaving room for a header at
+// the start of each that Close fills in.
+type volumeWriter struct {
+	path   string
+	size   int64
+	macKey []byte
+	set    []byte
+
+	f       *os.File
+	written int64
+	digest  hash.Hash
+
+	paths   []string
+	digests [][]byte
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.f == nil || w.written == w.size {
+			if err := w.next(); err != nil {
+				return n - len(p), err
+			}
+		}
+		part := p
+		if int64(len(part)) > w.size-w.written {
+			part = part[:w.size-w.written]
+		}
+		if _, err := w.f.Write(part); err != nil {
+			return n - len(p), err
+		}
+		w.digest.Write(part)
+		w.written += int64(len(part))
+		p = p[len(part):]
+	}
+	return n, nil
+}
+
+// next finishes the current volume and starts the next one.
+func (w *volumeWriter) next() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	if w.set == nil {
+		w.set = make([]byte, volumeSetSize)
+		if _, err := rand.Read(w.set); err != nil {
+			return err
+		}
+	}
+	path := VolumePath(w.path, len(w.paths))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.paths = append(w.paths, path)
+	w.written = 0
+	w.digest = sha256.New()
+	// the header is written once the count is known
+	_, err = f.Write(make([]byte, volumeHeaderSize))
+	return err
+}
+
+func (w *volumeWriter) finish() error {
+	if w.f == nil {
+		return nil
+	}
+	w.digests = append(w.digests, w.digest.Sum(nil))
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Close finishes the last volume and writes the headers of all volumes.
+func (w *volumeWriter) Close() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	count := uint32(len(w.paths))
+	for i, path := range w.paths {
+		fields := volumeFields(w.set, uint32(i), count)
+		header := append(fields, volumeTag(w.macKey, fields, w.digests[i])...)
+		f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(header, 0); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort closes the current volume if Close was not reached.
+func (w *volumeWriter) abort() {
+	if w.f != nil {
+		w.f.Close()
+	}
+}
+
+// DecryptVolumes decrypts the volumes at volumePaths, given in order, into
+// outFilePath like DecryptFileWithOptions. The options may be nil. Missing,
+// duplicated, reordered or altered volumes and volumes of another set are
+// rejected.
+func DecryptVolumes(volumePaths []string, outFilePath string, key, iv, aad []byte, opts *Options) error {
+	var volumes []io.Reader
+	var size int64
+	for _, path := range volumePaths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil {
+			size += info.Size() - volumeHeaderSize
+		}
+		volumes = append(volumes, f)
+	}
+	src, err := NewVolumeReader(volumes, key, iv)
+	if err != nil {
+		return err
+	}
+	return decryptToPath(src, outFilePath, key, iv, aad, opts.withSize(size))
+}
+
+// VolumeReader reads the stream split across a set of volumes, checking the
+// header and tag of each.
+type VolumeReader struct {
+	volumes []io.Reader
+	macKey  []byte
+
+	set    []byte
+	count  uint32
+	index  uint32
+	fields []byte
+	tag    []byte
+	digest hash.Hash
+	cur    io.Reader
+}
+
+// NewVolumeReader creates a VolumeReader over the given volumes, which must
+// be given in order. The tag of each volume is checked when its end is
+// reached, so an error may follow data read from an altered volume, which
+// the decryption of the stream rejects on its own.
+func NewVolumeReader(volumes []io.Reader, key, iv []byte) (*VolumeReader, error) {
+	macKey, err := volumeKey(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, errors.New("No volumes given")
+	}
+	return &VolumeReader{volumes: volumes, macKey: macKey}, nil
+}
+
+func (r *VolumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.set != nil && r.index == r.count {
+			return 0, io.EOF
+		}
+		if r.cur == nil {
+			if err := r.start(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.cur.Read(p)
+		r.digest.Write(p[:n])
+		if err == io.EOF {
+			if err := r.end(); err != nil {
+				return n, err
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// start reads and checks the header of the next volume.
+func (r *VolumeReader) start() error {
+	if int(r.index) >= len(r.volumes) {
+		return fmt.Errorf("Volume %d of %d is missing", r.index+1, r.count)
+	}
+	header := make([]byte, volumeHeaderSize)
+	if _, err := io.ReadFull(r.volumes[r.index], header); err != nil {
+		return fmt.Errorf("The header of volume %d is truncated", r.index+1)
+	}
+	if !bytes.Equal(header[:len(volumeMagic)], volumeMagic) {
+		return fmt.Errorf("Input %d is not a volume", r.index+1)
+	}
+	if header[len(volumeMagic)] != volumeVersion {
+		return fmt.Errorf("Unsupported volume version %d", header[len(volumeMagic)])
+	}
+	fields := header[:volumeFieldsSize]
+	set := fields[len(volumeMagic)+1 : len(volumeMagic)+1+volumeSetSize]
+	index := binary.BigEndian.Uint32(fields[volumeFieldsSize-8:])
+	count := binary.BigEndian.Uint32(fields[volumeFieldsSize-4:])
+	if r.set == nil {
+		r.set = append([]byte{}, set...)
+		r.count = count
+		if count == 0 {
+			return errors.New("Invalid volume count 0")
+		}
+	} else if !bytes.Equal(set, r.set) {
+		return fmt.Errorf("Input %d is a volume of another set", r.index+1)
+	}
+	switch {
+	case count != r.count:
+		return fmt.Errorf("Volume %d has a count of %d, but the set has %d", index+1, count, r.count)
+	case index < r.index:
+		return fmt.Errorf("Volume %d appears more than once", index+1)
+	case index > r.index:
+		return fmt.Errorf("Expected volume %d of %d, found volume %d. Volumes are missing or out of order", r.index+1, r.count, index+1)
+	}
+	r.fields = fields
+	r.tag = header[volumeFieldsSize:]
+	r.digest = sha256.New()
+	r.cur = r.volumes[r.index]
+	return nil
+}
+
+// end checks the tag of the current volume once all of it has been read.
+func (r *VolumeReader) end() error {
+	if !hmac.Equal(r.tag, volumeTag(r.macKey, r.fields, r.digest.Sum(nil))) {
+		return fmt.Errorf("Volume %d failed to authenticate", r.index+1)
+	}
+	r.cur = nil
+	r.index++
+	if r.index == r.count && len(r.volumes) > int(r.count) {
+		return fmt.Errorf("%d volumes given, but the set has %d", len(r.volumes), r.count)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package gcm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcm-volumes")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	plainText := make([]byte, 2*chunkSize+1000)
+	for i := range plainText {
+		plainText[i] = byte(i % 249)
+	}
+	inPath := filepath.Join(dir, "in")
+	if err := ioutil.WriteFile(inPath, plainText, 0600); err != nil {
+		t.Fatalf("Failed to write input: %s", err)
+	}
+	outPath := filepath.Join(dir, "out.enc")
+	volumeSize := int64(600000)
+	paths, err := EncryptFileToVolumes(inPath, outPath, volumeSize, key, iv, nil, &Options{Metadata: &Metadata{}})
+	if err != nil {
+		t.Fatalf("EncryptFileToVolumes failed: %s", err)
+	}
+	if len(paths) != 4 || paths[0] != outPath+".001" || paths[3] != outPath+".004" {
+		t.Fatalf("Failed. Unexpected volumes %v", paths)
+	}
+	for _, path := range paths {
+		if info, err := os.Stat(path); err != nil || info.Size() > volumeSize {
+			t.Errorf("Failed. Volume %s exceeds the volume size", path)
+		}
+	}
+	found, err := VolumePaths(outPath)
+	if err != nil || strings.Join(found, ",") != strings.Join(paths, ",") {
+		t.Fatalf("Failed. VolumePaths returned %v, %v", found, err)
+	}
+
+	decPath := filepath.Join(dir, "dec")
+	if err := DecryptVolumes(paths, decPath, key, iv, nil, nil); err != nil {
+		t.Fatalf("DecryptVolumes failed: %s", err)
+	}
+	if decrypted, _ := ioutil.ReadFile(decPath); !bytes.Equal(decrypted, plainText) {
+		t.Errorf("Failed. Decrypted text differs")
+	}
+
+	// a volume of another encryption of the same file
+	otherPath := filepath.Join(dir, "other.enc")
+	other, err := EncryptFileToVolumes(inPath, otherPath, volumeSize, key, iv, nil, &Options{Metadata: &Metadata{}})
+	if err != nil {
+		t.Fatalf("EncryptFileToVolumes failed: %s", err)
+	}
+
+	for name, test := range map[string]struct {
+		paths []string
+		err   string
+	}{
+		"missing":    {[]string{paths[0], paths[1], paths[3]}, "missing or out of order"},
+		"last":       {paths[:3], "Volume 4 of 4 is missing"},
+		"duplicated": {[]string{paths[0], paths[1], paths[1], paths[2], paths[3]}, "more than once"},
+		"reordered":  {[]string{paths[0], paths[2], paths[1], paths[3]}, "out of order"},
+		"extra":      {append(append([]string{}, paths...), other[0]), "the set has 4"},
+		"other set":  {[]string{paths[0], other[1], paths[2], paths[3]}, "another set"},
+	} {
+		err := DecryptVolumes(test.paths, filepath.Join(dir, "bad"), key, iv, nil, nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Failed for %s. Expected an error containing %q, got %v", name, test.err, err)
+		}
+	}
+
+	// altered data is caught by the tag of its volume
+	var readers []io.Reader
+	for i, path := range paths {
+		volume, _ := ioutil.ReadFile(path)
+		if i == 1 {
+			volume[volumeHeaderSize+10] ^= 1
+		}
+		readers = append(readers, bytes.NewReader(volume))
+	}
+	r, err := NewVolumeReader(readers, key, iv)
+	if err != nil {
+		t.Fatalf("NewVolumeReader failed: %s", err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), "Volume 2 failed to authenticate") {
+		t.Errorf("Failed. Expected an altered volume to be rejected, got %v", err)
+	}
+
+	// encrypting to fewer volumes removes the later ones of the old set
+	paths, err = EncryptFileToVolumes(inPath, outPath, 2*volumeSize, key, iv, nil, &Options{Metadata: &Metadata{}})
+	if err != nil {
+		t.Fatalf("EncryptFileToVolumes failed: %s", err)
+	}
+	found, err = VolumePaths(outPath)
+	if err != nil || len(paths) != 2 || strings.Join(found, ",") != strings.Join(paths, ",") {
+		t.Fatalf("Failed. Expected stale volumes to be removed, found %v, %v", found, err)
+	}
+	if err := DecryptVolumes(found, decPath, key, iv, nil, nil); err != nil {
+		t.Errorf("DecryptVolumes failed after re-encryption: %s", err)
+	}
+
+	if _, err := EncryptFileToVolumes(inPath, outPath, volumeHeaderSize, key, iv, nil, nil); err == nil {
+		t.Errorf("Failed. Expected a volume size without room for data to be rejected")
+	}
+}
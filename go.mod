@@ -0,0 +1,10 @@
+module github.com/catalyzeio/gcm
+
+go 1.26.0
+
+require (
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/crypto v0.57.0
+)
+
+require golang.org/x/sys v0.48.0 // indirect
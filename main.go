@@ -3,8 +3,12 @@ package main
 import (
 	"encoding/hex"
 	"flag"
+	"fmt"
 	"log"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/catalyzeio/gcm/gcm"
 )
@@ -23,49 +27,182 @@ var (
 	ivString   string
 	inputPath  string
 	outputPath string
+	progress   bool
+	recursive  string
+	metadata   bool
+	compress   string
+	pad        string
+	commit     bool
+	merkle     bool
+	armor      bool
+	fec        string
+	splitSize  string
+	volumes    bool
+	convergent bool
+	resume     bool
 )
 
+// commands maps subcommand names to their implementations. Without a
+// subcommand, the -e and -d flags select the operation.
+var commands = map[string]func(args []string){
+	"encrypt": func(args []string) { runCommand(true, args) },
+	"decrypt": func(args []string) { runCommand(false, args) },
+	"inspect": runInspect,
+}
+
 func main() {
-	flag.BoolVar(&encrypt, "e", false, "Enrypt the given file")
-	flag.BoolVar(&decrypt, "d", false, "Decrypt the given file")
-	flag.StringVar(&keyString, "K", "", "The hex encoded key")
-	flag.StringVar(&ivString, "iv", "", "The hex encoded IV")
-	flag.StringVar(&inputPath, "in", "", "The input file")
-	flag.StringVar(&outputPath, "out", "", "The output file")
-	flag.Parse()
-	checkRequiredFlags()
-	key, err := hex.DecodeString(keyString)
-	if err != nil {
-		logger.Fatalf("Invalid key: %s.", err)
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
 	}
-	if len(key) != keySize {
-		logger.Fatalf("Invalid key. Must be a valid hex encoded string at least %d bytes long.", keySize)
-	}
-	iv, err := hex.DecodeString(ivString)
-	if err != nil {
-		logger.Fatalf("Invalid IV: %s.", err)
+
+	flags := flag.CommandLine
+	flags.BoolVar(&encrypt, "e", false, "Enrypt the given file")
+	flags.BoolVar(&decrypt, "d", false, "Decrypt the given file")
+	addCommonFlags(flags)
+	flags.Parse(os.Args[1:])
+	if (encrypt && decrypt) || (!encrypt && !decrypt) {
+		logger.Fatalln("-e or -d must be specified, but not both")
 	}
-	if len(iv) < minIVSize {
-		logger.Fatalf("Invalid IV. Must be a valid hex encoded string at least %d bytes long.", minIVSize)
+	run()
+}
+
+// runCommand handles the encrypt and decrypt subcommands.
+func runCommand(enc bool, args []string) {
+	name := "decrypt"
+	if enc {
+		name = "encrypt"
 	}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	addCommonFlags(flags)
+	flags.StringVar(&recursive, "r", "", "Recursively process the given directory")
+	flags.Parse(args)
+	encrypt = enc
+	decrypt = !enc
+	run()
+}
+
+func addCommonFlags(flags *flag.FlagSet) {
+	flags.StringVar(&keyString, "K", "", "The hex encoded key")
+	flags.StringVar(&ivString, "iv", "", "The hex encoded IV")
+	flags.StringVar(&inputPath, "in", "", "The input file")
+	flags.StringVar(&outputPath, "out", "", "The output file")
+	flags.BoolVar(&progress, "progress", false, "Report progress on stderr")
+	flags.BoolVar(&metadata, "metadata", false, "Store the file name, mode, time, type and digest in the encrypted file")
+	flags.StringVar(&compress, "compress", "none", "Compress before encrypting: none, gzip or zstd")
+	flags.StringVar(&pad, "pad", "none", "Hide the file size: none, padme or a bucket size in bytes")
+	flags.BoolVar(&commit, "commit", false, "Store a key commitment so a wrong key is detected immediately. When decrypting, require one")
+	flags.BoolVar(&merkle, "merkle", false, "Append a Merkle tree root over the encrypted chunks")
+	flags.BoolVar(&armor, "armor", false, "Write the encrypted file as ASCII armored text")
+	flags.StringVar(&fec, "fec", "", "Add parity to repair damaged chunks, given as data,parity chunks per group such as 10,2")
+	flags.StringVar(&splitSize, "split-size", "", "Split the encrypted file into volumes of at most the given size, such as 5G, named out.001, out.002, ...")
+	flags.BoolVar(&volumes, "volumes", false, "Decrypt the volumes -in.001, -in.002, ... written with -split-size")
+	flags.BoolVar(&convergent, "convergent", false, "Derive the key and IV from -K and the file content, so identical files encrypt identically. -iv is not used")
+	flags.BoolVar(&resume, "resume", false, "Continue an interrupted run from the complete chunks already in the output file")
+	flags.StringVar(&signKeyPath, "sign-key", "", "Sign with the hex encoded Ed25519 seed in the given file")
+	flags.StringVar(&trustedPath, "trusted", "", "Require a signature from a hex encoded public key listed in the given file")
+}
+
+func run() {
+	checkRequiredFlags()
+	key := parseKey()
 	aad, err := hex.DecodeString(gcm.AAD)
 	if err != nil {
 		panic(err)
 	}
-	if encrypt {
-		err = gcm.EncryptFile(inputPath, outputPath, key, iv, aad)
+	opts := &gcm.Options{}
+	if progress {
+		opts.Progress = newProgressLogger()
+	}
+	if metadata {
+		opts.Metadata = &gcm.Metadata{}
+	}
+	if opts.Compression, err = gcm.ParseCompression(compress); err != nil {
+		logger.Fatalf("Invalid -compress: %s.", err)
+	}
+	opts.Padding = parsePadding()
+	opts.KeyCommitment = commit
+	opts.RequireKeyCommitment = commit
+	opts.Merkle = merkle
+	opts.Armor = armor
+	opts.ErrorCorrection = parseErrorCorrection()
+	signingOptions(opts)
+	if recursive != "" {
+		if splitSize != "" || volumes || convergent || resume {
+			logger.Fatalln("-split-size, -volumes, -convergent and -resume cannot be used with -r")
+		}
+		runRecursive(key, aad, opts)
+		return
+	}
+	if convergent {
+		if splitSize != "" || volumes || resume {
+			logger.Fatalln("-split-size, -volumes and -resume cannot be used with -convergent")
+		}
+		if encrypt {
+			err = gcm.EncryptFileConvergent(inputPath, outputPath, key, aad, opts)
+		} else {
+			err = gcm.DecryptFileConvergent(inputPath, outputPath, key, aad, opts)
+		}
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		return
+	}
+	iv := parseIV()
+	if resume && (splitSize != "" || volumes) {
+		logger.Fatalln("-resume cannot be used with -split-size or -volumes")
+	}
+	if encrypt && resume {
+		err = gcm.ResumeEncryptFile(inputPath, outputPath, key, iv, aad, opts)
+	} else if decrypt && resume {
+		err = gcm.ResumeDecryptFile(inputPath, outputPath, key, iv, aad, opts)
+	} else if encrypt && splitSize != "" {
+		var paths []string
+		paths, err = gcm.EncryptFileToVolumes(inputPath, outputPath, parseSize(splitSize), key, iv, aad, opts)
+		if err == nil {
+			logger.Printf("Wrote %d volumes", len(paths))
+		}
+	} else if decrypt && volumes {
+		var paths []string
+		if paths, err = gcm.VolumePaths(inputPath); err == nil {
+			err = gcm.DecryptVolumes(paths, outputPath, key, iv, aad, opts)
+		}
+	} else if encrypt {
+		err = gcm.EncryptFileWithOptions(inputPath, outputPath, key, iv, aad, opts)
 	} else if decrypt {
-		err = gcm.DecryptFile(inputPath, outputPath, key, iv, aad)
+		err = gcm.DecryptFileWithOptions(inputPath, outputPath, key, iv, aad, opts)
 	}
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 }
 
-func checkRequiredFlags() {
-	if (encrypt && decrypt) || (!encrypt && !decrypt) {
-		logger.Fatalln("-e or -d must be specified, but not both")
+func runRecursive(key, aad []byte, opts *gcm.Options) {
+	var manifest *gcm.Manifest
+	var err error
+	if encrypt {
+		manifest, err = gcm.EncryptDir(recursive, outputPath, key, aad, opts)
+	} else {
+		manifest, err = gcm.DecryptDir(recursive, outputPath, key, aad, opts)
 	}
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	for _, entry := range manifest.Entries {
+		logger.Printf("%s %s", entry.Mode, entry.Path)
+	}
+	logger.Printf("Processed %d entries", len(manifest.Entries))
+}
+
+// runInspect prints the authenticated metadata of an encrypted file.
+func runInspect(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flags.StringVar(&keyString, "K", "", "The hex encoded key")
+	flags.StringVar(&ivString, "iv", "", "The hex encoded IV")
+	flags.StringVar(&inputPath, "in", "", "The input file")
+	flags.Parse(args)
 	if keyString == "" {
 		logger.Fatalln("-K is required")
 	}
@@ -75,6 +212,121 @@ func checkRequiredFlags() {
 	if inputPath == "" {
 		logger.Fatalln("-in is required")
 	}
+	aad, err := hex.DecodeString(gcm.AAD)
+	if err != nil {
+		panic(err)
+	}
+	meta, err := gcm.InspectFile(inputPath, parseKey(), parseIV(), aad)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	fmt.Printf("Name:         %s\n", meta.Name)
+	fmt.Printf("Mode:         %s\n", meta.Mode)
+	fmt.Printf("Modified:     %s\n", meta.ModTime)
+	fmt.Printf("Content-Type: %s\n", meta.ContentType)
+	fmt.Printf("SHA-256:      %x\n", meta.SHA256)
+}
+
+func parsePadding() gcm.Padding {
+	switch pad {
+	case "", "none":
+		return gcm.Padding{}
+	case "padme":
+		return gcm.Padding{Scheme: gcm.PaddingPadme}
+	}
+	size, err := strconv.ParseInt(pad, 10, 64)
+	if err != nil || size <= 0 {
+		logger.Fatalf("Invalid -pad. Must be none, padme or a positive bucket size in bytes.")
+	}
+	return gcm.Padding{Scheme: gcm.PaddingBuckets, BucketSize: size}
+}
+
+// parseSize parses a size in bytes with an optional K, M or G suffix for
+// powers of 1024.
+func parseSize(s string) int64 {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	digits := s
+	if multiplier > 1 {
+		digits = s[:len(s)-1]
+	}
+	size, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || size <= 0 {
+		logger.Fatalf("Invalid size %s. Must be a positive number of bytes with an optional K, M or G suffix.", s)
+	}
+	if size > math.MaxInt64/multiplier {
+		logger.Fatalf("Invalid size %s. It is too large.", s)
+	}
+	return size * multiplier
+}
+
+func parseErrorCorrection() gcm.ErrorCorrection {
+	if fec == "" {
+		return gcm.ErrorCorrection{}
+	}
+	parts := strings.Split(fec, ",")
+	if len(parts) != 2 {
+		logger.Fatalf("Invalid -fec. Must be data,parity chunks per group such as 10,2.")
+	}
+	data, err := strconv.Atoi(parts[0])
+	if err != nil {
+		logger.Fatalf("Invalid -fec: %s.", err)
+	}
+	parity, err := strconv.Atoi(parts[1])
+	if err != nil {
+		logger.Fatalf("Invalid -fec: %s.", err)
+	}
+	if data < 1 || parity < 1 {
+		logger.Fatalf("Invalid -fec. Both counts must be positive.")
+	}
+	return gcm.ErrorCorrection{DataChunks: data, ParityChunks: parity}
+}
+
+func parseKey() []byte {
+	key, err := hex.DecodeString(keyString)
+	if err != nil {
+		logger.Fatalf("Invalid key: %s.", err)
+	}
+	if len(key) != keySize {
+		logger.Fatalf("Invalid key. Must be a valid hex encoded string at least %d bytes long.", keySize)
+	}
+	return key
+}
+
+func parseIV() []byte {
+	iv, err := hex.DecodeString(ivString)
+	if err != nil {
+		logger.Fatalf("Invalid IV: %s.", err)
+	}
+	if len(iv) < minIVSize {
+		logger.Fatalf("Invalid IV. Must be a valid hex encoded string at least %d bytes long.", minIVSize)
+	}
+	return iv
+}
+
+func checkRequiredFlags() {
+	if keyString == "" {
+		logger.Fatalln("-K is required")
+	}
+	if recursive != "" {
+		if inputPath != "" || ivString != "" {
+			logger.Fatalln("-in and -iv cannot be used with -r")
+		}
+	} else {
+		if ivString == "" && !convergent {
+			logger.Fatalln("-iv is required")
+		}
+		if inputPath == "" {
+			logger.Fatalln("-in is required")
+		}
+	}
 	if outputPath == "" {
 		logger.Fatalln("-out is required")
 	}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/catalyzeio/gcm/gcm"
+)
+
+var (
+	passphrasePath string
+	iteratedS2K    bool
+)
+
+func init() {
+	commands["openpgp-encrypt"] = func(args []string) { runOpenPGP(true, args) }
+	commands["openpgp-decrypt"] = func(args []string) { runOpenPGP(false, args) }
+}
+
+// runOpenPGP encrypts or decrypts a passphrase protected OpenPGP message.
+func runOpenPGP(enc bool, args []string) {
+	name := "openpgp-decrypt"
+	if enc {
+		name = "openpgp-encrypt"
+	}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&inputPath, "in", "", "The input file")
+	flags.StringVar(&outputPath, "out", "", "The output file")
+	flags.StringVar(&passphrasePath, "passphrase-file", "", "A file holding the passphrase on its first line")
+	if enc {
+		flags.BoolVar(&iteratedS2K, "iterated-s2k", false, "Derive the key with the iterated and salted S2K instead of Argon2, for readers without Argon2")
+	}
+	flags.Parse(args)
+	if inputPath == "" {
+		logger.Fatalln("-in is required")
+	}
+	if outputPath == "" {
+		logger.Fatalln("-out is required")
+	}
+	if passphrasePath == "" {
+		logger.Fatalln("-passphrase-file is required")
+	}
+	passphrase := readPassphrase(passphrasePath)
+
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer inFile.Close()
+	if enc {
+		err = openPGPEncrypt(inFile, passphrase)
+	} else {
+		err = openPGPDecrypt(inFile, passphrase)
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		log.Fatalln(err.Error())
+	}
+}
+
+// readPassphrase returns the first line of the file at path.
+func readPassphrase(path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	passphrase := bytes.TrimRight(bytes.SplitN(data, []byte("\n"), 2)[0], "\r")
+	if len(passphrase) == 0 {
+		logger.Fatalln("The passphrase is empty")
+	}
+	return passphrase
+}
+
+func openPGPEncrypt(inFile *os.File, passphrase []byte) error {
+	params := &gcm.OpenPGPParams{FileName: filepath.Base(inputPath)}
+	if iteratedS2K {
+		params.S2K = gcm.OpenPGPS2KIterated
+	}
+	if info, err := inFile.Stat(); err == nil {
+		params.ModTime = info.ModTime()
+	}
+	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	w, err := gcm.NewOpenPGPEncryptWriter(outFile, passphrase, params)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, inFile); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return outFile.Close()
+}
+
+func openPGPDecrypt(inFile *os.File, passphrase []byte) error {
+	r, err := gcm.NewOpenPGPDecryptReader(inFile, passphrase)
+	if err != nil {
+		return err
+	}
+	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	if _, err := io.Copy(outFile, r); err != nil {
+		return err
+	}
+	return outFile.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/catalyzeio/gcm/gcm"
+)
+
+// progressInterval is the minimum time between progress log lines.
+const progressInterval = time.Second
+
+// newProgressLogger returns a gcm.ProgressFunc that logs throughput and an
+// estimated time remaining to the logger at most once per progressInterval.
+func newProgressLogger() gcm.ProgressFunc {
+	start := time.Now()
+	last := start
+	return func(p gcm.Progress) {
+		now := time.Now()
+		done := p.Total > 0 && p.Bytes >= p.Total
+		if now.Sub(last) < progressInterval && !done {
+			return
+		}
+		last = now
+
+		elapsed := now.Sub(start).Seconds()
+		rate := 0.0
+		if elapsed > 0 {
+			rate = float64(p.Bytes) / elapsed
+		}
+		if p.Total <= 0 {
+			logger.Printf("%s processed, %s/s", formatBytes(float64(p.Bytes)), formatBytes(rate))
+			return
+		}
+		eta := "unknown"
+		if rate > 0 {
+			remaining := float64(p.Total-p.Bytes) / rate
+			eta = (time.Duration(remaining) * time.Second).String()
+		}
+		logger.Printf("%s / %s (%.1f%%), %s/s, ETA %s",
+			formatBytes(float64(p.Bytes)), formatBytes(float64(p.Total)),
+			100*float64(p.Bytes)/float64(p.Total), formatBytes(rate), eta)
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/catalyzeio/gcm/gcm"
+)
+
+func init() {
+	commands["salvage"] = runSalvage
+}
+
+// runSalvage recovers the intact chunks of a damaged file and prints a
+// report of the damaged ones.
+func runSalvage(args []string) {
+	var omit bool
+	flags := flag.NewFlagSet("salvage", flag.ExitOnError)
+	flags.StringVar(&keyString, "K", "", "The hex encoded key")
+	flags.StringVar(&ivString, "iv", "", "The hex encoded IV")
+	flags.StringVar(&inputPath, "in", "", "The damaged input file")
+	flags.StringVar(&outputPath, "out", "", "The output file")
+	flags.BoolVar(&omit, "omit", false, "Leave damaged chunks out of the output instead of filling them with zeros")
+	flags.Parse(args)
+	checkRequiredFlags()
+	aad, err := hex.DecodeString(gcm.AAD)
+	if err != nil {
+		panic(err)
+	}
+	report, err := gcm.SalvageFile(inputPath, outputPath, parseKey(), parseIV(), aad, omit)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if report.MetadataDamaged {
+		fmt.Println("Metadata: damaged")
+	} else if report.Metadata != nil {
+		fmt.Printf("Metadata: %s\n", report.Metadata.Name)
+	}
+	fmt.Printf("Chunks: %d, damaged: %d, written: %d bytes\n", report.Chunks, len(report.Damaged), report.Written)
+	if report.Repaired > 0 {
+		fmt.Printf("Repaired from parity: %d chunks\n", report.Repaired)
+	}
+	for _, d := range report.Damaged {
+		if d.OutputSize == 0 {
+			fmt.Printf("Chunk %d: input bytes %d-%d, omitted at output byte %d\n",
+				d.Index, d.Offset, d.Offset+d.Size-1, d.OutputOffset)
+			continue
+		}
+		fmt.Printf("Chunk %d: input bytes %d-%d, output bytes %d-%d\n",
+			d.Index, d.Offset, d.Offset+d.Size-1, d.OutputOffset, d.OutputOffset+d.OutputSize-1)
+	}
+	if report.Truncated {
+		fmt.Println("The file is truncated: it ends with a full chunk")
+	}
+}
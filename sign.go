@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/catalyzeio/gcm/gcm"
+)
+
+var (
+	signKeyPath string
+	trustedPath string
+)
+
+func init() {
+	commands["verify"] = runVerify
+	commands["keygen"] = runKeygen
+}
+
+// signingOptions loads the keys named by -sign-key and -trusted into opts.
+func signingOptions(opts *gcm.Options) {
+	var err error
+	if signKeyPath != "" {
+		if opts.SigningKey, err = gcm.ReadSigningKey(signKeyPath); err != nil {
+			logger.Fatalf("Invalid -sign-key: %s.", err)
+		}
+	}
+	if trustedPath != "" {
+		if opts.TrustedKeys, err = gcm.ReadTrustedKeys(trustedPath); err != nil {
+			logger.Fatalf("Invalid -trusted: %s.", err)
+		}
+		if len(opts.TrustedKeys) == 0 {
+			logger.Fatalf("Invalid -trusted: %s has no keys.", trustedPath)
+		}
+	}
+}
+
+// runVerify checks that an encrypted file decrypts and is signed by a
+// trusted key, without writing the plaintext.
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.StringVar(&keyString, "K", "", "The hex encoded key")
+	flags.StringVar(&ivString, "iv", "", "The hex encoded IV")
+	flags.StringVar(&inputPath, "in", "", "The input file")
+	flags.StringVar(&trustedPath, "trusted", "", "A file of trusted hex encoded public keys, one per line")
+	flags.Parse(args)
+	if keyString == "" {
+		logger.Fatalln("-K is required")
+	}
+	if ivString == "" {
+		logger.Fatalln("-iv is required")
+	}
+	if inputPath == "" {
+		logger.Fatalln("-in is required")
+	}
+	if trustedPath == "" {
+		logger.Fatalln("-trusted is required")
+	}
+	aad, err := hex.DecodeString(gcm.AAD)
+	if err != nil {
+		panic(err)
+	}
+	opts := &gcm.Options{}
+	signingOptions(opts)
+	signer, err := gcm.VerifyFile(inputPath, parseKey(), parseIV(), aad, opts)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	fmt.Printf("Good signature from %x\n", []byte(signer))
+}
+
+// runKeygen writes a new signing key seed to -out and prints the public key.
+func runKeygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	flags.StringVar(&outputPath, "out", "", "The file to write the hex encoded signing key to")
+	flags.Parse(args)
+	if outputPath == "" {
+		logger.Fatalln("-out is required")
+	}
+	pub, priv, err := gcm.GenerateSigningKey()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	seed := hex.EncodeToString(priv.Seed()) + "\n"
+	if err := ioutil.WriteFile(outputPath, []byte(seed), 0600); err != nil {
+		log.Fatalln(err.Error())
+	}
+	fmt.Printf("%x\n", []byte(pub))
+}